@@ -0,0 +1,147 @@
+// Package audioinfo reads basic stream properties (codec, bitrate, sample rate, etc.) directly from
+// audio file headers, without relying on any external tools.
+package audioinfo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrUnsupportedFormat is returned when the given file is not in a format this package can parse.
+var ErrUnsupportedFormat = errors.New("unsupported audio format")
+
+// Info describes the primary audio stream in a file.
+type Info struct {
+	Codec      string        `json:"codec,omitempty"`       // short codec name, matching ffmpeg's naming where possible (eg. "mp3", "aac", "alac", "flac")
+	Lossless   bool          `json:"lossless,omitempty"`    // whether the codec is lossless
+	Bitrate    int           `json:"bitrate"`               // average bitrate, in bits per second
+	SampleRate int           `json:"sample_rate,omitempty"` // sample rate, in Hz
+	BitDepth   int           `json:"bit_depth,omitempty"`   // bits per sample; 0 for lossy codecs, where it's not meaningful
+	Channels   int           `json:"channels,omitempty"`    // number of audio channels
+	Duration   time.Duration `json:"duration,omitempty"`    // duration of the audio stream
+}
+
+// Read parses the headers of the audio file at the given path.
+// ErrUnsupportedFormat (possibly wrapped) is returned if the file's format isn't one this package
+// understands, or if its headers don't contain enough information to determine its bitrate.
+func Read(path string) (*Info, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return read(f, stat.Size())
+}
+
+func read(r io.ReaderAt, size int64) (*Info, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrUnsupportedFormat
+		}
+		return nil, err
+	}
+
+	var info *Info
+	var err error
+	switch {
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		info, err = readMP4(r, size)
+	case bytes.Equal(header[0:4], []byte("fLaC")):
+		info, err = readFLAC(r, size, 0)
+	case bytes.Equal(header[0:4], []byte("OggS")):
+		info, err = readOgg(r, size)
+	case (bytes.Equal(header[0:4], []byte("RIFF")) || bytes.Equal(header[0:4], []byte("RF64"))) && bytes.Equal(header[8:12], []byte("WAVE")):
+		info, err = readWAV(r, size)
+	case bytes.Equal(header[0:4], []byte("FORM")) && (bytes.Equal(header[8:12], []byte("AIFF")) || bytes.Equal(header[8:12], []byte("AIFC"))):
+		info, err = readAIFF(r, size, bytes.Equal(header[8:12], []byte("AIFC")))
+	case bytes.Equal(header[0:3], []byte("ID3")):
+		// FLAC files occasionally carry an ID3v2 tag, too:
+		tagSize := id3v2Size(header)
+		magic := make([]byte, 4)
+		if _, magicErr := r.ReadAt(magic, tagSize); magicErr == nil && bytes.Equal(magic, []byte("fLaC")) {
+			info, err = readFLAC(r, size, tagSize)
+		} else {
+			info, err = readMP3(r, size, tagSize)
+		}
+	default:
+		info, err = readMP3(r, size, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Bitrate <= 0 {
+		return nil, fmt.Errorf("%w: could not determine bitrate", ErrUnsupportedFormat)
+	}
+	return info, nil
+}
+
+// losslessCodecs is the set of lossless codec names, as used in Info.Codec.
+var losslessCodecs = map[string]bool{
+	"alac":        true,
+	"ape":         true,
+	"flac":        true,
+	"mlp":         true,
+	"pcm":         true,
+	"shorten":     true,
+	"truehd":      true,
+	"tta":         true,
+	"wavpack":     true,
+	"wmalossless": true,
+}
+
+// NormalizeCodecName maps the given codec name (as reported by ffprobe, for example) to the name
+// used by this package. In particular, all PCM variants (eg. "pcm_s16le") become "pcm", and all DSD
+// variants become "dsd".
+func NormalizeCodecName(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(name, "pcm_"):
+		return "pcm"
+	case strings.HasPrefix(name, "dsd_"):
+		return "dsd"
+	}
+	return name
+}
+
+// IsLosslessCodec returns true iff the named codec is lossless. DSD is treated as lossless.
+func IsLosslessCodec(name string) bool {
+	name = NormalizeCodecName(name)
+	return losslessCodecs[name] || name == "dsd"
+}
+
+// id3v2Size returns the total size of the ID3v2 tag whose 10-byte header is given.
+func id3v2Size(header []byte) int64 {
+	size := int64(header[6]&0x7f)<<21 | int64(header[7]&0x7f)<<14 | int64(header[8]&0x7f)<<7 | int64(header[9]&0x7f)
+	size += 10
+	if header[5]&0x10 != 0 {
+		// footer present
+		size += 10
+	}
+	return size
+}
+
+// bitrateFor returns the average bitrate, in bits per second, of the given number of bytes
+// spread over the given duration.
+func bitrateFor(byteCount int64, d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(float64(byteCount*8) / d.Seconds())
+}
+
+func durationFor(sampleCount int64, sampleRate int) time.Duration {
+	if sampleRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(sampleCount) / float64(sampleRate) * float64(time.Second))
+}
@@ -0,0 +1,248 @@
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func le16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	return b
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+// id3v2Header returns an ID3v2 tag header for a tag of the given version, flags, and size (excluding the header).
+func id3v2Header(version, flags byte, size int) []byte {
+	return []byte{'I', 'D', '3', version, 0, flags, byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+}
+
+// mp3Frames returns count MPEG-1 Layer III frames at 128 Kbps and 44.1 kHz, in joint stereo.
+func mp3Frames(count int) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+	return bytes.Repeat(frame, count)
+}
+
+// mp3XingFile returns a VBR MP3 file with a Xing header claiming the given frame and byte counts.
+func mp3XingFile(frameCount, byteCount uint32) []byte {
+	xing := make([]byte, 417)
+	copy(xing, []byte{0xff, 0xfb, 0x90, 0x00})
+	copy(xing[36:], "Xing")
+	copy(xing[40:], be32(3))
+	copy(xing[44:], be32(frameCount))
+	copy(xing[48:], be32(byteCount))
+	return append(xing, mp3Frames(99)...)
+}
+
+// flacFile returns a FLAC file with the given stream properties, followed by the given (extra) metadata
+// blocks, and audioSize bytes of audio data.
+func flacFile(sampleRate, channels, bitDepth int, totalSamples int64, audioSize int, blocks ...[]byte) []byte {
+	streamInfo := make([]byte, 34)
+	streamInfo[10] = byte(sampleRate >> 12)
+	streamInfo[11] = byte(sampleRate >> 4)
+	streamInfo[12] = byte(sampleRate&0xf)<<4 | byte(channels-1)<<1 | byte(bitDepth-1)>>4
+	streamInfo[13] = byte(bitDepth-1)<<4 | byte(totalSamples>>32&0xf)
+	binary.BigEndian.PutUint32(streamInfo[14:], uint32(totalSamples))
+
+	f := []byte("fLaC")
+	streamInfoType := byte(flacBlockTypeStreamInfo)
+	if len(blocks) == 0 {
+		streamInfoType |= 0x80
+	}
+	f = append(f, streamInfoType, 0, 0, 34)
+	f = append(f, streamInfo...)
+	for i, block := range blocks {
+		if i == len(blocks)-1 {
+			block = append([]byte{block[0] | 0x80}, block[1:]...)
+		}
+		f = append(f, block...)
+	}
+	return append(f, make([]byte, audioSize)...)
+}
+
+// flacBlock returns a FLAC metadata block of the given type and contents.
+func flacBlock(blockType byte, data []byte) []byte {
+	return append([]byte{blockType, byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}, data...)
+}
+
+// mp4BoxBytes returns an MP4 box of the given type, containing the given payloads.
+func mp4BoxBytes(boxType string, payload ...[]byte) []byte {
+	p := bytes.Join(payload, nil)
+	return append(append(be32(uint32(8+len(p))), boxType...), p...)
+}
+
+// m4aFile returns an AAC-in-MP4 file, with the given iTunes-style metadata items (if any), whose
+// audio track runs for 10 seconds at 44.1 kHz, in 500 samples of 400 bytes each.
+func m4aFile(items ...[]byte) []byte {
+	esds := append(be32(0), 0x03, 25, 0, 1, 0, 0x04, 17, 0x40, 0x15, 0, 0, 0)
+	esds = append(esds, be32(300000)...)
+	esds = append(esds, be32(256000)...)
+	esds = append(esds, 0x05, 2, 0x12, 0x10)
+	entry := append(make([]byte, 6), be16(1)...)
+	entry = append(entry, make([]byte, 8)...)
+	entry = append(entry, be16(2)...)
+	entry = append(entry, be16(16)...)
+	entry = append(entry, make([]byte, 4)...)
+	entry = append(entry, be32(44100<<16)...)
+	mp4a := mp4BoxBytes("mp4a", entry, mp4BoxBytes("esds", esds))
+	stsd := mp4BoxBytes("stsd", be32(0), be32(1), mp4a)
+	stsz := mp4BoxBytes("stsz", be32(0), be32(500), be32(400))
+	mdhd := mp4BoxBytes("mdhd", be32(0), be32(0), be32(0), be32(44100), be32(441000), be32(0))
+	hdlr := mp4BoxBytes("hdlr", be32(0), be32(0), []byte("soun"), make([]byte, 12))
+	trak := mp4BoxBytes("trak", mp4BoxBytes("mdia", mdhd, hdlr, mp4BoxBytes("minf", mp4BoxBytes("stbl", stsd, stsz))))
+	moovChildren := [][]byte{trak}
+	if len(items) > 0 {
+		metaHdlr := mp4BoxBytes("hdlr", be32(0), be32(0), []byte("mdir"), make([]byte, 12))
+		meta := mp4BoxBytes("meta", be32(0), metaHdlr, mp4BoxBytes("ilst", items...))
+		moovChildren = append(moovChildren, mp4BoxBytes("udta", meta))
+	}
+	return append(mp4BoxBytes("ftyp", []byte("M4A "), be32(0)), mp4BoxBytes("moov", moovChildren...)...)
+}
+
+// oggPageBytes returns an Ogg page with the given header type flags and granule position, holding the given packets.
+func oggPageBytes(flags byte, granule int64, serial uint32, packets ...[]byte) []byte {
+	var segments, payload []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			segments = append(segments, 255)
+		}
+		segments = append(segments, byte(n))
+		payload = append(payload, p...)
+	}
+	h := make([]byte, 27)
+	copy(h, "OggS")
+	h[5] = flags
+	binary.LittleEndian.PutUint64(h[6:], uint64(granule))
+	binary.LittleEndian.PutUint32(h[14:], serial)
+	h[26] = byte(len(segments))
+	return append(append(h, segments...), payload...)
+}
+
+// opusFile returns an Ogg Opus file with the given comment header packet, lasting 10 seconds.
+func opusFile(commentHeader []byte) []byte {
+	head := append([]byte("OpusHead\x01\x02"), 0x38, 0x01, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	var b []byte
+	b = append(b, oggPageBytes(0x02, 0, 7, head)...)
+	b = append(b, oggPageBytes(0, 0, 7, commentHeader)...)
+	b = append(b, oggPageBytes(0, 48000*5, 7, make([]byte, 20000))...)
+	return append(b, oggPageBytes(0x04, 48000*10+312, 7, make([]byte, 20000))...)
+}
+
+func TestRead(t *testing.T) {
+	id3Tagged := append(id3v2Header(3, 0, 10), make([]byte, 10)...)
+	id3Tagged = append(id3Tagged, mp3Frames(100)...)
+	id3TaggedFLAC := append(id3v2Header(4, 0, 0), flacFile(48000, 2, 24, 480000, 100000)...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Info
+	}{
+		{"mp3 cbr", mp3Frames(100), Info{Codec: "mp3", Bitrate: 128000, SampleRate: 44100, Channels: 2, Duration: 2606235827}},
+		{"mp3 after id3v2 tag", id3Tagged, Info{Codec: "mp3", Bitrate: 128000, SampleRate: 44100, Channels: 2, Duration: 2606235827}},
+		{"mp3 xing", mp3XingFile(100, 41700), Info{Codec: "mp3", Bitrate: 127706, SampleRate: 44100, Channels: 2, Duration: 2612244897}},
+		{"flac", flacFile(44100, 2, 16, 441000, 100000), Info{Codec: "flac", Lossless: true, Bitrate: 80000, SampleRate: 44100, BitDepth: 16, Channels: 2, Duration: 10 * time.Second}},
+		{"flac after id3v2 tag", id3TaggedFLAC, Info{Codec: "flac", Lossless: true, Bitrate: 80000, SampleRate: 48000, BitDepth: 24, Channels: 2, Duration: 10 * time.Second}},
+		{"m4a", m4aFile(), Info{Codec: "aac", Bitrate: 160000, SampleRate: 44100, Channels: 2, Duration: 10 * time.Second}},
+		{"opus", opusFile(append([]byte("OpusTags"), make([]byte, 8)...)), Info{Codec: "opus", Bitrate: 32169, SampleRate: 48000, Channels: 2, Duration: 10 * time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := read(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("read failed: %s", err)
+			}
+			if *info != tt.want {
+				t.Errorf("read = %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadUnsupported(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte("ID3")},
+		{"text", bytes.Repeat([]byte("not an audio file\n"), 100)},
+		{"id3v2 tag only", append(id3v2Header(3, 0, 10), make([]byte, 10)...)},
+		{"flac without streaminfo", append([]byte("fLaC"), flacBlock(0x81, make([]byte, 10))...)},
+		{"mp4 without moov", mp4BoxBytes("ftyp", []byte("M4A "), be32(0))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := read(bytes.NewReader(tt.data), int64(len(tt.data))); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("read error = %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
+
+// hostileVariants returns copies of the given valid file which are truncated at various points, or have
+// various bytes corrupted. Parsers must reject (or make do with) each without panicking, hanging, or
+// allocating memory in proportion to sizes claimed by the corrupt data.
+func hostileVariants(data []byte) [][]byte {
+	var variants [][]byte
+	step := len(data)/200 + 1
+	for n := 0; n < len(data); n += step {
+		variants = append(variants, data[:n])
+	}
+	limit := len(data)
+	if limit > 512 {
+		limit = 512 // headers are at the start; corrupting the audio data isn't interesting
+	}
+	for i := 0; i < limit; i++ {
+		for _, v := range []byte{0x00, 0x7f, 0x80, 0xff} {
+			corrupt := append([]byte(nil), data...)
+			corrupt[i] = v
+			variants = append(variants, corrupt)
+		}
+	}
+	return variants
+}
+
+func TestReadHostile(t *testing.T) {
+	files := map[string][]byte{
+		"mp3":  mp3XingFile(100, 41700),
+		"flac": flacFile(44100, 2, 16, 441000, 1000),
+		"m4a":  m4aFile(),
+		"opus": opusFile(append([]byte("OpusTags"), make([]byte, 8)...)),
+		"wav":  wavFile(wavFmtChunk(1, 2, 44100, 16), 4000),
+		"aiff": aiffFile(false, aiffCommChunk(2, 44100, 16, 1000, "")),
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			for _, variant := range hostileVariants(data) {
+				// errors are expected; this checks there's no panic:
+				info, err := read(bytes.NewReader(variant), int64(len(variant)))
+				if err == nil && info.Bitrate <= 0 {
+					t.Errorf("read of a %d-byte variant returned bitrate %d without an error", len(variant), info.Bitrate)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package audioinfo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+const (
+	flacBlockTypeStreamInfo    = 0
+	flacBlockTypeVorbisComment = 4
+)
+
+// readFLAC parses a FLAC stream starting at the given offset (which points at the "fLaC" marker).
+func readFLAC(r io.ReaderAt, size int64, offset int64) (*Info, error) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, offset); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, []byte("fLaC")) {
+		return nil, fmt.Errorf("%w: missing FLAC stream marker", ErrUnsupportedFormat)
+	}
+
+	info := &Info{Codec: "flac", Lossless: true}
+	var totalSamples int64
+	foundStreamInfo := false
+	pos := offset + 4
+	for {
+		blockHeader := make([]byte, 4)
+		if _, err := r.ReadAt(blockHeader, pos); err != nil {
+			return nil, fmt.Errorf("failed to read FLAC metadata block header: %w", err)
+		}
+		isLast := blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7f
+		blockLen := int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3])
+		pos += 4
+
+		if blockType == flacBlockTypeStreamInfo {
+			if blockLen < 34 {
+				return nil, fmt.Errorf("%w: FLAC STREAMINFO block is too short", ErrUnsupportedFormat)
+			}
+			b := make([]byte, 34)
+			if _, err := r.ReadAt(b, pos); err != nil {
+				return nil, fmt.Errorf("failed to read FLAC STREAMINFO: %w", err)
+			}
+			// bytes 10-17: sample rate (20 bits), channels-1 (3 bits), bits per sample-1 (5 bits), total samples (36 bits)
+			info.SampleRate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+			info.Channels = int(b[12]>>1&0x07) + 1
+			info.BitDepth = int(b[12]&0x01)<<4 | int(b[13]>>4) + 1
+			totalSamples = int64(b[13]&0x0f)<<32 | int64(b[14])<<24 | int64(b[15])<<16 | int64(b[16])<<8 | int64(b[17])
+			foundStreamInfo = true
+		}
+
+		pos += blockLen
+		if isLast {
+			break
+		}
+	}
+	if !foundStreamInfo {
+		return nil, fmt.Errorf("%w: FLAC stream has no STREAMINFO block", ErrUnsupportedFormat)
+	}
+
+	info.Duration = durationFor(totalSamples, info.SampleRate)
+	info.Bitrate = bitrateFor(size-pos, info.Duration)
+	return info, nil
+}
@@ -0,0 +1,199 @@
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	mpegVersion25 = 0
+	mpegVersion2  = 2
+	mpegVersion1  = 3
+
+	mpegLayer3 = 1
+	mpegLayer2 = 2
+	mpegLayer1 = 3
+
+	// how far past the start of the audio data to search for the first frame:
+	mp3MaxSyncSearch = 64 * 1024
+)
+
+var mp3BitratesKbps = map[[2]int][16]int{
+	{mpegVersion1, mpegLayer1}: {0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, -1},
+	{mpegVersion1, mpegLayer2}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, -1},
+	{mpegVersion1, mpegLayer3}: {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, -1},
+	{mpegVersion2, mpegLayer1}: {0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, -1},
+	{mpegVersion2, mpegLayer2}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1},
+	{mpegVersion2, mpegLayer3}: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1},
+}
+
+var mp3SampleRates = map[int][3]int{
+	mpegVersion1:  {44100, 48000, 32000},
+	mpegVersion2:  {22050, 24000, 16000},
+	mpegVersion25: {11025, 12000, 8000},
+}
+
+type mp3FrameHeader struct {
+	version    int
+	layer      int
+	bitrate    int // bits per second
+	sampleRate int
+	padding    bool
+	mono       bool
+}
+
+func parseMP3FrameHeader(b []byte) (mp3FrameHeader, bool) {
+	var h mp3FrameHeader
+	if len(b) < 4 || b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		return h, false
+	}
+	h.version = int(b[1] >> 3 & 0x03)
+	h.layer = int(b[1] >> 1 & 0x03)
+	if h.version == 1 || h.layer == 0 {
+		return h, false
+	}
+	bitrateIdx := int(b[2] >> 4)
+	sampleRateIdx := int(b[2] >> 2 & 0x03)
+	if bitrateIdx == 0 || bitrateIdx == 15 || sampleRateIdx == 3 {
+		// "free" bitrate streams are vanishingly rare, so we don't bother with them.
+		return h, false
+	}
+	tableVersion := h.version
+	if tableVersion == mpegVersion25 {
+		tableVersion = mpegVersion2
+	}
+	h.bitrate = mp3BitratesKbps[[2]int{tableVersion, h.layer}][bitrateIdx] * 1000
+	h.sampleRate = mp3SampleRates[h.version][sampleRateIdx]
+	h.padding = b[2]&0x02 != 0
+	h.mono = b[3]>>6 == 0x03
+	return h, true
+}
+
+func (h mp3FrameHeader) samplesPerFrame() int {
+	switch {
+	case h.layer == mpegLayer1:
+		return 384
+	case h.layer == mpegLayer3 && h.version != mpegVersion1:
+		return 576
+	default:
+		return 1152
+	}
+}
+
+func (h mp3FrameHeader) frameLength() int {
+	padding := 0
+	if h.padding {
+		padding = 1
+	}
+	if h.layer == mpegLayer1 {
+		return (12*h.bitrate/h.sampleRate + padding) * 4
+	}
+	return h.samplesPerFrame()/8*h.bitrate/h.sampleRate + padding
+}
+
+// sideInfoLength returns the length of the Layer III side information, which precedes
+// any Xing/Info VBR header in the first frame.
+func (h mp3FrameHeader) sideInfoLength() int {
+	switch {
+	case h.version == mpegVersion1 && h.mono:
+		return 17
+	case h.version == mpegVersion1:
+		return 32
+	case h.mono:
+		return 9
+	default:
+		return 17
+	}
+}
+
+func (h mp3FrameHeader) codec() string {
+	switch h.layer {
+	case mpegLayer1:
+		return "mp1"
+	case mpegLayer2:
+		return "mp2"
+	default:
+		return "mp3"
+	}
+}
+
+// readMP3 parses an MPEG audio stream whose data begins at the given offset (ie. after any ID3v2 tag).
+// VBR files are handled via their Xing/Info or VBRI headers; files without one are assumed to be CBR.
+func readMP3(r io.ReaderAt, size int64, offset int64) (*Info, error) {
+	buf := make([]byte, mp3MaxSyncSearch)
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	// find the first frame header which is followed immediately by another valid frame header:
+	frameStart := -1
+	var h mp3FrameHeader
+	for i := 0; i+4 <= len(buf); i++ {
+		candidate, ok := parseMP3FrameHeader(buf[i:])
+		if !ok {
+			continue
+		}
+		next := i + candidate.frameLength()
+		if next+4 <= len(buf) {
+			if _, ok := parseMP3FrameHeader(buf[next:]); !ok {
+				continue
+			}
+		}
+		frameStart = i
+		h = candidate
+		break
+	}
+	if frameStart < 0 {
+		return nil, fmt.Errorf("%w: no MPEG audio frames found", ErrUnsupportedFormat)
+	}
+
+	audioStart := offset + int64(frameStart)
+	audioSize := size - audioStart
+	tail := make([]byte, 3)
+	if _, err := r.ReadAt(tail, size-128); err == nil && bytes.Equal(tail, []byte("TAG")) {
+		audioSize -= 128 // ID3v1 tag
+	}
+
+	info := &Info{
+		Codec:      h.codec(),
+		SampleRate: h.sampleRate,
+		Channels:   2,
+	}
+	if h.mono {
+		info.Channels = 1
+	}
+
+	frame := buf[frameStart:]
+	var frameCount, byteCount int64
+	xingOffset := 4 + h.sideInfoLength()
+	if len(frame) >= xingOffset+16 && (bytes.Equal(frame[xingOffset:xingOffset+4], []byte("Xing")) || bytes.Equal(frame[xingOffset:xingOffset+4], []byte("Info"))) {
+		flags := binary.BigEndian.Uint32(frame[xingOffset+4:])
+		fieldOffset := xingOffset + 8
+		if flags&0x01 != 0 {
+			frameCount = int64(binary.BigEndian.Uint32(frame[fieldOffset:]))
+			fieldOffset += 4
+		}
+		if flags&0x02 != 0 {
+			byteCount = int64(binary.BigEndian.Uint32(frame[fieldOffset:]))
+		}
+	} else if len(frame) >= 36+18 && bytes.Equal(frame[36:40], []byte("VBRI")) {
+		byteCount = int64(binary.BigEndian.Uint32(frame[46:]))
+		frameCount = int64(binary.BigEndian.Uint32(frame[50:]))
+	}
+	if byteCount <= 0 || byteCount > audioSize {
+		byteCount = audioSize
+	}
+
+	if frameCount > 0 {
+		info.Duration = durationFor(frameCount*int64(h.samplesPerFrame()), h.sampleRate)
+		info.Bitrate = bitrateFor(byteCount, info.Duration)
+	} else {
+		info.Bitrate = h.bitrate
+		info.Duration = durationFor(byteCount*8*int64(h.sampleRate)/int64(h.bitrate), h.sampleRate)
+	}
+	return info, nil
+}
@@ -0,0 +1,324 @@
+package audioinfo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// mp4Box is an ISO base media file format box (aka. QuickTime atom).
+type mp4Box struct {
+	boxType    string
+	dataOffset int64 // offset of the box's payload, after its header
+	dataSize   int64 // size of the box's payload
+}
+
+// readMP4Boxes returns the boxes found in the given range of r.
+func readMP4Boxes(r io.ReaderAt, offset, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+	for offset+8 <= end {
+		if _, err := r.ReadAt(header[:8], offset); err != nil {
+			return nil, fmt.Errorf("failed to read MP4 box header: %w", err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[0:4]))
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			size = end - offset
+		case 1:
+			if _, err := r.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, fmt.Errorf("failed to read MP4 box header: %w", err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen || offset+size > end {
+			return nil, fmt.Errorf("%w: malformed MP4 box '%s'", ErrUnsupportedFormat, header[4:8])
+		}
+		boxes = append(boxes, mp4Box{
+			boxType:    string(header[4:8]),
+			dataOffset: offset + headerLen,
+			dataSize:   size - headerLen,
+		})
+		offset += size
+	}
+	return boxes, nil
+}
+
+func findMP4Box(boxes []mp4Box, boxType string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].boxType == boxType {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+// findMP4Path descends through the given nested box types, starting within the given parent box.
+func findMP4Path(r io.ReaderAt, parent mp4Box, path ...string) (*mp4Box, error) {
+	current := &parent
+	for _, boxType := range path {
+		children, err := readMP4Boxes(r, current.dataOffset, current.dataOffset+current.dataSize)
+		if err != nil {
+			return nil, err
+		}
+		current = findMP4Box(children, boxType)
+		if current == nil {
+			return nil, nil
+		}
+	}
+	return current, nil
+}
+
+func readMP4BoxData(r io.ReaderAt, b *mp4Box) ([]byte, error) {
+	data := make([]byte, b.dataSize)
+	if _, err := r.ReadAt(data, b.dataOffset); err != nil {
+		return nil, fmt.Errorf("failed to read MP4 box '%s': %w", b.boxType, err)
+	}
+	return data, nil
+}
+
+// readMP4 parses an MP4/M4A file, returning information about its first audio track.
+func readMP4(r io.ReaderAt, size int64) (*Info, error) {
+	topLevel, err := readMP4Boxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	moov := findMP4Box(topLevel, "moov")
+	if moov == nil {
+		return nil, fmt.Errorf("%w: MP4 file has no moov box", ErrUnsupportedFormat)
+	}
+	traks, err := readMP4Boxes(r, moov.dataOffset, moov.dataOffset+moov.dataSize)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range traks {
+		if trak.boxType != "trak" {
+			continue
+		}
+		hdlr, err := findMP4Path(r, trak, "mdia", "hdlr")
+		if err != nil {
+			return nil, err
+		}
+		if hdlr == nil || hdlr.dataSize < 12 {
+			continue
+		}
+		hdlrData, err := readMP4BoxData(r, hdlr)
+		if err != nil {
+			return nil, err
+		}
+		if string(hdlrData[8:12]) != "soun" {
+			continue
+		}
+		return readMP4AudioTrack(r, trak)
+	}
+	return nil, fmt.Errorf("%w: MP4 file has no audio track", ErrUnsupportedFormat)
+}
+
+func readMP4AudioTrack(r io.ReaderAt, trak mp4Box) (*Info, error) {
+	info := &Info{}
+
+	mdhd, err := findMP4Path(r, trak, "mdia", "mdhd")
+	if err != nil {
+		return nil, err
+	}
+	if mdhd != nil {
+		data, err := readMP4BoxData(r, mdhd)
+		if err != nil {
+			return nil, err
+		}
+		var timescale, duration uint64
+		if len(data) >= 32 && data[0] == 1 {
+			timescale = uint64(binary.BigEndian.Uint32(data[20:24]))
+			duration = binary.BigEndian.Uint64(data[24:32])
+		} else if len(data) >= 20 {
+			timescale = uint64(binary.BigEndian.Uint32(data[12:16]))
+			duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+		}
+		if timescale > 0 {
+			info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+		}
+	}
+
+	stbl, err := findMP4Path(r, trak, "mdia", "minf", "stbl")
+	if err != nil {
+		return nil, err
+	}
+	if stbl == nil {
+		return nil, fmt.Errorf("%w: MP4 audio track has no sample table", ErrUnsupportedFormat)
+	}
+
+	declaredBitrate := 0
+	stsd, err := findMP4Path(r, *stbl, "stsd")
+	if err != nil {
+		return nil, err
+	}
+	if stsd != nil && stsd.dataSize > 8 {
+		// stsd: version/flags (4), entry count (4), then sample entries (which are boxes):
+		entries, err := readMP4Boxes(r, stsd.dataOffset+8, stsd.dataOffset+stsd.dataSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			declaredBitrate, err = readMP4AudioSampleEntry(r, entries[0], info)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// compute the actual average bitrate from the sample size table, if possible:
+	stsz, err := findMP4Path(r, *stbl, "stsz")
+	if err != nil {
+		return nil, err
+	}
+	if stsz != nil && stsz.dataSize >= 12 && info.Duration > 0 {
+		data, err := readMP4BoxData(r, stsz)
+		if err != nil {
+			return nil, err
+		}
+		sampleSize := int64(binary.BigEndian.Uint32(data[4:8]))
+		sampleCount := int64(binary.BigEndian.Uint32(data[8:12]))
+		totalSize := sampleSize * sampleCount
+		if sampleSize == 0 {
+			for i := int64(0); i < sampleCount && 12+4*i+4 <= int64(len(data)); i++ {
+				totalSize += int64(binary.BigEndian.Uint32(data[12+4*i:]))
+			}
+		}
+		info.Bitrate = bitrateFor(totalSize, info.Duration)
+	}
+	if info.Bitrate <= 0 {
+		info.Bitrate = declaredBitrate
+	}
+	return info, nil
+}
+
+// readMP4AudioSampleEntry fills in the given Info from an audio sample entry box, and
+// returns the bitrate declared in the entry's decoder configuration, if any.
+func readMP4AudioSampleEntry(r io.ReaderAt, entry mp4Box, info *Info) (int, error) {
+	data, err := readMP4BoxData(r, &entry)
+	if err != nil {
+		return 0, err
+	}
+	// reserved (6), data reference index (2), version (2), revision (2), vendor (4),
+	// channel count (2), sample size (2), compression id (2), packet size (2), sample rate (16.16 fixed point, 4)
+	if len(data) < 28 {
+		return 0, fmt.Errorf("%w: MP4 audio sample entry is too short", ErrUnsupportedFormat)
+	}
+	info.Channels = int(binary.BigEndian.Uint16(data[16:18]))
+	info.SampleRate = int(binary.BigEndian.Uint32(data[24:28]) >> 16)
+	childrenOffset := int64(28)
+	switch binary.BigEndian.Uint16(data[8:10]) {
+	case 1:
+		childrenOffset += 16 // QuickTime sound sample description v1
+	case 2:
+		childrenOffset += 36 // QuickTime sound sample description v2
+	}
+	children, err := readMP4Boxes(r, entry.dataOffset+childrenOffset, entry.dataOffset+entry.dataSize)
+	if err != nil {
+		return 0, err
+	}
+	if wave := findMP4Box(children, "wave"); wave != nil {
+		// QuickTime files may nest the codec config in a 'wave' box:
+		if waveChildren, err := readMP4Boxes(r, wave.dataOffset, wave.dataOffset+wave.dataSize); err == nil {
+			children = append(children, waveChildren...)
+		}
+	}
+
+	switch entry.boxType {
+	case "mp4a":
+		info.Codec = "aac"
+		if esds := findMP4Box(children, "esds"); esds != nil {
+			esdsData, err := readMP4BoxData(r, esds)
+			if err != nil {
+				return 0, err
+			}
+			return parseMP4ESDS(esdsData, info), nil
+		}
+	case "alac":
+		info.Codec = "alac"
+		info.Lossless = true
+		if alac := findMP4Box(children, "alac"); alac != nil {
+			alacData, err := readMP4BoxData(r, alac)
+			if err != nil {
+				return 0, err
+			}
+			// version/flags (4), then ALACSpecificConfig: frame length (4), compatible version (1), bit depth (1),
+			// pb (1), mb (1), kb (1), channels (1), max run (2), max frame bytes (4), avg bitrate (4), sample rate (4)
+			if len(alacData) >= 28 {
+				info.BitDepth = int(alacData[9])
+				info.Channels = int(alacData[13])
+				info.SampleRate = int(binary.BigEndian.Uint32(alacData[24:28]))
+				return int(binary.BigEndian.Uint32(alacData[20:24])), nil
+			}
+		}
+	case "fLaC":
+		info.Codec = "flac"
+		info.Lossless = true
+	case "Opus":
+		info.Codec = "opus"
+	case "ac-3":
+		info.Codec = "ac3"
+	case "ec-3":
+		info.Codec = "eac3"
+	case ".mp3":
+		info.Codec = "mp3"
+	default:
+		return 0, fmt.Errorf("%w: unknown MP4 audio sample entry '%s'", ErrUnsupportedFormat, entry.boxType)
+	}
+	return 0, nil
+}
+
+// parseMP4ESDS parses an elementary stream descriptor box, updating the codec in the given Info
+// and returning the stream's declared average bitrate.
+func parseMP4ESDS(data []byte, info *Info) int {
+	if len(data) < 4 {
+		return 0
+	}
+	pos := 4 // version/flags
+	readDescriptor := func() (tag byte, length int, ok bool) {
+		if pos >= len(data) {
+			return 0, 0, false
+		}
+		tag = data[pos]
+		pos++
+		for i := 0; i < 4 && pos < len(data); i++ {
+			b := data[pos]
+			pos++
+			length = length<<7 | int(b&0x7f)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return tag, length, true
+	}
+
+	tag, _, ok := readDescriptor()
+	if !ok || tag != 0x03 || pos+3 > len(data) {
+		return 0
+	}
+	flags := data[pos+2]
+	pos += 3 // ES ID (2), flags (1)
+	if flags&0x80 != 0 {
+		pos += 2 // depends-on ES ID
+	}
+	if flags&0x40 != 0 && pos < len(data) {
+		pos += int(data[pos]) + 1 // URL
+	}
+	if flags&0x20 != 0 {
+		pos += 2 // OCR ES ID
+	}
+
+	tag, _, ok = readDescriptor()
+	if !ok || tag != 0x04 || pos+13 > len(data) {
+		return 0
+	}
+	// object type (1), stream type (1), buffer size (3), max bitrate (4), avg bitrate (4)
+	switch data[pos] {
+	case 0x69, 0x6b:
+		info.Codec = "mp3"
+	}
+	return int(binary.BigEndian.Uint32(data[pos+9 : pos+13]))
+}
@@ -0,0 +1,181 @@
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	oggPageHeaderLen = 27
+	oggFlagBOS       = 0x02
+
+	// how far from the end of the file to search for the last page:
+	oggMaxTailSearch = 64 * 1024
+)
+
+type oggPage struct {
+	offset     int64
+	length     int64 // total length of the page, including its header
+	flags      byte
+	granule    int64
+	serial     uint32
+	segments   []byte // the page's lacing values
+	firstBytes []byte // the start of the page's payload
+}
+
+func readOggPage(r io.ReaderAt, offset int64) (*oggPage, error) {
+	header := make([]byte, oggPageHeaderLen)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, fmt.Errorf("failed to read Ogg page: %w", err)
+	}
+	if !bytes.Equal(header[0:4], []byte("OggS")) {
+		return nil, fmt.Errorf("%w: bad Ogg page at offset %d", ErrUnsupportedFormat, offset)
+	}
+	p := &oggPage{
+		offset:  offset,
+		flags:   header[5],
+		granule: int64(binary.LittleEndian.Uint64(header[6:14])),
+		serial:  binary.LittleEndian.Uint32(header[14:18]),
+	}
+	p.segments = make([]byte, header[26])
+	if _, err := r.ReadAt(p.segments, offset+oggPageHeaderLen); err != nil {
+		return nil, fmt.Errorf("failed to read Ogg page: %w", err)
+	}
+	payloadLen := int64(0)
+	for _, s := range p.segments {
+		payloadLen += int64(s)
+	}
+	payloadOffset := offset + oggPageHeaderLen + int64(len(p.segments))
+	p.length = payloadOffset - offset + payloadLen
+
+	first := payloadLen
+	if first > 64 {
+		first = 64
+	}
+	p.firstBytes = make([]byte, first)
+	if _, err := r.ReadAt(p.firstBytes, payloadOffset); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read Ogg page: %w", err)
+	}
+	return p, nil
+}
+
+// completedPackets returns the number of packets which end on this page.
+func (p *oggPage) completedPackets() int {
+	count := 0
+	for _, s := range p.segments {
+		if s < 255 {
+			count++
+		}
+	}
+	return count
+}
+
+// oggStreamCodec identifies the codec of an Ogg logical stream from its first packet.
+func oggStreamCodec(firstPacket []byte) string {
+	switch {
+	case bytes.HasPrefix(firstPacket, []byte("\x01vorbis")):
+		return "vorbis"
+	case bytes.HasPrefix(firstPacket, []byte("OpusHead")):
+		return "opus"
+	case bytes.HasPrefix(firstPacket, []byte("\x7fFLAC")):
+		return "flac"
+	case bytes.HasPrefix(firstPacket, []byte("Speex   ")):
+		return "speex"
+	case bytes.HasPrefix(firstPacket, []byte("\x80theora")):
+		return "theora"
+	}
+	return ""
+}
+
+// readOgg parses an Ogg Vorbis, Opus, or FLAC file. Only the first logical stream is considered.
+func readOgg(r io.ReaderAt, size int64) (*Info, error) {
+	first, err := readOggPage(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	b := first.firstBytes
+	info := &Info{Codec: oggStreamCodec(b)}
+	var headerPackets int
+	var granuleRate int
+	var preSkip int64
+	switch info.Codec {
+	case "vorbis":
+		// packet type (1), "vorbis" (6), version (4), channels (1), sample rate (4), ...
+		if len(b) < 16 {
+			return nil, fmt.Errorf("%w: Vorbis identification header is too short", ErrUnsupportedFormat)
+		}
+		info.Channels = int(b[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(b[12:16]))
+		granuleRate = info.SampleRate
+		headerPackets = 3
+	case "opus":
+		// "OpusHead" (8), version (1), channels (1), pre-skip (2), input sample rate (4), ...
+		if len(b) < 16 {
+			return nil, fmt.Errorf("%w: Opus identification header is too short", ErrUnsupportedFormat)
+		}
+		info.Channels = int(b[9])
+		preSkip = int64(binary.LittleEndian.Uint16(b[10:12]))
+		info.SampleRate = int(binary.LittleEndian.Uint32(b[12:16]))
+		if info.SampleRate == 0 {
+			info.SampleRate = 48000
+		}
+		granuleRate = 48000 // Opus granule positions are always at 48 kHz
+		headerPackets = 2
+	case "flac":
+		// 0x7F "FLAC" (5), version (2), header packet count (2), "fLaC" (4), STREAMINFO block header (4), STREAMINFO (34)
+		if len(b) < 51 || !bytes.Equal(b[9:13], []byte("fLaC")) {
+			return nil, fmt.Errorf("%w: Ogg FLAC identification header is malformed", ErrUnsupportedFormat)
+		}
+		si := b[17:]
+		info.Lossless = true
+		info.SampleRate = int(si[10])<<12 | int(si[11])<<4 | int(si[12])>>4
+		info.Channels = int(si[12]>>1&0x07) + 1
+		info.BitDepth = int(si[12]&0x01)<<4 | int(si[13]>>4) + 1
+		granuleRate = info.SampleRate
+		headerPackets = 1 + int(binary.BigEndian.Uint16(b[7:9]))
+	default:
+		return nil, fmt.Errorf("%w: unsupported Ogg stream", ErrUnsupportedFormat)
+	}
+
+	// the header packets always end on a page boundary; audio data starts on the page after the last one:
+	audioStart := int64(0)
+	for page, packets := first, 0; ; {
+		if page.serial == first.serial {
+			packets += page.completedPackets()
+		}
+		audioStart = page.offset + page.length
+		if packets >= headerPackets {
+			break
+		}
+		if page, err = readOggPage(r, audioStart); err != nil {
+			return nil, err
+		}
+	}
+
+	// the granule position of the stream's last page gives its total length, in samples:
+	tailStart := size - oggMaxTailSearch
+	if tailStart < audioStart {
+		tailStart = audioStart
+	}
+	tail := make([]byte, size-tailStart)
+	if _, err := r.ReadAt(tail, tailStart); err != nil && err != io.EOF {
+		return nil, err
+	}
+	lastGranule := int64(-1)
+	for i := bytes.LastIndex(tail, []byte("OggS")); i >= 0; i = bytes.LastIndex(tail[:i], []byte("OggS")) {
+		page, err := readOggPage(r, tailStart+int64(i))
+		if err != nil || page.serial != first.serial || page.granule < 0 {
+			continue
+		}
+		lastGranule = page.granule
+		break
+	}
+	if lastGranule <= preSkip {
+		return nil, fmt.Errorf("%w: could not determine Ogg stream length", ErrUnsupportedFormat)
+	}
+	info.Duration = durationFor(lastGranule-preSkip, granuleRate)
+	info.Bitrate = bitrateFor(size-audioStart, info.Duration)
+	return info, nil
+}
@@ -0,0 +1,141 @@
+package audioinfo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	waveFormatPCM        = 0x0001
+	waveFormatIEEEFloat  = 0x0003
+	waveFormatExtensible = 0xfffe
+)
+
+// maxFormatChunkSize limits the size of a WAV fmt or AIFF COMM chunk. Real ones are a few dozen bytes;
+// larger sizes come from corrupt files, and aren't worth allocating memory for.
+const maxFormatChunkSize = 1024
+
+// readWAV parses a RIFF WAVE (or RF64) file. Only PCM data is supported.
+func readWAV(r io.ReaderAt, size int64) (*Info, error) {
+	var info *Info
+	var byteRate, dataSize int64
+	pos := int64(12)
+	header := make([]byte, 8)
+	for pos+8 <= size {
+		if _, err := r.ReadAt(header, pos); err != nil {
+			return nil, fmt.Errorf("failed to read WAV chunk header: %w", err)
+		}
+		chunkID := string(header[0:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(header[4:8]))
+		pos += 8
+		switch chunkID {
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, fmt.Errorf("%w: WAV fmt chunk is too short", ErrUnsupportedFormat)
+			}
+			if chunkSize > maxFormatChunkSize || pos+chunkSize > size {
+				return nil, fmt.Errorf("%w: WAV fmt chunk is too long", ErrUnsupportedFormat)
+			}
+			fmtChunk := make([]byte, chunkSize)
+			if _, err := r.ReadAt(fmtChunk, pos); err != nil {
+				return nil, fmt.Errorf("failed to read WAV fmt chunk: %w", err)
+			}
+			formatTag := binary.LittleEndian.Uint16(fmtChunk[0:2])
+			if formatTag == waveFormatExtensible && chunkSize >= 26 {
+				// the first two bytes of the subformat GUID are the actual format tag:
+				formatTag = binary.LittleEndian.Uint16(fmtChunk[24:26])
+			}
+			if formatTag != waveFormatPCM && formatTag != waveFormatIEEEFloat {
+				return nil, fmt.Errorf("%w: WAV format 0x%04x", ErrUnsupportedFormat, formatTag)
+			}
+			info = &Info{
+				Codec:      "pcm",
+				Lossless:   true,
+				Channels:   int(binary.LittleEndian.Uint16(fmtChunk[2:4])),
+				SampleRate: int(binary.LittleEndian.Uint32(fmtChunk[4:8])),
+				BitDepth:   int(binary.LittleEndian.Uint16(fmtChunk[14:16])),
+			}
+			byteRate = int64(binary.LittleEndian.Uint32(fmtChunk[8:12]))
+		case "data":
+			dataSize = chunkSize
+			if dataSize == 0xffffffff || pos+dataSize > size {
+				// RF64 files (and truncated files) don't have a usable size here:
+				dataSize = size - pos
+			}
+		}
+		if info != nil && dataSize > 0 {
+			break
+		}
+		pos += chunkSize + chunkSize%2 // chunks are padded to an even size
+	}
+	if info == nil || byteRate <= 0 {
+		return nil, fmt.Errorf("%w: WAV file has no fmt chunk", ErrUnsupportedFormat)
+	}
+	info.Bitrate = int(byteRate * 8)
+	info.Duration = durationFor(dataSize*8*int64(info.SampleRate)/int64(info.Bitrate), info.SampleRate)
+	return info, nil
+}
+
+// readAIFF parses an AIFF or AIFF-C file. Only uncompressed PCM data is supported.
+func readAIFF(r io.ReaderAt, size int64, isAIFC bool) (*Info, error) {
+	pos := int64(12)
+	header := make([]byte, 8)
+	for pos+8 <= size {
+		if _, err := r.ReadAt(header, pos); err != nil {
+			return nil, fmt.Errorf("failed to read AIFF chunk header: %w", err)
+		}
+		chunkID := string(header[0:4])
+		chunkSize := int64(binary.BigEndian.Uint32(header[4:8]))
+		pos += 8
+		if chunkID != "COMM" {
+			pos += chunkSize + chunkSize%2 // chunks are padded to an even size
+			continue
+		}
+
+		if chunkSize < 18 {
+			return nil, fmt.Errorf("%w: AIFF COMM chunk is too short", ErrUnsupportedFormat)
+		}
+		if chunkSize > maxFormatChunkSize || pos+chunkSize > size {
+			return nil, fmt.Errorf("%w: AIFF COMM chunk is too long", ErrUnsupportedFormat)
+		}
+		comm := make([]byte, chunkSize)
+		if _, err := r.ReadAt(comm, pos); err != nil {
+			return nil, fmt.Errorf("failed to read AIFF COMM chunk: %w", err)
+		}
+		if isAIFC && chunkSize >= 22 {
+			switch string(comm[18:22]) {
+			case "NONE", "sowt", "twos", "raw ", "in24", "in32", "fl32", "fl64":
+			default:
+				return nil, fmt.Errorf("%w: AIFF-C compression type '%s'", ErrUnsupportedFormat, comm[18:22])
+			}
+		}
+		info := &Info{
+			Codec:      "pcm",
+			Lossless:   true,
+			Channels:   int(binary.BigEndian.Uint16(comm[0:2])),
+			BitDepth:   int(binary.BigEndian.Uint16(comm[6:8])),
+			SampleRate: int(math.Round(parseExtendedFloat(comm[8:18]))),
+		}
+		frameCount := int64(binary.BigEndian.Uint32(comm[2:6]))
+		info.Bitrate = info.SampleRate * info.Channels * info.BitDepth
+		info.Duration = durationFor(frameCount, info.SampleRate)
+		return info, nil
+	}
+	return nil, fmt.Errorf("%w: AIFF file has no COMM chunk", ErrUnsupportedFormat)
+}
+
+// parseExtendedFloat parses the given 80-bit IEEE 754 extended precision number, as used for AIFF sample rates.
+func parseExtendedFloat(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:2]) & 0x7fff)
+	mantissa := binary.BigEndian.Uint64(b[2:10])
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+	return value
+}
@@ -0,0 +1,138 @@
+package audioinfo
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wavFmtChunk returns the contents of a WAV fmt chunk for the given format.
+func wavFmtChunk(formatTag uint16, channels uint16, sampleRate uint32, bitDepth uint16) []byte {
+	blockAlign := channels * bitDepth / 8
+	var b []byte
+	b = append(b, le16(formatTag)...)
+	b = append(b, le16(channels)...)
+	b = append(b, le32(sampleRate)...)
+	b = append(b, le32(sampleRate*uint32(blockAlign))...)
+	b = append(b, le16(blockAlign)...)
+	return append(b, le16(bitDepth)...)
+}
+
+// wavChunk returns a RIFF chunk with the given ID and contents, padded to an even size.
+func wavChunk(id string, data []byte) []byte {
+	b := append(append([]byte(id), le32(uint32(len(data)))...), data...)
+	if len(data)%2 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// wavFile returns a WAV file with the given fmt chunk contents and dataSize bytes of audio.
+func wavFile(fmtChunk []byte, dataSize int) []byte {
+	b := []byte("RIFF\x00\x00\x00\x00WAVE")
+	b = append(b, wavChunk("LIST", []byte("INFOISFT\x04\x00\x00\x00msy\x00"))...)
+	b = append(b, wavChunk("fmt ", fmtChunk)...)
+	return append(b, wavChunk("data", make([]byte, dataSize))...)
+}
+
+// aiffCommChunk returns the contents of an AIFF COMM chunk for the given format, with the given AIFF-C
+// compression type (if any).
+func aiffCommChunk(channels uint16, sampleRate int, bitDepth uint16, frameCount uint32, compression string) []byte {
+	var b []byte
+	b = append(b, be16(channels)...)
+	b = append(b, be32(frameCount)...)
+	b = append(b, be16(bitDepth)...)
+	switch sampleRate {
+	case 44100:
+		b = append(b, 0x40, 0x0e, 0xac, 0x44, 0, 0, 0, 0, 0, 0)
+	case 48000:
+		b = append(b, 0x40, 0x0e, 0xbb, 0x80, 0, 0, 0, 0, 0, 0)
+	default:
+		panic("unsupported sample rate")
+	}
+	if compression != "" {
+		b = append(b, compression...)
+		b = append(b, 0, 0) // empty pascal string name
+	}
+	return b
+}
+
+// aiffFile returns an AIFF (or AIFF-C) file with the given COMM chunk contents.
+func aiffFile(isAIFC bool, comm []byte) []byte {
+	formType := "AIFF"
+	if isAIFC {
+		formType = "AIFC"
+	}
+	b := append([]byte("FORM\x00\x00\x00\x00"), formType...)
+	if isAIFC {
+		b = append(b, "FVER"...)
+		b = append(b, be32(4)...)
+		b = append(b, be32(0xa2805140)...)
+	}
+	b = append(b, "COMM"...)
+	b = append(b, be32(uint32(len(comm)))...)
+	b = append(b, comm...)
+	return b
+}
+
+func TestReadPCM(t *testing.T) {
+	extensible := wavFmtChunk(waveFormatExtensible, 6, 48000, 24)
+	extensible = append(extensible, le16(22)...)
+	extensible = append(extensible, le16(24)...)
+	extensible = append(extensible, le32(0x3f)...)
+	extensible = append(extensible, le16(waveFormatPCM)...)
+	extensible = append(extensible, []byte("\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71")...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Info
+	}{
+		{"wav", wavFile(wavFmtChunk(waveFormatPCM, 2, 44100, 16), 44100*4*2), Info{Codec: "pcm", Lossless: true, Bitrate: 1411200, SampleRate: 44100, BitDepth: 16, Channels: 2, Duration: 2 * time.Second}},
+		{"wav float", wavFile(wavFmtChunk(waveFormatIEEEFloat, 1, 48000, 32), 48000*4), Info{Codec: "pcm", Lossless: true, Bitrate: 1536000, SampleRate: 48000, BitDepth: 32, Channels: 1, Duration: time.Second}},
+		{"wav extensible", wavFile(extensible, 48000*18), Info{Codec: "pcm", Lossless: true, Bitrate: 6912000, SampleRate: 48000, BitDepth: 24, Channels: 6, Duration: time.Second}},
+		{"aiff", aiffFile(false, aiffCommChunk(2, 44100, 24, 88200, "")), Info{Codec: "pcm", Lossless: true, Bitrate: 2116800, SampleRate: 44100, BitDepth: 24, Channels: 2, Duration: 2 * time.Second}},
+		{"aifc sowt", aiffFile(true, aiffCommChunk(2, 48000, 16, 48000, "sowt")), Info{Codec: "pcm", Lossless: true, Bitrate: 1536000, SampleRate: 48000, BitDepth: 16, Channels: 2, Duration: time.Second}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := read(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("read failed: %s", err)
+			}
+			if *info != tt.want {
+				t.Errorf("read = %+v, want %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPCMUnsupported(t *testing.T) {
+	oversizedFmt := []byte("RIFF\x00\x00\x00\x00WAVEfmt \xff\xff\xff\x7f")
+	oversizedFmt = append(oversizedFmt, wavFmtChunk(waveFormatPCM, 2, 44100, 16)...)
+	oversizedComm := []byte("FORM\x00\x00\x00\x00AIFFCOMM\x7f\xff\xff\xff")
+	oversizedComm = append(oversizedComm, aiffCommChunk(2, 44100, 16, 1000, "")...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"wav without fmt", []byte("RIFF\x00\x00\x00\x00WAVEdata\x04\x00\x00\x00\x00\x00\x00\x00")},
+		{"wav short fmt", wavFile(wavFmtChunk(waveFormatPCM, 2, 44100, 16)[:12], 100)},
+		{"wav oversized fmt", oversizedFmt},
+		{"wav fmt past end of file", wavFile(wavFmtChunk(waveFormatPCM, 2, 44100, 16), 0)[:50]},
+		{"wav compressed", wavFile(wavFmtChunk(0x0055, 2, 44100, 0), 100)},
+		{"aiff without comm", []byte("FORM\x00\x00\x00\x00AIFFSSND\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"aiff short comm", aiffFile(false, aiffCommChunk(2, 44100, 16, 1000, "")[:16])},
+		{"aiff oversized comm", oversizedComm},
+		{"aifc compressed", aiffFile(true, aiffCommChunk(2, 44100, 16, 1000, "ima4"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := read(bytes.NewReader(tt.data), int64(len(tt.data))); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("read error = %v, want ErrUnsupportedFormat", err)
+			}
+		})
+	}
+}
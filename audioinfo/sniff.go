@@ -0,0 +1,160 @@
+package audioinfo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Contents describes what kinds of streams a container file holds.
+type Contents struct {
+	HasAudio  bool // the file has at least one audio stream
+	HasVideo  bool // the file has at least one enabled video stream (cover art and chapter images don't count)
+	Protected bool // the file's audio is DRM-protected (eg. old iTunes Store purchases)
+}
+
+// IsMusic returns true iff the file holds playable audio and nothing else of note.
+func (c Contents) IsMusic() bool {
+	return c.HasAudio && !c.HasVideo && !c.Protected
+}
+
+// Sniff inspects the container at the given path to determine what kinds of streams it holds.
+// It's meant for container formats which are commonly used for both music and video, and currently
+// supports MP4 (including M4A/M4B) and Ogg files. ErrUnsupportedFormat is returned for other formats.
+func Sniff(path string) (Contents, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Contents{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return Contents{}, err
+	}
+
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return Contents{}, ErrUnsupportedFormat
+		}
+		return Contents{}, err
+	}
+	switch {
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		return sniffMP4(f, stat.Size())
+	case bytes.Equal(header[0:4], []byte("OggS")):
+		return sniffOgg(f)
+	}
+	return Contents{}, ErrUnsupportedFormat
+}
+
+func sniffMP4(r io.ReaderAt, size int64) (Contents, error) {
+	var c Contents
+	topLevel, err := readMP4Boxes(r, 0, size)
+	if err != nil {
+		return c, err
+	}
+	moov := findMP4Box(topLevel, "moov")
+	if moov == nil {
+		return c, fmt.Errorf("%w: MP4 file has no moov box", ErrUnsupportedFormat)
+	}
+	traks, err := readMP4Boxes(r, moov.dataOffset, moov.dataOffset+moov.dataSize)
+	if err != nil {
+		return c, err
+	}
+	for _, trak := range traks {
+		if trak.boxType != "trak" {
+			continue
+		}
+		hdlr, err := findMP4Path(r, trak, "mdia", "hdlr")
+		if err != nil {
+			return c, err
+		}
+		if hdlr == nil || hdlr.dataSize < 12 {
+			continue
+		}
+		hdlrData, err := readMP4BoxData(r, hdlr)
+		if err != nil {
+			return c, err
+		}
+
+		switch string(hdlrData[8:12]) {
+		case "soun":
+			c.HasAudio = true
+			entryType, err := mp4SampleEntryType(r, trak)
+			if err != nil {
+				return c, err
+			}
+			if entryType == "drms" || entryType == "enca" {
+				c.Protected = true
+			}
+		case "vide":
+			// audiobooks often carry a disabled video track holding chapter images:
+			enabled, err := mp4TrackEnabled(r, trak)
+			if err != nil {
+				return c, err
+			}
+			if enabled {
+				c.HasVideo = true
+			}
+		}
+	}
+	return c, nil
+}
+
+// mp4TrackEnabled reports whether the given track's header marks it as enabled.
+func mp4TrackEnabled(r io.ReaderAt, trak mp4Box) (bool, error) {
+	tkhd, err := findMP4Path(r, trak, "tkhd")
+	if err != nil || tkhd == nil || tkhd.dataSize < 4 {
+		return true, err
+	}
+	flags := make([]byte, 4)
+	if _, err := r.ReadAt(flags, tkhd.dataOffset); err != nil {
+		return true, fmt.Errorf("failed to read MP4 box 'tkhd': %w", err)
+	}
+	return flags[3]&0x01 != 0, nil
+}
+
+// mp4SampleEntryType returns the type of the first sample entry in the given track (eg. "mp4a").
+func mp4SampleEntryType(r io.ReaderAt, trak mp4Box) (string, error) {
+	stsd, err := findMP4Path(r, trak, "mdia", "minf", "stbl", "stsd")
+	if err != nil || stsd == nil || stsd.dataSize <= 8 {
+		return "", err
+	}
+	entries, err := readMP4Boxes(r, stsd.dataOffset+8, stsd.dataOffset+stsd.dataSize)
+	if err != nil || len(entries) == 0 {
+		return "", err
+	}
+	return entries[0].boxType, nil
+}
+
+func sniffOgg(r io.ReaderAt) (Contents, error) {
+	var c Contents
+	// every logical stream's first page comes before any other page:
+	for offset := int64(0); ; {
+		page, err := readOggPage(r, offset)
+		if err != nil {
+			if offset == 0 {
+				return c, err
+			}
+			break
+		}
+		if page.flags&oggFlagBOS == 0 {
+			break
+		}
+		switch oggStreamCodec(page.firstBytes) {
+		case "vorbis", "opus", "flac", "speex":
+			c.HasAudio = true
+		case "theora":
+			c.HasVideo = true
+		default:
+			// Ogg Skeleton and friends carry no media; VP8 and Daala are video:
+			if bytes.HasPrefix(page.firstBytes, []byte("OVP80")) || bytes.HasPrefix(page.firstBytes, []byte("\x80daala")) {
+				c.HasVideo = true
+			}
+		}
+		offset += page.length
+	}
+	return c, nil
+}
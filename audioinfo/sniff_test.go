@@ -0,0 +1,94 @@
+package audioinfo
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// mp4Track returns an MP4 track with the given handler type (eg. "soun") and sample entry type (eg. "mp4a").
+// Its track header marks it as enabled iff enabled is set.
+func mp4Track(handler, entryType string, enabled bool) []byte {
+	flags := be32(0)
+	if enabled {
+		flags = be32(1)
+	}
+	tkhd := mp4BoxBytes("tkhd", flags, make([]byte, 80))
+	hdlr := mp4BoxBytes("hdlr", be32(0), be32(0), []byte(handler), make([]byte, 12))
+	stsd := mp4BoxBytes("stsd", be32(0), be32(1), mp4BoxBytes(entryType, make([]byte, 28)))
+	return mp4BoxBytes("trak", tkhd, mp4BoxBytes("mdia", hdlr, mp4BoxBytes("minf", mp4BoxBytes("stbl", stsd))))
+}
+
+// mp4File returns an MP4 file holding the given tracks.
+func mp4File(tracks ...[]byte) []byte {
+	return append(mp4BoxBytes("ftyp", []byte("M4A "), be32(0)), mp4BoxBytes("moov", tracks...)...)
+}
+
+func TestSniff(t *testing.T) {
+	theora := oggPageBytes(0x02, 0, 9, append([]byte("\x80theora"), make([]byte, 34)...))
+
+	tests := []struct {
+		name string
+		data []byte
+		want Contents
+	}{
+		{"m4a", m4aFile(), Contents{HasAudio: true}},
+		{"protected m4a", mp4File(mp4Track("soun", "drms", true)), Contents{HasAudio: true, Protected: true}},
+		{"encrypted m4a", mp4File(mp4Track("soun", "enca", true)), Contents{HasAudio: true, Protected: true}},
+		{"mp4 video", mp4File(mp4Track("vide", "avc1", true), mp4Track("soun", "mp4a", true)), Contents{HasAudio: true, HasVideo: true}},
+		{"m4b with chapter images", mp4File(mp4Track("soun", "mp4a", true), mp4Track("vide", "jpeg", false)), Contents{HasAudio: true}},
+		{"mp4 without audio", mp4File(mp4Track("vide", "avc1", true)), Contents{HasVideo: true}},
+		{"ogg opus", opusFile(append([]byte("OpusTags"), make([]byte, 8)...)), Contents{HasAudio: true}},
+		{"ogg theora", append(theora, opusFile(append([]byte("OpusTags"), make([]byte, 8)...))...), Contents{HasAudio: true, HasVideo: true}},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "file")
+			if err := ioutil.WriteFile(path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := Sniff(path)
+			if err != nil {
+				t.Fatalf("Sniff failed: %s", err)
+			}
+			if c != tt.want {
+				t.Errorf("Sniff = %+v, want %+v", c, tt.want)
+			}
+			if c.IsMusic() != (tt.want == Contents{HasAudio: true}) {
+				t.Errorf("IsMusic = %v for %+v", c.IsMusic(), c)
+			}
+		})
+	}
+}
+
+func TestSniffUnsupported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(path, mp3Frames(10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Sniff(path); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Sniff error = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+func TestSniffHostile(t *testing.T) {
+	files := map[string][]byte{
+		"mp4": mp4File(mp4Track("soun", "mp4a", true), mp4Track("vide", "jpeg", false)),
+		"ogg": opusFile(append([]byte("OpusTags"), make([]byte, 8)...)),
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			for _, variant := range hostileVariants(data) {
+				// errors are expected; this checks there's no panic:
+				if bytes.HasPrefix(variant, []byte("OggS")) {
+					_, _ = sniffOgg(bytes.NewReader(variant))
+				} else {
+					_, _ = sniffMP4(bytes.NewReader(variant), int64(len(variant)))
+				}
+			}
+		})
+	}
+}
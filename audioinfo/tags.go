@@ -0,0 +1,444 @@
+package audioinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Tag names used as keys in Tags.
+const (
+	TagTitle       = "title"
+	TagArtist      = "artist"
+	TagAlbum       = "album"
+	TagAlbumArtist = "album_artist"
+	TagGenre       = "genre"
+	TagRating      = "rating" // a percentage, from 1 (worst) to 100 (best); eg. 5 stars is 100, 3 stars is 60
+)
+
+// Tags holds a music file's metadata tags, keyed by the Tag* constants. A tag may have several values.
+type Tags map[string][]string
+
+// Get returns the first value of the given tag, or an empty string if the tag isn't set.
+func (t Tags) Get(name string) string {
+	if values := t[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (t Tags) add(name string, values ...string) {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			t[name] = append(t[name], v)
+		}
+	}
+}
+
+// maxTagBlockSize limits how much data is read for a single tag block; larger blocks usually hold
+// embedded cover art, which we don't care about.
+const maxTagBlockSize = 16 * 1024 * 1024
+
+// ReadTags reads the basic metadata tags (see the Tag* constants) of the music file at the given path.
+// ID3v2 (MP3 and others), Vorbis comments (FLAC and Ogg), and iTunes-style MP4 tags are supported.
+// MP4 files have no standard rating tag, so TagRating is never set for them.
+// A file with no tags yields empty Tags; ErrUnsupportedFormat is returned for unknown file formats.
+func ReadTags(path string) (Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return readTags(f, stat.Size())
+}
+
+func readTags(r io.ReaderAt, size int64) (Tags, error) {
+	header := make([]byte, 12)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		if err == io.EOF {
+			return nil, ErrUnsupportedFormat
+		}
+		return nil, err
+	}
+	tags := make(Tags)
+	switch {
+	case bytes.Equal(header[4:8], []byte("ftyp")):
+		return tags, readMP4Tags(r, size, tags)
+	case bytes.Equal(header[0:4], []byte("fLaC")):
+		return tags, readFLACTags(r, 0, tags)
+	case bytes.Equal(header[0:4], []byte("OggS")):
+		return tags, readOggTags(r, tags)
+	case bytes.Equal(header[0:3], []byte("ID3")):
+		tagSize := id3v2Size(header)
+		if err := readID3v2Tags(r, size, header, tags); err != nil {
+			return nil, err
+		}
+		magic := make([]byte, 4)
+		if _, err := r.ReadAt(magic, tagSize); err == nil && bytes.Equal(magic, []byte("fLaC")) {
+			return tags, readFLACTags(r, tagSize, tags)
+		}
+		return tags, nil
+	}
+	if _, err := readMP3(r, size, 0); err == nil {
+		return tags, nil // an MP3 file without an ID3v2 tag
+	}
+	return nil, ErrUnsupportedFormat
+}
+
+// id3v2Frames maps ID3v2.3/2.4 (and, for ID3v2.2, three-character) frame IDs to tag names.
+var id3v2Frames = map[string]string{
+	"TIT2": TagTitle, "TT2": TagTitle,
+	"TPE1": TagArtist, "TP1": TagArtist,
+	"TALB": TagAlbum, "TAL": TagAlbum,
+	"TPE2": TagAlbumArtist, "TP2": TagAlbumArtist,
+	"TCON": TagGenre, "TCO": TagGenre,
+}
+
+func readID3v2Tags(r io.ReaderAt, size int64, header []byte, tags Tags) error {
+	version := header[3]
+	// the tag's size comes from its header; don't trust it further than the file's size, and skip any
+	// frames (usually cover art) beyond maxTagBlockSize:
+	dataSize := id3v2Size(header) - 10
+	if dataSize > size-10 {
+		dataSize = size - 10
+	}
+	if dataSize > maxTagBlockSize {
+		dataSize = maxTagBlockSize
+	}
+	if dataSize < 0 {
+		dataSize = 0
+	}
+	data := make([]byte, dataSize)
+	if _, err := r.ReadAt(data, 10); err != nil {
+		return fmt.Errorf("failed to read ID3v2 tag: %w", err)
+	}
+	if header[5]&0x80 != 0 && version < 4 {
+		// ID3v2.3 and earlier apply unsynchronization to the whole tag:
+		data = bytes.ReplaceAll(data, []byte{0xff, 0x00}, []byte{0xff})
+	}
+
+	pos := 0
+	if header[5]&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		// skip the extended header
+		if version == 3 {
+			pos = 4 + int(binary.BigEndian.Uint32(data[0:4]))
+		} else {
+			pos = int(synchsafe(data[0:4]))
+		}
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	for pos+headerLen <= len(data) {
+		id := string(data[pos : pos+idLen])
+		if data[pos] == 0 {
+			break // padding
+		}
+		var frameSize int
+		switch version {
+		case 2:
+			frameSize = int(data[pos+3])<<16 | int(data[pos+4])<<8 | int(data[pos+5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[pos+4 : pos+8]))
+		default:
+			frameSize = int(synchsafe(data[pos+4 : pos+8]))
+		}
+		pos += headerLen
+		if frameSize < 0 || pos+frameSize > len(data) {
+			break
+		}
+		if (id == "POPM" || id == "POP") && frameSize > 1 {
+			// popularimeter: email address, then a rating from 1 to 255 (0 is unrated), then a play counter
+			frame := data[pos : pos+frameSize]
+			if end := bytes.IndexByte(frame, 0); end >= 0 && end+1 < len(frame) && frame[end+1] > 0 {
+				tags.add(TagRating, strconv.Itoa(int(math.Round(float64(frame[end+1])/255*100))))
+			}
+		} else if name, ok := id3v2Frames[id]; ok && frameSize > 1 {
+			values := decodeID3v2Text(data[pos : pos+frameSize])
+			if name == TagGenre {
+				for i, v := range values {
+					values[i] = resolveID3v1Genre(v)
+				}
+			}
+			tags.add(name, values...)
+		}
+		pos += frameSize
+	}
+	return nil
+}
+
+func synchsafe(b []byte) int64 {
+	return int64(b[0]&0x7f)<<21 | int64(b[1]&0x7f)<<14 | int64(b[2]&0x7f)<<7 | int64(b[3]&0x7f)
+}
+
+// decodeID3v2Text decodes the given ID3v2 text frame payload, which may hold several null-separated values.
+func decodeID3v2Text(b []byte) []string {
+	encoding, b := b[0], b[1:]
+	var text string
+	switch encoding {
+	case 1, 2: // UTF-16 with BOM, UTF-16BE
+		bigEndian := encoding == 2
+		if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+			bigEndian, b = true, b[2:]
+		} else if len(b) >= 2 && b[0] == 0xff && b[1] == 0xfe {
+			bigEndian, b = false, b[2:]
+		}
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(b[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(b[i:]))
+			}
+		}
+		text = string(utf16.Decode(units))
+		// values after the first may have their own BOMs:
+		text = strings.ReplaceAll(text, "\ufeff", "")
+	case 3: // UTF-8
+		text = string(b)
+	default: // ISO-8859-1
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		text = string(runes)
+	}
+	return strings.Split(strings.TrimRight(text, "\x00"), "\x00")
+}
+
+// id3v1Genres lists the standard ID3v1 genres, by index.
+var id3v1Genres = []string{
+	"Blues", "Classic Rock", "Country", "Dance", "Disco", "Funk", "Grunge", "Hip-Hop", "Jazz", "Metal",
+	"New Age", "Oldies", "Other", "Pop", "R&B", "Rap", "Reggae", "Rock", "Techno", "Industrial",
+	"Alternative", "Ska", "Death Metal", "Pranks", "Soundtrack", "Euro-Techno", "Ambient", "Trip-Hop", "Vocal", "Jazz+Funk",
+	"Fusion", "Trance", "Classical", "Instrumental", "Acid", "House", "Game", "Sound Clip", "Gospel", "Noise",
+	"Alternative Rock", "Bass", "Soul", "Punk", "Space", "Meditative", "Instrumental Pop", "Instrumental Rock", "Ethnic", "Gothic",
+	"Darkwave", "Techno-Industrial", "Electronic", "Pop-Folk", "Eurodance", "Dream", "Southern Rock", "Comedy", "Cult", "Gangsta",
+	"Top 40", "Christian Rap", "Pop/Funk", "Jungle", "Native American", "Cabaret", "New Wave", "Psychedelic", "Rave", "Showtunes",
+	"Trailer", "Lo-Fi", "Tribal", "Acid Punk", "Acid Jazz", "Polka", "Retro", "Musical", "Rock & Roll", "Hard Rock",
+}
+
+// resolveID3v1Genre maps ID3v1-style genre references (eg. "(32)" or "32") to genre names.
+func resolveID3v1Genre(genre string) string {
+	ref := genre
+	if strings.HasPrefix(ref, "(") && strings.HasSuffix(ref, ")") {
+		ref = ref[1 : len(ref)-1]
+	}
+	if idx, err := strconv.Atoi(ref); err == nil && idx >= 0 && idx < len(id3v1Genres) {
+		return id3v1Genres[idx]
+	}
+	return genre
+}
+
+// vorbisCommentFields maps Vorbis comment field names (uppercase) to tag names.
+var vorbisCommentFields = map[string]string{
+	"TITLE":        TagTitle,
+	"ARTIST":       TagArtist,
+	"ALBUM":        TagAlbum,
+	"ALBUMARTIST":  TagAlbumArtist,
+	"ALBUM ARTIST": TagAlbumArtist,
+	"ALBUM_ARTIST": TagAlbumArtist,
+	"GENRE":        TagGenre,
+	"RATING":       TagRating,
+}
+
+// parseVorbisComment parses a Vorbis comment block (vendor string, then the comment list).
+func parseVorbisComment(b []byte, tags Tags) error {
+	if len(b) < 4 {
+		return fmt.Errorf("%w: Vorbis comment block is too short", ErrUnsupportedFormat)
+	}
+	pos := 4 + int(binary.LittleEndian.Uint32(b[0:4]))
+	if pos+4 > len(b) {
+		return fmt.Errorf("%w: Vorbis comment block is truncated", ErrUnsupportedFormat)
+	}
+	count := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+	pos += 4
+	for i := 0; i < count && pos+4 <= len(b); i++ {
+		length := int(binary.LittleEndian.Uint32(b[pos : pos+4]))
+		pos += 4
+		if length < 0 || pos+length > len(b) {
+			break
+		}
+		comment := string(b[pos : pos+length])
+		pos += length
+		if eq := strings.IndexByte(comment, '='); eq > 0 {
+			if name, ok := vorbisCommentFields[strings.ToUpper(comment[:eq])]; ok {
+				value := comment[eq+1:]
+				if name == TagRating {
+					if value = normalizeVorbisRating(value); value == "" {
+						continue
+					}
+				}
+				tags.add(name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeVorbisRating converts a RATING comment, which by convention is either a number of stars
+// (from 1 to 5) or a percentage, to a percentage. It returns an empty string for unparseable ratings.
+func normalizeVorbisRating(value string) string {
+	rating, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || rating <= 0 {
+		return ""
+	}
+	if rating <= 5 {
+		rating *= 20
+	}
+	return strconv.Itoa(int(math.Round(math.Min(rating, 100))))
+}
+
+func readFLACTags(r io.ReaderAt, offset int64, tags Tags) error {
+	pos := offset + 4
+	blockHeader := make([]byte, 4)
+	for {
+		if _, err := r.ReadAt(blockHeader, pos); err != nil {
+			return fmt.Errorf("failed to read FLAC metadata block header: %w", err)
+		}
+		isLast := blockHeader[0]&0x80 != 0
+		blockLen := int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3])
+		pos += 4
+		if blockHeader[0]&0x7f == flacBlockTypeVorbisComment {
+			b := make([]byte, blockLen)
+			if _, err := r.ReadAt(b, pos); err != nil {
+				return fmt.Errorf("failed to read FLAC Vorbis comment: %w", err)
+			}
+			return parseVorbisComment(b, tags)
+		}
+		pos += blockLen
+		if isLast {
+			return nil
+		}
+	}
+}
+
+// readOggTags reads the comment header, which is the second packet of a Vorbis, Opus, or FLAC stream.
+func readOggTags(r io.ReaderAt, tags Tags) error {
+	first, err := readOggPage(r, 0)
+	if err != nil {
+		return err
+	}
+	codec := oggStreamCodec(first.firstBytes)
+
+	var packets [][]byte
+	var current []byte
+	for offset := int64(0); len(packets) < 2; {
+		page, err := readOggPage(r, offset)
+		if err != nil {
+			return err
+		}
+		offset += page.length
+		if page.serial != first.serial {
+			continue
+		}
+		payload := make([]byte, page.length-oggPageHeaderLen-int64(len(page.segments)))
+		if _, err := r.ReadAt(payload, page.offset+oggPageHeaderLen+int64(len(page.segments))); err != nil {
+			return fmt.Errorf("failed to read Ogg page: %w", err)
+		}
+		for _, s := range page.segments {
+			current = append(current, payload[:s]...)
+			payload = payload[s:]
+			if s < 255 {
+				packets = append(packets, current)
+				current = nil
+			}
+		}
+		if len(current) > maxTagBlockSize {
+			return fmt.Errorf("%w: Ogg comment header is too large", ErrUnsupportedFormat)
+		}
+	}
+
+	comment := packets[1]
+	switch {
+	case codec == "vorbis" && bytes.HasPrefix(comment, []byte("\x03vorbis")):
+		return parseVorbisComment(comment[7:], tags)
+	case codec == "opus" && bytes.HasPrefix(comment, []byte("OpusTags")):
+		return parseVorbisComment(comment[8:], tags)
+	case codec == "flac" && len(comment) > 4 && comment[0]&0x7f == flacBlockTypeVorbisComment:
+		return parseVorbisComment(comment[4:], tags)
+	}
+	return nil
+}
+
+// mp4Atoms maps iTunes-style MP4 metadata atoms to tag names.
+var mp4Atoms = map[string]string{
+	"\xa9nam": TagTitle,
+	"\xa9ART": TagArtist,
+	"\xa9alb": TagAlbum,
+	"aART":    TagAlbumArtist,
+	"\xa9gen": TagGenre,
+	"gnre":    TagGenre,
+}
+
+func readMP4Tags(r io.ReaderAt, size int64, tags Tags) error {
+	topLevel, err := readMP4Boxes(r, 0, size)
+	if err != nil {
+		return err
+	}
+	moov := findMP4Box(topLevel, "moov")
+	if moov == nil {
+		return fmt.Errorf("%w: MP4 file has no moov box", ErrUnsupportedFormat)
+	}
+	meta, err := findMP4Path(r, *moov, "udta", "meta")
+	if err != nil || meta == nil {
+		return err
+	}
+	// meta is usually a full box (with version & flags), but not always in QuickTime files:
+	metaChildren := *meta
+	peek := make([]byte, 8)
+	if _, err := r.ReadAt(peek, meta.dataOffset); err == nil && !bytes.Equal(peek[4:8], []byte("hdlr")) {
+		metaChildren.dataOffset += 4
+		metaChildren.dataSize -= 4
+	}
+	ilst, err := findMP4Path(r, metaChildren, "ilst")
+	if err != nil || ilst == nil {
+		return err
+	}
+	items, err := readMP4Boxes(r, ilst.dataOffset, ilst.dataOffset+ilst.dataSize)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		name, ok := mp4Atoms[item.boxType]
+		if !ok {
+			continue
+		}
+		dataBoxes, err := readMP4Boxes(r, item.dataOffset, item.dataOffset+item.dataSize)
+		if err != nil {
+			return err
+		}
+		for _, dataBox := range dataBoxes {
+			if dataBox.boxType != "data" || dataBox.dataSize < 8 || dataBox.dataSize > maxTagBlockSize {
+				continue
+			}
+			b, err := readMP4BoxData(r, &dataBox)
+			if err != nil {
+				return err
+			}
+			// type indicator (4), locale (4), value:
+			value := b[8:]
+			if item.boxType == "gnre" {
+				// a 1-based index into the ID3v1 genres
+				if len(value) >= 2 {
+					tags.add(name, resolveID3v1Genre(strconv.Itoa(int(binary.BigEndian.Uint16(value))-1)))
+				}
+				continue
+			}
+			tags.add(name, string(value))
+		}
+	}
+	return nil
+}
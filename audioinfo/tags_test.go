@@ -0,0 +1,166 @@
+package audioinfo
+
+import (
+	"bytes"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+// id3v2Frame returns an ID3v2.3 frame with the given ID and contents.
+func id3v2Frame(id string, data []byte) []byte {
+	return append(append(append([]byte(id), be32(uint32(len(data)))...), 0, 0), data...)
+}
+
+// id3v2Tag returns an ID3v2.3 tag holding the given frames, with some padding.
+func id3v2Tag(frames ...[]byte) []byte {
+	body := append(bytes.Join(frames, nil), make([]byte, 16)...)
+	return append(id3v2Header(3, 0, len(body)), body...)
+}
+
+// vorbisComment returns a Vorbis comment block holding the given comments.
+func vorbisComment(comments ...string) []byte {
+	b := append(le32(6), "msync!"...)
+	b = append(b, le32(uint32(len(comments)))...)
+	for _, c := range comments {
+		b = append(b, le32(uint32(len(c)))...)
+		b = append(b, c...)
+	}
+	return b
+}
+
+// mp4Item returns an iTunes-style MP4 metadata item of the given type, holding the given value.
+func mp4Item(itemType string, value []byte) []byte {
+	return mp4BoxBytes(itemType, mp4BoxBytes("data", be32(1), be32(0), value))
+}
+
+func TestReadTags(t *testing.T) {
+	utf16Artist := []byte{0x01, 0xff, 0xfe, 'B', 0, 'j', 0, 0xf6, 0, 'r', 0, 'k', 0}
+	id3v22 := []byte("TT2\x00\x00\x06\x00Title")
+	id3v22 = append(id3v22, "TCO\x00\x00\x05\x00(17)"...)
+
+	tests := []struct {
+		name string
+		data []byte
+		want Tags
+	}{
+		{
+			"id3v2.3",
+			append(id3v2Tag(
+				id3v2Frame("TIT2", []byte("\x00Title")),
+				id3v2Frame("TPE1", utf16Artist),
+				id3v2Frame("TALB", []byte("\x03Album \xe2\x9c\x93")),
+				id3v2Frame("TPE2", []byte("\x00Various Artists")),
+				id3v2Frame("TCON", []byte("\x00(32)")),
+				id3v2Frame("POPM", []byte("someone@example.com\x00\xc4\x00\x00\x00\x01")),
+				id3v2Frame("APIC", make([]byte, 1000)),
+			), mp3Frames(10)...),
+			Tags{TagTitle: {"Title"}, TagArtist: {"Björk"}, TagAlbum: {"Album ✓"}, TagAlbumArtist: {"Various Artists"}, TagGenre: {"Classical"}, TagRating: {"77"}},
+		},
+		{
+			"id3v2.3 multiple values",
+			id3v2Tag(id3v2Frame("TCON", []byte("\x03Jazz\x00Fusion\x00"))),
+			Tags{TagGenre: {"Jazz", "Fusion"}},
+		},
+		{
+			"id3v2.2",
+			append(id3v2Header(2, 0, len(id3v22)), id3v22...),
+			Tags{TagTitle: {"Title"}, TagGenre: {"Rock"}},
+		},
+		{
+			"mp3 without tags",
+			mp3Frames(10),
+			Tags{},
+		},
+		{
+			"flac",
+			flacFile(44100, 2, 16, 441000, 100, flacBlock(flacBlockTypeVorbisComment, vorbisComment("TITLE=Title", "albumartist=Someone", "GENRE=Audiobook", "RATING=4", "COMMENT=ignored"))),
+			Tags{TagTitle: {"Title"}, TagAlbumArtist: {"Someone"}, TagGenre: {"Audiobook"}, TagRating: {"80"}},
+		},
+		{
+			"opus",
+			opusFile(append([]byte("OpusTags"), vorbisComment("ARTIST=Artist", "ARTIST=Other Artist", "RATING=0")...)),
+			Tags{TagArtist: {"Artist", "Other Artist"}},
+		},
+		{
+			"m4a",
+			m4aFile(mp4Item("\xa9nam", []byte("Title")), mp4Item("aART", []byte("Album Artist")), mp4Item("gnre", be16(10)), mp4Item("covr", make([]byte, 100))),
+			Tags{TagTitle: {"Title"}, TagAlbumArtist: {"Album Artist"}, TagGenre: {"Metal"}},
+		},
+		{
+			"m4a without tags",
+			m4aFile(),
+			Tags{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := readTags(bytes.NewReader(tt.data), int64(len(tt.data)))
+			if err != nil {
+				t.Fatalf("readTags failed: %s", err)
+			}
+			if !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("readTags = %v, want %v", tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeVorbisRating(t *testing.T) {
+	tests := map[string]string{
+		"1":    "20",
+		"5":    "100",
+		"2.5":  "50",
+		"60":   "60",
+		"250":  "100",
+		" 3 ":  "60",
+		"0":    "",
+		"-1":   "",
+		"five": "",
+		"":     "",
+	}
+	for value, want := range tests {
+		if got := normalizeVorbisRating(value); got != want {
+			t.Errorf("normalizeVorbisRating(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestReadTagsHostile(t *testing.T) {
+	files := map[string][]byte{
+		"id3v2": append(id3v2Tag(id3v2Frame("TIT2", []byte("\x00Title")), id3v2Frame("POPM", []byte("x\x00\xff"))), mp3Frames(2)...),
+		"flac":  flacFile(44100, 2, 16, 441000, 100, flacBlock(flacBlockTypeVorbisComment, vorbisComment("TITLE=Title", "RATING=5"))),
+		"opus":  opusFile(append([]byte("OpusTags"), vorbisComment("TITLE=Title")...)),
+		"m4a":   m4aFile(mp4Item("\xa9nam", []byte("Title")), mp4Item("gnre", be16(9))),
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			for _, variant := range hostileVariants(data) {
+				// errors are expected; this checks there's no panic:
+				_, _ = readTags(bytes.NewReader(variant), int64(len(variant)))
+			}
+		})
+	}
+}
+
+func TestReadTagsBoundsAllocations(t *testing.T) {
+	// tags claiming to be (much) larger than the file they're in:
+	tests := map[string][]byte{
+		"id3v2 tag size":      append(id3v2Header(3, 0, 0x0fffffff), id3v2Frame("TIT2", []byte("\x00Title"))...),
+		"id3v2 frame size":    append(id3v2Header(3, 0, 20), append([]byte("TIT2\x7f\xff\xff\xff\x00\x00"), make([]byte, 10)...)...),
+		"id3v2 extended size": append(id3v2Header(3, 0x40, 20), append([]byte("\x7f\xff\xff\xff"), make([]byte, 16)...)...),
+		"vorbis comment":      flacFile(44100, 2, 16, 441000, 0, flacBlock(flacBlockTypeVorbisComment, []byte("\xff\xff\xff\x7f\xff\xff\xff\x7f"))),
+		"mp4 data box":        m4aFile(mp4BoxBytes("\xa9nam", be32(0x7fffffff), []byte("data"), be32(1), be32(0))),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, _ = readTags(bytes.NewReader(data), int64(len(data)))
+			runtime.ReadMemStats(&after)
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1024*1024 {
+				t.Errorf("reading the tags of a %d-byte file allocated %d bytes", len(data), allocated)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"msync/audioinfo"
+)
+
+const (
+	// sizePriorityRecent fills the -max-size budget with the most recently modified albums first.
+	sizePriorityRecent = "recent"
+	// sizePriorityPath fills the -max-size budget with albums in path order.
+	sizePriorityPath = "path"
+	// sizePriorityRating fills the -max-size budget with the highest-rated albums (by their tracks' average rating tag) first.
+	sizePriorityRating = "rating"
+)
+
+// bitrateSteps are the bitrates, in Kbps, tried in turn when lowering the bitrate to fit the -max-size budget.
+var bitrateSteps = []int{320, 256, 224, 192, 160, 128, 112, 96, 80, 64, 48, 32}
+
+// budgetRaiseMargin is the fraction of the -max-size budget a library must fit in, at a higher bitrate than
+// the previous run's plan chose, for the bitrate to be raised again. This keeps a library hovering around
+// the budget from flip-flopping between bitrates, and being re-transcoded, on every run.
+const budgetRaiseMargin = 0.9
+
+// estimatedDestSize returns the estimated size of the destination file synced from the given source music file.
+func estimatedDestSize(n *MusicTreeNode, p EncodingProfile) int64 {
+	if !p.NeedsTranscode(n) || n.FileBitrate <= 0 {
+		return n.FileSize
+	}
+	return int64(math.Round(float64(n.FileSize) / float64(n.FileBitrate) * float64(p.ExpectedBitrate(n))))
+}
+
+// SizeBudget describes the -max-size options.
+type SizeBudget struct {
+	MaxSize  int64  // in bytes
+	Priority string // one of the sizePriority* constants
+	MinKbps  int    // if nonzero, the base profile's bitrate may be lowered to this bitrate (but no further) to fit more music
+}
+
+// bitrates returns the base profile bitrates, in Kbps, a plan may choose from, highest first, given the
+// base profile's bitrate.
+func (b SizeBudget) bitrates(baseKbps int) []int {
+	bitrates := []int{baseKbps}
+	if b.MinKbps <= 0 || b.MinKbps >= baseKbps {
+		return bitrates
+	}
+	for _, step := range bitrateSteps {
+		if step < baseKbps && step > b.MinKbps {
+			bitrates = append(bitrates, step)
+		}
+	}
+	return append(bitrates, b.MinKbps)
+}
+
+// Validate returns an error if the budget is invalid for use with the given base profile.
+func (b SizeBudget) Validate(base EncodingProfile) error {
+	switch b.Priority {
+	case sizePriorityRecent, sizePriorityPath, sizePriorityRating:
+	default:
+		return fmt.Errorf("-max-size-priority must be one of: %s, %s, %s", sizePriorityRecent, sizePriorityPath, sizePriorityRating)
+	}
+	if b.MinKbps < 0 {
+		return errors.New("-max-size-min-kbps must not be negative")
+	}
+	if b.MinKbps > 0 {
+		if base.Quality != "" || base.IsLossless() {
+			return errors.New("-max-size-min-kbps requires a lossy -codec, without -quality")
+		}
+		if b.MinKbps > base.BitrateKbps {
+			return errors.New("-max-size-min-kbps must not be greater than -max-kbps")
+		}
+	}
+	return nil
+}
+
+// budgetAlbum is a directory's worth of music files, which the size budget includes or leaves out as a whole.
+type budgetAlbum struct {
+	dir     *MusicTreeNode
+	files   []*MusicTreeNode
+	size    int64     // estimated size in the destination
+	modTime time.Time // of the most recently modified file
+	rating  float64   // average rating of the rated files; 0 if none are rated
+}
+
+// SizePlan is the outcome of fitting a source library into a SizeBudget.
+type SizePlan struct {
+	BitrateKbps  int // the base profile's bitrate the plan was made with
+	Included     []*budgetAlbum
+	LeftOut      []*budgetAlbum
+	Size         int64 // estimated size of the included albums
+	LeftOutSize  int64 // estimated size of the albums left out
+	LeftOutFiles int
+}
+
+// PlanSizeBudget chooses which albums (ie. directories of music files) from the source tree are synced
+// so that the destination fits within the budget. Albums are considered in the budget's priority order,
+// and each is included if it fits in the space remaining. If the budget allows, the base profile's bitrate
+// is lowered (via profiles.SetBaseBitrate) until the whole library fits, or the minimum is reached.
+//
+// previousKbps is the bitrate the destination's previous plan chose (or 0). Since changing the bitrate
+// means re-transcoding, that bitrate is kept unless the library no longer fits at it; it's only raised
+// again once the library fits at a higher bitrate with some room to spare (see budgetRaiseMargin).
+func PlanSizeBudget(sourceTree *MusicTreeNode, profiles *ProfileSelector, budget SizeBudget, previousKbps int) *SizePlan {
+	var albums []*budgetAlbum
+	_ = sourceTree.Walk(func(n *MusicTreeNode) error {
+		if !n.IsDirectory {
+			return nil
+		}
+		if files := n.MusicFiles(); len(files) > 0 {
+			album := &budgetAlbum{dir: n, files: files}
+			for _, f := range files {
+				if f.ModTime.After(album.modTime) {
+					album.modTime = f.ModTime
+				}
+			}
+			albums = append(albums, album)
+		}
+		return nil
+	})
+	sortAlbums(albums, budget.Priority, profiles.ReadTags)
+
+	bitrates := budget.bitrates(profiles.Base().BitrateKbps)
+	previous := -1
+	for i, kbps := range bitrates {
+		if kbps == previousKbps {
+			previous = i
+		}
+	}
+	// try each bitrate, highest first, until the library fits (or the lowest is reached):
+	var bitrate int
+	for i, kbps := range bitrates {
+		bitrate = kbps
+		profiles.SetBaseBitrate(bitrate)
+		total := estimateAlbumSizes(albums, profiles)
+		limit := budget.MaxSize
+		if previous >= 0 && i < previous {
+			limit = int64(float64(budget.MaxSize) * budgetRaiseMargin)
+		}
+		if total <= limit {
+			break
+		}
+	}
+
+	plan := &SizePlan{BitrateKbps: bitrate}
+	for _, album := range albums {
+		if plan.Size+album.size <= budget.MaxSize {
+			plan.Included = append(plan.Included, album)
+			plan.Size += album.size
+		} else {
+			plan.LeftOut = append(plan.LeftOut, album)
+			plan.LeftOutSize += album.size
+			plan.LeftOutFiles += len(album.files)
+		}
+	}
+	return plan
+}
+
+// estimateAlbumSizes updates the estimated size of each album, and returns their total.
+func estimateAlbumSizes(albums []*budgetAlbum, profiles *ProfileSelector) int64 {
+	var total int64
+	for _, album := range albums {
+		album.size = 0
+		for _, f := range album.files {
+			album.size += estimatedDestSize(f, profiles.For(f))
+		}
+		total += album.size
+	}
+	return total
+}
+
+// sortAlbums sorts the given albums in priority order; ties are broken by path.
+// For the rating priority, tags are read with the given TagReader.
+func sortAlbums(albums []*budgetAlbum, priority string, readTags TagReader) {
+	if priority == sizePriorityRating {
+		for _, album := range albums {
+			album.rating = averageRating(album.files, readTags)
+		}
+	}
+	sort.SliceStable(albums, func(i, j int) bool {
+		a, b := albums[i], albums[j]
+		switch priority {
+		case sizePriorityRecent:
+			if !a.modTime.Equal(b.modTime) {
+				return a.modTime.After(b.modTime)
+			}
+		case sizePriorityRating:
+			if a.rating != b.rating {
+				return a.rating > b.rating
+			}
+		}
+		return a.dir.FilesystemPath < b.dir.FilesystemPath
+	})
+}
+
+// averageRating returns the average rating tag (see audioinfo.TagRating) of those of the given files which are rated.
+func averageRating(files []*MusicTreeNode, readTags TagReader) float64 {
+	var sum float64
+	rated := 0
+	for _, f := range files {
+		tags, err := readTags(f.FilesystemPath)
+		if err != nil {
+			if *verboseFlag {
+				log.Printf("could not read tags from '%s': %s", f.FilesystemPath, err)
+			}
+			continue
+		}
+		if rating, err := strconv.ParseFloat(tags.Get(audioinfo.TagRating), 64); err == nil {
+			sum += rating
+			rated++
+		}
+	}
+	if rated == 0 {
+		return 0
+	}
+	return sum / float64(rated)
+}
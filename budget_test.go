@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// budgetTestTree returns a source tree with albums A, B, and C (modified in that order), each holding two
+// 10 MB, 320 Kbps MP3 files.
+func budgetTestTree(rootPath string) *MusicTreeNode {
+	root := &MusicTreeNode{IsDirectory: true, FilesystemPath: rootPath, Children: make(map[string]*MusicTreeNode)}
+	modTime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a", "b", "c"} {
+		modTime = modTime.Add(time.Hour)
+		album := &MusicTreeNode{
+			TreePath:           []string{name},
+			FilesystemPath:     filepath.Join(rootPath, name),
+			IsDirectory:        true,
+			BaseName:           name,
+			BaseNameNormalized: name,
+			Children:           make(map[string]*MusicTreeNode),
+		}
+		for i := 1; i <= 2; i++ {
+			baseName := fmt.Sprintf("%02d.mp3", i)
+			album.Children[normalizeFileNameForComparing(baseName)] = &MusicTreeNode{
+				TreePath:           []string{name, normalizeFileNameForComparing(baseName)},
+				FilesystemPath:     filepath.Join(rootPath, name, baseName),
+				IsFile:             true,
+				IsMusicFile:        true,
+				BaseName:           baseName,
+				BaseNameNormalized: normalizeFileNameForComparing(baseName),
+				FileSize:           10000000,
+				FileBitrate:        320000,
+				FileCodec:          "mp3",
+				FileSampleRate:     44100,
+				FileChannels:       2,
+				ModTime:            modTime,
+			}
+		}
+		root.Children[name] = album
+	}
+	return root
+}
+
+func TestPlanSizeBudget(t *testing.T) {
+	// at 256 Kbps, each album is estimated at 15.875 MB; at 224, 13.875 MB; at 192, 11.875 MB; at 128, 7.875 MB.
+	tests := []struct {
+		name         string
+		budget       SizeBudget
+		previousKbps int
+		wantKbps     int
+		wantIncluded []string
+	}{
+		{"fits", SizeBudget{MaxSize: 50000000, Priority: sizePriorityPath}, 0, 256, []string{"a", "b", "c"}},
+		{"path priority", SizeBudget{MaxSize: 40000000, Priority: sizePriorityPath}, 0, 256, []string{"a", "b"}},
+		{"recent priority", SizeBudget{MaxSize: 40000000, Priority: sizePriorityRecent}, 0, 256, []string{"c", "b"}},
+		{"lowered bitrate", SizeBudget{MaxSize: 40000000, Priority: sizePriorityPath, MinKbps: 128}, 0, 192, []string{"a", "b", "c"}},
+		{"lowest bitrate", SizeBudget{MaxSize: 20000000, Priority: sizePriorityPath, MinKbps: 128}, 0, 128, []string{"a", "b"}},
+		{"previous bitrate kept", SizeBudget{MaxSize: 44000000, Priority: sizePriorityPath, MinKbps: 128}, 192, 192, []string{"a", "b", "c"}},
+		{"without previous bitrate", SizeBudget{MaxSize: 44000000, Priority: sizePriorityPath, MinKbps: 128}, 0, 224, []string{"a", "b", "c"}},
+		{"previous bitrate raised", SizeBudget{MaxSize: 48000000, Priority: sizePriorityPath, MinKbps: 128}, 192, 224, []string{"a", "b", "c"}},
+		{"previous bitrate lowered", SizeBudget{MaxSize: 40000000, Priority: sizePriorityPath, MinKbps: 128}, 224, 192, []string{"a", "b", "c"}},
+		{"previous bitrate no longer allowed", SizeBudget{MaxSize: 44000000, Priority: sizePriorityPath, MinKbps: 128}, 96, 224, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootPath := filepath.Join(string(filepath.Separator), "music")
+			profiles, err := NewProfileSelector(testProfile(policyBitrate, "libmp3lame", 256, channelsKeep), rootPath, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plan := PlanSizeBudget(budgetTestTree(rootPath), profiles, tt.budget, tt.previousKbps)
+			if plan.BitrateKbps != tt.wantKbps || profiles.Base().BitrateKbps != tt.wantKbps {
+				t.Errorf("plan bitrate = %d Kbps (base profile at %d Kbps), want %d Kbps", plan.BitrateKbps, profiles.Base().BitrateKbps, tt.wantKbps)
+			}
+			var included []string
+			for _, album := range plan.Included {
+				included = append(included, album.dir.BaseName)
+			}
+			if !reflect.DeepEqual(included, tt.wantIncluded) {
+				t.Errorf("included albums = %v, want %v", included, tt.wantIncluded)
+			}
+			if plan.Size > tt.budget.MaxSize {
+				t.Errorf("plan size %d exceeds budget %d", plan.Size, tt.budget.MaxSize)
+			}
+			if wantLeftOut := 3 - len(tt.wantIncluded); len(plan.LeftOut) != wantLeftOut || plan.LeftOutFiles != 2*wantLeftOut {
+				t.Errorf("left out %d albums (%d files), want %d (%d files)", len(plan.LeftOut), plan.LeftOutFiles, wantLeftOut, 2*wantLeftOut)
+			}
+		})
+	}
+}
+
+func TestSizeBudgetBitrates(t *testing.T) {
+	tests := []struct {
+		minKbps int
+		want    []int
+	}{
+		{0, []int{256}},
+		{256, []int{256}},
+		{128, []int{256, 224, 192, 160, 128}},
+		{100, []int{256, 224, 192, 160, 128, 112, 100}},
+	}
+	for _, tt := range tests {
+		if got := (SizeBudget{MinKbps: tt.minKbps}).bitrates(256); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bitrates with minimum %d Kbps = %v, want %v", tt.minKbps, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"msync/dzutil"
+)
+
+const (
+	// coverArtKeep copies embedded cover art into transcoded files as-is.
+	coverArtKeep = "keep"
+	// coverArtResize downscales embedded cover art in transcoded files (see EncodingProfile.CoverArtMaxSize).
+	coverArtResize = "resize"
+	// coverArtStrip removes embedded cover art from transcoded files.
+	coverArtStrip = "strip"
+	// coverArtExtract removes embedded cover art from transcoded files, and saves it once per album
+	// (ie. per destination directory) to coverArtFileName instead.
+	coverArtExtract = "extract"
+
+	// coverArtFileName is the name of the file cover art is extracted to, in coverArtExtract mode.
+	coverArtFileName = "cover.jpg"
+)
+
+// scaledCoverArtArgs returns the ffmpeg output options which re-encode cover art as a JPEG,
+// downscaled to fit within this profile's maximum size (if any).
+func (p EncodingProfile) scaledCoverArtArgs() []string {
+	args := []string{"-c:v", "mjpeg", "-q:v", strconv.Itoa(p.CoverArtQuality)}
+	if p.CoverArtMaxSize > 0 {
+		size := strconv.Itoa(p.CoverArtMaxSize)
+		args = append(args, "-vf", "scale='min(iw,"+size+")':'min(ih,"+size+")':force_original_aspect_ratio=decrease")
+	}
+	return args
+}
+
+// FFmpegCoverArtArgs returns the ffmpeg output options which handle embedded cover art when transcoding.
+func (p EncodingProfile) FFmpegCoverArtArgs() []string {
+	switch p.CoverArt {
+	case coverArtKeep:
+		return []string{"-c:v", "copy"}
+	case coverArtResize:
+		return append(p.scaledCoverArtArgs(), "-disposition:v:0", "attached_pic")
+	default:
+		return []string{"-vn"}
+	}
+}
+
+// EmbedsCoverArt returns true iff transcodes made with this profile carry embedded cover art.
+func (p EncodingProfile) EmbedsCoverArt() bool {
+	return p.CoverArt == coverArtKeep || p.CoverArt == coverArtResize
+}
+
+// IsExtractedCoverArt returns true iff the given destination node is a cover art file extracted by
+// msync, and it should be kept: the profile still extracts cover art, and its album is still in the source.
+func (p EncodingProfile) IsExtractedCoverArt(n *MusicTreeNode, sourceTree *MusicTreeNode) bool {
+	if p.CoverArt != coverArtExtract || !n.IsFile || n.SyncState == nil || n.SyncState.Operation != syncOpExtractArt {
+		return false
+	}
+	return sourceTree.HasNodeAtTreePath(n.TreePath[:len(n.TreePath)-1])
+}
+
+// coverArtExtractor saves the cover art embedded in source files to coverArtFileName in their
+// destination directories, once per directory. It's safe for concurrent use.
+type coverArtExtractor struct {
+	profile  EncodingProfile
+	fileMode os.FileMode   // of extracted cover art files
+	timeout  time.Duration // for each ffmpeg run; see dzutil.Exec
+	lock     sync.Mutex
+	done     map[string]bool // destination directories which have cover art (or are having it extracted right now)
+}
+
+func newCoverArtExtractor(profile EncodingProfile, fileMode os.FileMode, timeout time.Duration) *coverArtExtractor {
+	return &coverArtExtractor{
+		profile:  profile,
+		fileMode: fileMode,
+		timeout:  timeout,
+		done:     make(map[string]bool),
+	}
+}
+
+// Extract saves the cover art embedded in the given source file to destDir, unless destDir already
+// has cover art. It returns the path of the file written, or an empty string if nothing needed doing.
+// If the source file has no cover art, an error is returned, and a later call (for another track of
+// the same album) may try again.
+func (e *coverArtExtractor) Extract(ctx context.Context, sourcePath, destDir string) (string, error) {
+	destPath := filepath.Join(destDir, coverArtFileName)
+	e.lock.Lock()
+	if e.done[destDir] {
+		e.lock.Unlock()
+		return "", nil
+	}
+	e.done[destDir] = true
+	e.lock.Unlock()
+
+	if _, err := os.Stat(destPath); err == nil {
+		return "", nil
+	}
+	if err := e.extract(ctx, sourcePath, destPath); err != nil {
+		e.lock.Lock()
+		delete(e.done, destDir)
+		e.lock.Unlock()
+		return "", fmt.Errorf("failed to extract cover art from '%s': %w", sourcePath, err)
+	}
+	return destPath, nil
+}
+
+// extract runs ffmpeg to save the cover art embedded in the given source file to destPath. The cover art
+// is written to a temporary file first, so an interrupted extraction never leaves a partial file at destPath.
+func (e *coverArtExtractor) extract(ctx context.Context, sourcePath, destPath string) error {
+	tmpPath, err := dzutil.TempFileFor(destPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op once the cover art has been moved into place
+	args := append([]string{"-loglevel", "warning", "-hide_banner", "-i", sourcePath, "-an", "-frames:v", "1", "-update", "1"}, e.profile.scaledCoverArtArgs()...)
+	if _, _, err := dzutil.Exec(ctx, e.timeout, "ffmpeg", append(args, "-y", tmpPath)); err != nil {
+		return err
+	}
+	return dzutil.CommitTempFile(tmpPath, destPath, e.fileMode)
+}
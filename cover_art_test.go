@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegCoverArtArgs(t *testing.T) {
+	scale := "scale='min(iw,500)':'min(ih,500)':force_original_aspect_ratio=decrease"
+	tests := []struct {
+		policy     string
+		maxSize    int
+		quality    int
+		want       []string
+		wantEmbeds bool
+	}{
+		{coverArtKeep, 0, 0, []string{"-c:v", "copy"}, true},
+		{coverArtResize, 500, 4, []string{"-c:v", "mjpeg", "-q:v", "4", "-vf", scale, "-disposition:v:0", "attached_pic"}, true},
+		{coverArtStrip, 0, 0, []string{"-vn"}, false},
+		{coverArtExtract, 0, 2, []string{"-vn"}, false},
+	}
+	for _, tt := range tests {
+		p := testProfile(policyBitrate, "aac", 256, channelsKeep)
+		p.CoverArt = tt.policy
+		p.CoverArtMaxSize = tt.maxSize
+		p.CoverArtQuality = tt.quality
+		if err := p.Validate(); err != nil {
+			t.Errorf("%s: invalid profile: %s", tt.policy, err)
+			continue
+		}
+		if got := p.FFmpegCoverArtArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FFmpegCoverArtArgs = %q, want %q", tt.policy, got, tt.want)
+		}
+		if got := p.EmbedsCoverArt(); got != tt.wantEmbeds {
+			t.Errorf("%s: EmbedsCoverArt = %v, want %v", tt.policy, got, tt.wantEmbeds)
+		}
+	}
+}
+
+func TestValidateCoverArt(t *testing.T) {
+	tests := []struct {
+		policy  string
+		maxSize int
+		quality int
+		valid   bool
+	}{
+		{coverArtResize, 0, 4, false},
+		{coverArtResize, 500, 1, false},
+		{coverArtResize, 500, 32, false},
+		{coverArtExtract, 0, 2, true},
+		{coverArtExtract, -1, 2, false},
+		{"embed", 0, 0, false},
+	}
+	for _, tt := range tests {
+		p := testProfile(policyBitrate, "aac", 256, channelsKeep)
+		p.CoverArt = tt.policy
+		p.CoverArtMaxSize = tt.maxSize
+		p.CoverArtQuality = tt.quality
+		if err := p.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate with cover art '%s' (max. size %d, quality %d) = %v, want valid = %v", tt.policy, tt.maxSize, tt.quality, err, tt.valid)
+		}
+	}
+}
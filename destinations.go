@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"msync/dzutil"
+	"msync/filesize"
+)
+
+// DestinationSpec describes a destination music library, as read from the file given by -destinations.
+// Settings it doesn't give are taken from the command-line flags.
+type DestinationSpec struct {
+	Path     string      `json:"path"`
+	Symlink  *bool       `json:"symlink,omitempty"`   // if true, same as link_mode "symlink"
+	LinkMode string      `json:"link_mode,omitempty"` // see -link-mode
+	MaxSize  string      `json:"max_size,omitempty"`  // see -max-size
+	Profile  RuleProfile `json:"profile,omitempty"`   // overrides for the encoding profile given by the command-line flags
+}
+
+type destinationsFile struct {
+	Destinations []*DestinationSpec `json:"destinations"`
+}
+
+// LoadDestinations reads the destination specs in the given JSON file.
+func LoadDestinations(destinationsPath string) ([]*DestinationSpec, error) {
+	data, err := ioutil.ReadFile(destinationsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read destinations from '%s': %w", destinationsPath, err)
+	}
+	var f destinationsFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse destinations from '%s': %w", destinationsPath, err)
+	}
+	for i, spec := range f.Destinations {
+		if spec.Path == "" {
+			return nil, fmt.Errorf("destination #%d in '%s' has no path", i+1, destinationsPath)
+		}
+	}
+	return f.Destinations, nil
+}
+
+// destination is a destination music library, ready to be synced.
+type destination struct {
+	rootPath   string
+	profiles   *ProfileSelector
+	linkMode   string      // one of the linkMode* constants
+	sizeBudget *SizeBudget // nil if the destination has no -max-size
+}
+
+// newDestination resolves the given spec against the settings given on the command line: profiles (whose base
+// profile comes from the command-line flags), linkMode, and sizeBudget (which may be nil).
+func newDestination(spec *DestinationSpec, profiles *ProfileSelector, rules []*Rule, linkMode string, sizeBudget *SizeBudget) (*destination, error) {
+	rootPath, err := filepath.Abs(spec.Path)
+	if err != nil {
+		return nil, err
+	}
+	base := spec.Profile.Apply(profiles.Base())
+	if err := base.Validate(); err != nil {
+		return nil, fmt.Errorf("destination '%s': %w", spec.Path, err)
+	}
+	for _, rule := range rules {
+		if err := rule.Apply(base).Validate(); err != nil {
+			return nil, fmt.Errorf("destination '%s': rule '%s': %w", spec.Path, rule.Name, err)
+		}
+	}
+	d := &destination{
+		rootPath:   rootPath,
+		profiles:   profiles.WithBase(base),
+		linkMode:   linkMode,
+		sizeBudget: sizeBudget,
+	}
+	if spec.LinkMode != "" {
+		if err := validateLinkMode(spec.LinkMode); err != nil {
+			return nil, fmt.Errorf("destination '%s': link_mode: %w", spec.Path, err)
+		}
+		d.linkMode = spec.LinkMode
+	}
+	if spec.Symlink != nil {
+		if *spec.Symlink {
+			if spec.LinkMode != "" && spec.LinkMode != linkModeSymlink {
+				return nil, fmt.Errorf("destination '%s': symlink cannot be used with link_mode %s", spec.Path, spec.LinkMode)
+			}
+			d.linkMode = linkModeSymlink
+		} else if spec.LinkMode == "" && d.linkMode == linkModeSymlink {
+			d.linkMode = linkModeCopy
+		}
+	}
+	if spec.MaxSize != "" {
+		maxSize, err := filesize.Parse(spec.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("destination '%s': max_size: %w", spec.Path, err)
+		}
+		budget := SizeBudget{MaxSize: maxSize, Priority: *maxSizePriorityFlag, MinKbps: *maxSizeMinKbpsFlag}
+		if sizeBudget != nil {
+			budget.Priority, budget.MinKbps = sizeBudget.Priority, sizeBudget.MinKbps
+		}
+		d.sizeBudget = &budget
+	}
+	if d.sizeBudget != nil {
+		if err := d.sizeBudget.Validate(base); err != nil {
+			return nil, fmt.Errorf("destination '%s': %w", spec.Path, err)
+		}
+	}
+	return d, nil
+}
+
+// pathsOverlap returns true iff either of the given absolute paths is the other, or is inside it.
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+string(os.PathSeparator)) || strings.HasPrefix(b, a+string(os.PathSeparator))
+}
+
+// sharedTranscodes tracks the files transcoded for each destination, so a later destination needing the
+// same transcode (ie. of the same source file, with the same encoder settings) can reuse it instead of
+// transcoding the file again. It's safe for concurrent use.
+type sharedTranscodes struct {
+	lock  sync.Mutex
+	paths map[string]string // key (see sharedTranscodeKey) -> path of transcoded file
+}
+
+func newSharedTranscodes() *sharedTranscodes {
+	return &sharedTranscodes{paths: make(map[string]string)}
+}
+
+func sharedTranscodeKey(sourcePath, encoderSettings string) string {
+	return sourcePath + "\x00" + encoderSettings
+}
+
+// Put records that the given source file was transcoded, with the given encoder settings (see EncodingProfile.ID), to destPath.
+func (t *sharedTranscodes) Put(sourcePath, encoderSettings, destPath string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.paths[sharedTranscodeKey(sourcePath, encoderSettings)] = destPath
+}
+
+// Get returns the path of a file transcoded from the given source file with the given encoder settings, if there is one.
+func (t *sharedTranscodes) Get(sourcePath, encoderSettings string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	destPath, ok := t.paths[sharedTranscodeKey(sourcePath, encoderSettings)]
+	return destPath, ok
+}
+
+// linkOrCopy hardlinks destPath to sharedPath if possible (ie. if they're on the same filesystem), and
+// otherwise copies sharedPath to destPath. With copyOptions.PreserveModTime, a copy gets the given
+// modification time (that of the source music file) rather than the shared file's.
+func linkOrCopy(sharedPath, destPath string, modTime time.Time, copyOptions dzutil.CopyOptions) error {
+	if err := os.Link(sharedPath, destPath); err == nil {
+		return nil
+	} else if errors.Is(err, os.ErrExist) {
+		return err
+	}
+	preserveModTime := copyOptions.PreserveModTime
+	copyOptions.PreserveModTime = false
+	if err := dzutil.CopyFileWithOptions(sharedPath, destPath, copyOptions); err != nil {
+		return err
+	}
+	if preserveModTime {
+		return os.Chtimes(destPath, modTime, modTime)
+	}
+	return nil
+}
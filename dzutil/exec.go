@@ -1,17 +1,139 @@
 package dzutil
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 )
 
-// Exec finds the executable with the given name in the path, runs it, and returns its output.
-func Exec(executable string, args []string) (string, error) {
+// stderrTailLines is the number of lines, from the end of a failed command's stderr, included in its ExecError.
+const stderrTailLines = 10
+
+// running tracks the commands started by Exec which haven't exited yet, so KillAll can kill them.
+var running = struct {
+	lock   sync.Mutex
+	cmds   map[*exec.Cmd]bool
+	killed bool // set by KillAll; no more commands may be started
+}{cmds: make(map[*exec.Cmd]bool)}
+
+// errKilled is the error of an ExecError for a command which wasn't started because KillAll was called.
+var errKilled = errors.New("not started, because all commands were killed")
+
+// KillAll kills every command started by Exec which is still running, along with any processes they started,
+// and stops Exec from starting any more. Since those commands run in their own process groups, they don't
+// receive the terminal's signals (eg. from Ctrl-C); this must be called before exiting without waiting for
+// them, so they aren't left running.
+func KillAll() {
+	running.lock.Lock()
+	defer running.lock.Unlock()
+	running.killed = true
+	for cmd := range running.cmds {
+		killProcessGroup(cmd)
+	}
+}
+
+// ExecError describes a command, run by Exec, which failed.
+type ExecError struct {
+	Executable string
+	ExitCode   int           // the command's exit status; -1 if it couldn't be run, or didn't exit normally (eg. because it was killed)
+	StderrTail string        // the last few lines the command wrote to stderr
+	TimedOut   bool          // whether the command was killed because it ran for longer than Timeout
+	Timeout    time.Duration // the timeout given to Exec
+	Err        error         // the underlying error; if the command was canceled, this is the context's error
+}
+
+func (e *ExecError) Error() string {
+	var msg string
+	switch {
+	case e.TimedOut:
+		msg = fmt.Sprintf("%s timed out after %s", e.Executable, e.Timeout)
+	case e.ExitCode >= 0:
+		msg = fmt.Sprintf("%s exited with status %d", e.Executable, e.ExitCode)
+	default:
+		msg = fmt.Sprintf("%s failed: %s", e.Executable, e.Err)
+	}
+	if e.StderrTail != "" {
+		msg += ": " + e.StderrTail
+	}
+	return msg
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Exec finds the executable with the given name in the path, runs it, and returns what it writes to
+// stdout and stderr. The process, along with any processes it starts, is killed if ctx is done before
+// it exits, or if it runs for longer than timeout (unless timeout is 0).
+// If the process can't be run, or doesn't exit successfully, the returned error is an *ExecError.
+func Exec(ctx context.Context, timeout time.Duration, executable string, args []string) (stdout, stderr string, err error) {
 	path, err := exec.LookPath(executable)
 	if err != nil {
-		return fmt.Sprintf("command not found: %s", executable), err
+		return "", "", &ExecError{Executable: executable, ExitCode: -1, Err: err}
+	}
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = &stdoutBuf
+	cmd.Stderr = &stderrBuf
+	setProcessGroup(cmd)
+	running.lock.Lock()
+	if running.killed {
+		running.lock.Unlock()
+		return "", "", &ExecError{Executable: executable, ExitCode: -1, Err: errKilled}
+	}
+	if err := cmd.Start(); err != nil {
+		running.lock.Unlock()
+		return "", "", &ExecError{Executable: executable, ExitCode: -1, Err: err}
+	}
+	running.cmds[cmd] = true
+	running.lock.Unlock()
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-runCtx.Done():
+			killProcessGroup(cmd)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+	running.lock.Lock()
+	delete(running.cmds, cmd)
+	running.lock.Unlock()
+
+	stdout, stderr = strings.TrimSpace(stdoutBuf.String()), strings.TrimSpace(stderrBuf.String())
+	if err == nil {
+		return stdout, stderr, nil
+	}
+	execErr := &ExecError{Executable: executable, ExitCode: -1, StderrTail: lastLines(stderr, stderrTailLines), Timeout: timeout, Err: err}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		execErr.Err = ctxErr
+	} else if runCtx.Err() != nil {
+		execErr.TimedOut = true
+		execErr.Err = runCtx.Err()
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		execErr.ExitCode = exitErr.ExitCode()
+	}
+	return stdout, stderr, execErr
+}
+
+// lastLines returns the last n lines of s.
+func lastLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
 	}
-	raw, err := exec.Command(path, args...).CombinedOutput()
-	return strings.TrimSpace(string(raw)), err
+	return strings.Join(lines, "\n")
 }
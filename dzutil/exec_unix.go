@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package dzutil
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the given command, once started, the leader of a new process group,
+// so killProcessGroup can kill any processes it starts, too.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the given started command's process group (see setProcessGroup).
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,11 @@
+package dzutil
+
+import "os/exec"
+
+// setProcessGroup does nothing on Windows, which has no process groups; see killProcessGroup.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the given started command. Any processes it started are left running.
+func killProcessGroup(cmd *exec.Cmd) {
+	_ = cmd.Process.Kill()
+}
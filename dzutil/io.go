@@ -1,25 +1,175 @@
 package dzutil
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
 )
 
+// CopyOptions configures how CopyFileWithOptions copies a file.
+type CopyOptions struct {
+	Mode            os.FileMode // permissions of the copy
+	Verify          bool        // if set, the copy is read back and its SHA-256 hash compared to the source's before it's moved into place
+	PreserveModTime bool        // if set, the copy gets the source file's modification time
+	PreserveXattrs  bool        // if set, the source file's extended attributes are copied, where the platform and filesystems support them
+}
+
 // CopyFile copies the file at `from` to the path `to`, creating `to` with the
-// given permissions.
+// given permissions. See CopyFileWithOptions.
 func CopyFile(from, to string, mode os.FileMode) error {
+	return CopyFileWithOptions(from, to, CopyOptions{Mode: mode})
+}
+
+// CopyFileWithOptions copies the file at `from` to the path `to`, replacing any existing file there.
+// The copy is written to a temporary file in the same directory, synced to disk, and only then renamed
+// into place, so `to` never holds a partial copy, even if msync or the system crashes.
+func CopyFileWithOptions(from, to string, opts CopyOptions) error {
 	fromFile, err := os.Open(from)
 	if err != nil {
 		return err
 	}
 	defer fromFile.Close()
+	fromInfo, err := fromFile.Stat()
+	if err != nil {
+		return err
+	}
 
-	toFile, err := os.OpenFile(to, os.O_RDWR|os.O_CREATE, mode)
+	tmpPath, err := TempFileFor(to)
 	if err != nil {
 		return err
 	}
-	defer toFile.Close()
+	defer os.Remove(tmpPath) // no-op once the copy has been moved into place
+	tmpFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	sourceHash := sha256.New()
+	var w io.Writer = tmpFile
+	if opts.Verify {
+		w = io.MultiWriter(tmpFile, sourceHash)
+	}
+	if _, err := io.Copy(w, fromFile); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Chmod(opts.Mode); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if opts.Verify {
+		copyHash, err := FileSHA256(tmpPath)
+		if err != nil {
+			return err
+		}
+		if copyHash != hex.EncodeToString(sourceHash.Sum(nil)) {
+			return fmt.Errorf("copy of '%s' failed verification: its SHA-256 hash doesn't match the source's", from)
+		}
+	}
+	if err := preserveAttributes(from, fromInfo, tmpPath, opts); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, to)
+}
 
-	_, err = io.Copy(toFile, fromFile)
-	return err
+// preserveAttributes gives the copy at tmpPath of the file at `from` (whose info is fromInfo) the source
+// file's extended attributes and modification time, as the given options ask.
+func preserveAttributes(from string, fromInfo os.FileInfo, tmpPath string, opts CopyOptions) error {
+	if opts.PreserveXattrs {
+		if err := copyXattrs(from, tmpPath); err != nil {
+			return fmt.Errorf("failed to copy extended attributes of '%s': %w", from, err)
+		}
+	}
+	if opts.PreserveModTime {
+		if err := os.Chtimes(tmpPath, fromInfo.ModTime(), fromInfo.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TempFileFor creates a new, empty temporary file in the same directory as the given path, with the same
+// extension, and returns its path. Once it's been written, it can be moved into place with CommitTempFile;
+// until then, readers of the given path never observe a partially-written file.
+func TempFileFor(path string) (string, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), "."+RemoveExt(filepath.Base(path))+".*.tmp"+filepath.Ext(path))
+	if err != nil {
+		return "", err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// tempFileNameRegex matches the base names of temporary files created by TempFileFor.
+var tempFileNameRegex = regexp.MustCompile(`^\..*\.[0-9]+\.tmp(\.[^.]*)?$`)
+
+// IsTempFile returns true iff the given path is named like a temporary file created by TempFileFor; eg. one
+// left behind when the process writing it was killed.
+func IsTempFile(path string) bool {
+	return tempFileNameRegex.MatchString(filepath.Base(path))
+}
+
+// CommitTempFile gives the temporary file at tmpPath (see TempFileFor) the given permissions, syncs it to disk,
+// and renames it to path, replacing any existing file there.
+func CommitTempFile(tmpPath, path string, mode os.FileMode) error {
+	f, err := os.OpenFile(tmpPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// WriteFileAtomic writes data to the file at the given path, creating it with the given permissions.
+// The data is written to a temporary file in the same directory, which is then renamed into place,
+// so readers never observe a partially-written file.
+func WriteFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmpPath, err := TempFileFor(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	if err := ioutil.WriteFile(tmpPath, data, mode); err != nil {
+		return err
+	}
+	return CommitTempFile(tmpPath, path, mode)
+}
+
+// FileSHA256 returns the hex-encoded SHA-256 hash of the file at the given path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
@@ -0,0 +1,17 @@
+package dzutil
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrReflinkUnsupported is returned by Reflink when the platform or filesystem doesn't support
+// copy-on-write clones, or when the source and destination are on different filesystems.
+var ErrReflinkUnsupported = errors.New("reflinks are not supported here")
+
+// IsLinkUnsupported returns true iff the given error, from os.Link, means hardlinks can't be made between
+// the given paths at all (eg. because they're on different filesystems, or the filesystem doesn't support
+// hardlinks), rather than that just this file can't be hardlinked.
+func IsLinkUnsupported(err error) bool {
+	return errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package dzutil
+
+// Reflink would create `to` as a copy-on-write clone of the file at `from`; it's only implemented on Linux,
+// so here it always returns ErrReflinkUnsupported.
+func Reflink(from, to string, opts CopyOptions) error {
+	return ErrReflinkUnsupported
+}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package dzutil
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// SameFilesystem returns true iff the files or directories at the two given paths are on the same filesystem
+// (ie. device), so that hardlinks and reflinks between them are possible.
+func SameFilesystem(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	aStat, aOK := aInfo.Sys().(*syscall.Stat_t)
+	bStat, bOK := bInfo.Sys().(*syscall.Stat_t)
+	if !aOK || !bOK {
+		return false, fmt.Errorf("cannot determine the filesystem of '%s' or '%s'", a, b)
+	}
+	return aStat.Dev == bStat.Dev, nil
+}
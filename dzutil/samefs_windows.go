@@ -0,0 +1,20 @@
+package dzutil
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SameFilesystem returns true iff the files or directories at the two given paths are on the same volume,
+// so that hardlinks between them are possible.
+func SameFilesystem(a, b string) (bool, error) {
+	aPath, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	bPath, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(aPath), filepath.VolumeName(bPath)), nil
+}
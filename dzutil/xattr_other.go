@@ -0,0 +1,10 @@
+//go:build !darwin && !linux
+// +build !darwin,!linux
+
+package dzutil
+
+// copyXattrs would copy the extended attributes of the file at `from` to the file at `to`;
+// they're only supported on Linux and macOS, so here it does nothing.
+func copyXattrs(from, to string) error {
+	return nil
+}
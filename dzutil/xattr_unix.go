@@ -0,0 +1,81 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package dzutil
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyXattrs copies the extended attributes of the file at `from` to the file at `to`.
+// If either filesystem doesn't support extended attributes, nothing is copied.
+func copyXattrs(from, to string) error {
+	names, err := listXattrs(from)
+	if err != nil {
+		if isXattrUnsupported(err) {
+			return nil
+		}
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(from, name)
+		if errors.Is(err, unix.ENODATA) {
+			continue // removed since it was listed
+		} else if err != nil {
+			return err
+		}
+		if err := unix.Setxattr(to, name, value, 0); err != nil {
+			if isXattrUnsupported(err) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattrBuf(func(dest []byte) (int, error) { return unix.Listxattr(path, dest) })
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	return readXattrBuf(func(dest []byte) (int, error) { return unix.Getxattr(path, name, dest) })
+}
+
+// readXattrBuf calls read, which behaves like listxattr(2) or getxattr(2), with a buffer large enough for its result.
+func readXattrBuf(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // grew since its size was read
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
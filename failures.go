@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"msync/cli"
+	"msync/dzutil"
+)
+
+// exitCodePartialSuccess is msync's exit status when, with -keep-going, the sync finished but some files failed to sync.
+const exitCodePartialSuccess = 3
+
+// errPartialSuccess is returned by msyncMain when, with -keep-going, some files failed to sync.
+var errPartialSuccess = errors.New("some files failed to sync")
+
+// Stages of the sync at which a file can fail, with -keep-going.
+const (
+	failureStageScan      = "scan"      // the file or directory couldn't be read while scanning the source or destination
+	failureStageProbe     = "probe"     // the music file's bitrate couldn't be determined
+	failureStageMkdir     = "mkdir"     // the file's directory couldn't be created in the destination
+	failureStageCopy      = "copy"      // the file couldn't be copied (or hardlinked, or reflinked) into the destination
+	failureStageSymlink   = "symlink"   // the file couldn't be symlinked into the destination
+	failureStageTranscode = "transcode" // the file couldn't be transcoded into the destination
+	failureStageTrash     = "trash"     // the destination file or directory couldn't be removed
+)
+
+// failureStages lists the failureStage* constants in the order they're reported.
+var failureStages = []string{failureStageScan, failureStageProbe, failureStageMkdir, failureStageCopy, failureStageSymlink, failureStageTranscode, failureStageTrash}
+
+// FileFailure describes a file which failed to sync.
+type FileFailure struct {
+	Stage       string // one of the failureStage* constants
+	Path        string
+	Destination string // root path of the destination the source file at Path was being synced to, if any
+	Err         error
+}
+
+// FailureReport collects the files which failed to sync, with -keep-going, so the rest of the library can be
+// synced and the failures reported at the end of the run. It's safe for concurrent use.
+// A nil *FailureReport, used without -keep-going, collects nothing; see Record.
+type FailureReport struct {
+	lock     sync.Mutex
+	failures []*FileFailure
+}
+
+// Add adds the given failure to the report. It's a no-op on a nil report.
+func (r *FailureReport) Add(f *FileFailure) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.failures = append(r.failures, f)
+}
+
+// Record adds the given failure to the report, logs a warning about it, and returns nil, so the caller can
+// carry on with the rest of the sync. If the report is nil (ie. without -keep-going), or the given context
+// is canceled, the failure's error is returned instead, so the caller stops.
+func (r *FailureReport) Record(ctx context.Context, f *FileFailure) error {
+	if r == nil || ctx.Err() != nil {
+		return f.Err
+	}
+	r.Add(f)
+	cli.Out(ctx).Warning(fmt.Sprintf("Failed to %s '%s' (continuing due to -keep-going): %s", f.Stage, f.Path, f.Err))
+	return nil
+}
+
+// Len returns the number of failures in the report.
+func (r *FailureReport) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.failures)
+}
+
+// Lines returns the report, with its failures grouped by stage, as lines of text.
+func (r *FailureReport) Lines() []string {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	byStage := make(map[string][]*FileFailure)
+	destinations := make(map[string]bool)
+	for _, f := range r.failures {
+		byStage[f.Stage] = append(byStage[f.Stage], f)
+		if f.Destination != "" {
+			destinations[f.Destination] = true
+		}
+	}
+	lines := []string{fmt.Sprintf("%d files failed to sync.", len(r.failures))}
+	for _, stage := range failureStages {
+		failures := byStage[stage]
+		if len(failures) == 0 {
+			continue
+		}
+		sort.SliceStable(failures, func(i, j int) bool {
+			return failures[i].Path < failures[j].Path
+		})
+		lines = append(lines, "", fmt.Sprintf("%s (%d):", stage, len(failures)))
+		for _, f := range failures {
+			if len(destinations) > 1 && f.Destination != "" {
+				lines = append(lines, fmt.Sprintf("- %s (to %s): %s", f.Path, f.Destination, f.Err))
+			} else {
+				lines = append(lines, fmt.Sprintf("- %s: %s", f.Path, f.Err))
+			}
+		}
+	}
+	return lines
+}
+
+// WriteFile writes the report to the file at the given path.
+func (r *FailureReport) WriteFile(path string) error {
+	data := []byte(strings.Join(r.Lines(), "\n") + "\n")
+	if err := dzutil.WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write failure report to '%s': %w", path, err)
+	}
+	return nil
+}
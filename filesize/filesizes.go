@@ -1,6 +1,11 @@
 package filesize
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
 
 // based on https://yourbasic.org/golang/formatting-byte-size-to-human-readable-format/
 
@@ -44,3 +49,42 @@ func ByteCountIEC(b int64) string {
 	return fmt.Sprintf("%.1f %ciB",
 		float64(b)/float64(div), "KMGTPE"[exp])
 }
+
+// unitMultipliers maps (lowercased) unit suffixes accepted by Parse to their sizes in bytes.
+var unitMultipliers = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1e3,
+	"kb":  1e3,
+	"m":   1e6,
+	"mb":  1e6,
+	"g":   1e9,
+	"gb":  1e9,
+	"t":   1e12,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+// Parse parses a human-readable byte count, like "60GB" or "1.5 TiB". Units with an "i" (eg. "GiB")
+// are IEC (base 2); others (eg. "GB") are SI (base 10). A number with no unit is a count of bytes.
+func Parse(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	split := strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if split < 0 {
+		split = len(s)
+	}
+	value, err := strconv.ParseFloat(s[:split], 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	multiplier, ok := unitMultipliers[strings.ToLower(strings.TrimSpace(s[split:]))]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s': unknown unit '%s'", s, strings.TrimSpace(s[split:]))
+	}
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,23 @@
+package filesize
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := map[string]int64{
+		"100":     100,
+		"60GB":    60e9,
+		"64g":     64e9,
+		"1.5 TiB": 1.5 * (1 << 40),
+		"512 MiB": 512 << 20,
+	}
+	for s, want := range tests {
+		if got, err := Parse(s); err != nil || got != want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "GB", "12XB", "-1GB"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", s)
+		}
+	}
+}
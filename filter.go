@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the name of the gitignore-like files, in source directories, listing paths to leave
+// out of the destination.
+const ignoreFileName = ".msyncignore"
+
+// ignorePattern is a single pattern read from an ignore file.
+type ignorePattern struct {
+	dir     string // slash-separated path of the directory containing the ignore file, relative to the library root; "" for the root itself
+	pattern string // glob pattern, relative to dir (see matchPathGlob)
+	negate  bool   // whether this pattern re-includes paths excluded by earlier patterns
+	dirOnly bool   // whether this pattern only matches directories
+}
+
+func (p ignorePattern) matches(relPath string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.dir != "" {
+		if len(relPath) <= len(p.dir) || relPath[len(p.dir)] != '/' || !strings.EqualFold(relPath[:len(p.dir)], p.dir) {
+			return false
+		}
+		relPath = relPath[len(p.dir)+1:]
+	}
+	return matchPathGlob(p.pattern, relPath)
+}
+
+// PathFilter decides which paths in a source library are mirrored to the destination, based on
+// -include and -exclude patterns and any ignore files found while scanning the library.
+// A nil *PathFilter excludes nothing.
+type PathFilter struct {
+	rootPath string
+	includes []string
+	excludes []string
+	ignores  []ignorePattern
+}
+
+// NewPathFilter returns a PathFilter for the library at rootPath. If includes is nonempty, only files
+// matching at least one of its patterns are mirrored. Paths matching any of excludes are never mirrored.
+func NewPathFilter(rootPath string, includes, excludes []string) (*PathFilter, error) {
+	for _, pattern := range append(append([]string{}, includes...), excludes...) {
+		if err := validatePathGlob(pattern); err != nil {
+			return nil, fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+	}
+	return &PathFilter{
+		rootPath: rootPath,
+		includes: includes,
+		excludes: excludes,
+	}, nil
+}
+
+// Excludes returns true iff the file or directory at the given path (under the filter's root) should be left out.
+// Include patterns only apply to files; directories are only left out if they're excluded explicitly.
+func (f *PathFilter) Excludes(filePath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	relPath := filepath.ToSlash(relativePath(f.rootPath, filePath))
+	for _, pattern := range f.excludes {
+		if matchPathGlob(pattern, relPath) {
+			return true
+		}
+	}
+	// as in .gitignore files, the last matching pattern wins:
+	ignored := false
+	for _, p := range f.ignores {
+		if p.matches(relPath, isDir) {
+			ignored = !p.negate
+		}
+	}
+	if ignored {
+		return true
+	}
+	if isDir || len(f.includes) == 0 {
+		return false
+	}
+	for _, pattern := range f.includes {
+		if matchPathGlob(pattern, relPath) {
+			return false
+		}
+	}
+	return true
+}
+
+// PrunesEmptyDirs returns true iff directories left empty by the filter should be left out, too.
+// This is the case when include patterns are used, since otherwise every directory in the library
+// would be mirrored regardless of whether anything in it was included.
+func (f *PathFilter) PrunesEmptyDirs() bool {
+	return f != nil && len(f.includes) > 0
+}
+
+// WithIgnoreFile returns a PathFilter which also applies the patterns in the ignore file in the given
+// directory, if there is one, to that directory's contents.
+func (f *PathFilter) WithIgnoreFile(dirPath string) (*PathFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+	ignorePath := filepath.Join(dirPath, ignoreFileName)
+	file, err := os.Open(ignorePath)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", ignorePath, err)
+	}
+	defer file.Close()
+
+	dir := filepath.ToSlash(relativePath(f.rootPath, dirPath))
+	if dir == "." {
+		dir = ""
+	}
+	var patterns []ignorePattern
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{dir: dir}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+		}
+		if strings.Trim(line, "/") == "" {
+			continue
+		}
+		p.pattern = line
+		if err := validatePathGlob(path.Clean(line)); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s' at %s:%d: %w", line, ignorePath, lineNo, err)
+		}
+		patterns = append(patterns, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read '%s': %w", ignorePath, err)
+	}
+	if len(patterns) == 0 {
+		return f, nil
+	}
+
+	withIgnores := *f
+	withIgnores.ignores = append(append([]ignorePattern{}, f.ignores...), patterns...)
+	return &withIgnores, nil
+}
+
+// protectPatterns are glob patterns (see matchPathGlob) matching destination paths which must never be removed.
+var protectPatterns []string
+
+// SetProtectPatterns sets the patterns matching destination paths which must never be removed (see -protect).
+func SetProtectPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if err := validatePathGlob(pattern); err != nil {
+			return fmt.Errorf("invalid path pattern '%s': %w", pattern, err)
+		}
+	}
+	protectPatterns = patterns
+	return nil
+}
+
+// isProtected returns true iff the given node, in the tree rooted at rootPath, matches a protect pattern,
+// or is a directory containing anything which does.
+func isProtected(rootPath string, n *MusicTreeNode) bool {
+	if len(protectPatterns) == 0 {
+		return false
+	}
+	relPath := filepath.ToSlash(relativePath(rootPath, n.FilesystemPath))
+	for _, pattern := range protectPatterns {
+		if matchPathGlob(pattern, relPath) {
+			return true
+		}
+	}
+	for _, child := range n.Children {
+		if isProtected(rootPath, child) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPathFilter(t *testing.T) {
+	root := t.TempDir()
+	f, err := NewPathFilter(root, []string{"*.mp3", "*.m4a"}, []string{"Audiobooks", "/Podcasts"})
+	if err != nil {
+		t.Fatalf("NewPathFilter failed: %s", err)
+	}
+	if !f.PrunesEmptyDirs() {
+		t.Errorf("PrunesEmptyDirs = false with include patterns")
+	}
+
+	tests := []struct {
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		{"Band/01.mp3", false, false},
+		{"Band/01.M4A", false, false},
+		{"Band/01.flac", false, true},
+		{"Band/cover.jpg", false, true},
+		{"Band", true, false},
+		{"Audiobooks", true, true},
+		{"Audiobooks/01.mp3", false, true},
+		{"Music/Audiobooks", true, true},
+		{"Podcasts/01.mp3", false, true},
+		{"Music/Podcasts/01.mp3", false, false},
+	}
+	for _, tt := range tests {
+		if got := f.Excludes(filepath.Join(root, filepath.FromSlash(tt.relPath)), tt.isDir); got != tt.want {
+			t.Errorf("Excludes(%q, %v) = %v, want %v", tt.relPath, tt.isDir, got, tt.want)
+		}
+	}
+
+	var nilFilter *PathFilter
+	if nilFilter.Excludes(filepath.Join(root, "Audiobooks"), true) || nilFilter.PrunesEmptyDirs() {
+		t.Errorf("a nil PathFilter excludes paths")
+	}
+	if f, _ := NewPathFilter(root, nil, []string{"Audiobooks"}); f.PrunesEmptyDirs() {
+		t.Errorf("PrunesEmptyDirs = true without include patterns")
+	}
+	if _, err := NewPathFilter(root, nil, []string{"[Audiobooks"}); err == nil {
+		t.Errorf("NewPathFilter succeeded with an invalid pattern")
+	}
+}
+
+func TestPathFilterIgnoreFiles(t *testing.T) {
+	root := t.TempDir()
+	writeTestFile(t, root, ignoreFileName, strings.Join([]string{
+		"# a comment",
+		"",
+		"*.m4b",
+		"Live/",
+		"/Demos",
+		"!Demos/keep.mp3",
+		`\#hash.mp3`,
+		`\!bang.mp3`,
+		"trailing.mp3   ",
+	}, "\n"))
+	writeTestFile(t, root, "Band/"+ignoreFileName, "/bonus.mp3\r\n!keep.m4b\r\n")
+
+	rootFilter, err := NewPathFilter(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootFilter, err = rootFilter.WithIgnoreFile(root); err != nil {
+		t.Fatalf("WithIgnoreFile failed: %s", err)
+	}
+	bandFilter, err := rootFilter.WithIgnoreFile(filepath.Join(root, "Band"))
+	if err != nil {
+		t.Fatalf("WithIgnoreFile failed: %s", err)
+	}
+
+	tests := []struct {
+		relPath string
+		isDir   bool
+		want    bool
+	}{
+		{"01.mp3", false, false},
+		{"book.m4b", false, true},
+		{"Band/book.m4b", false, true},
+		{"Band/keep.m4b", false, false},
+		{"Other/keep.m4b", false, true},
+		{"Live", true, true},
+		{"Live", false, false},
+		{"Band/Live", true, true},
+		{"Demos", true, true},
+		{"Demos/other.mp3", false, true},
+		{"Demos/keep.mp3", false, false},
+		{"Band/Demos", true, false},
+		{"#hash.mp3", false, true},
+		{"!bang.mp3", false, true},
+		{"bang.mp3", false, false},
+		{"trailing.mp3", false, true},
+		{"a comment", false, false},
+		{"Band/bonus.mp3", false, true},
+		{"Band/Extra/bonus.mp3", false, false},
+		{"bonus.mp3", false, false},
+		{"Other/bonus.mp3", false, false},
+	}
+	for _, tt := range tests {
+		if got := bandFilter.Excludes(filepath.Join(root, filepath.FromSlash(tt.relPath)), tt.isDir); got != tt.want {
+			t.Errorf("Excludes(%q, %v) = %v, want %v", tt.relPath, tt.isDir, got, tt.want)
+		}
+	}
+	// the nested ignore file only applies to its own directory's filter:
+	if !rootFilter.Excludes(filepath.Join(root, "Band", "keep.m4b"), false) || rootFilter.Excludes(filepath.Join(root, "Band", "bonus.mp3"), false) {
+		t.Errorf("Band's ignore file applies to the root directory's filter")
+	}
+
+	// a directory without an ignore file gets the same filter:
+	if f, err := rootFilter.WithIgnoreFile(filepath.Join(root, "Other")); err != nil || f != rootFilter {
+		t.Errorf("WithIgnoreFile for a directory without an ignore file = %p, %v; want %p", f, err, rootFilter)
+	}
+
+	writeTestFile(t, root, "Bad/"+ignoreFileName, "ok.mp3\n[bad\n")
+	if _, err := rootFilter.WithIgnoreFile(filepath.Join(root, "Bad")); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("WithIgnoreFile error = %v, want an error for line 2", err)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// stringsFlag is a flag.Value collecting the values of a flag which may be given more than once.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// newStringsFlag defines a flag, which may be given more than once, with the given name and usage.
+func newStringsFlag(name, usage string) *stringsFlag {
+	f := &stringsFlag{}
+	flag.Var(f, name, usage)
+	return f
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// validatePathGlob returns an error if the given pattern (see matchPathGlob) is malformed.
+func validatePathGlob(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchPathGlob reports whether the given slash-separated path, relative to a library root, matches
+// the given glob pattern. Matching is case-insensitive, and works segment by segment using path.Match
+// syntax; a "**" segment matches any number of segments. Like in a .gitignore file, a pattern without
+// a slash matches at any depth, while a pattern starting with a slash is anchored at the root. A pattern
+// matching a directory matches everything inside it, too.
+func matchPathGlob(pattern, relPath string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "/"))
+	if strings.HasPrefix(pattern, "/") {
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else if !strings.Contains(pattern, "/") {
+		pattern = "**/" + pattern
+	}
+	return matchPathSegments(strings.Split(pattern, "/"), strings.Split(strings.ToLower(relPath), "/"))
+}
+
+func matchPathSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchPathSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+		return false
+	}
+	return matchPathSegments(pattern[1:], segments[1:])
+}
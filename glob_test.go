@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		relPath string
+		want    bool
+	}{
+		{"Audiobooks", "Audiobooks", true},
+		{"Audiobooks", "Audiobooks/Book/01.mp3", true},
+		{"Audiobooks", "Music/Audiobooks/01.mp3", true},
+		{"audiobooks", "Music/AUDIOBOOKS/01.mp3", true},
+		{"Audiobooks", "Audiobooks 2/01.mp3", false},
+		{"Audiobooks/", "Audiobooks/01.mp3", true},
+		{"/Audiobooks", "Audiobooks/01.mp3", true},
+		{"/Audiobooks", "Music/Audiobooks/01.mp3", false},
+		{"Audiobooks/**", "Audiobooks/Book/01.mp3", true},
+		{"*.m4b", "a/b/c.m4b", true},
+		{"*.m4b", "a/b/c.m4a", false},
+		{"Music/*/Live", "Music/Band/Live/01.mp3", true},
+		{"Music/*/Live", "Music/Band/Album/Live/01.mp3", false},
+		{"Music/*/Live", "Other/Music/Band/Live/01.mp3", false},
+		{"Music/**/Live", "Music/Live/01.mp3", true},
+		{"Music/**/Live", "Music/Band/Album/Live/01.mp3", true},
+		{"Music/**/*.flac", "Music/Band/01.flac", true},
+		{"Music/**/*.flac", "Music/Band/01.mp3", false},
+		{"Band/Album", "Band/Album/01.mp3", true},
+		{"Band/Album", "Music/Band/Album/01.mp3", false},
+		{"[ab]*", "b/01.mp3", true},
+		{"[ab]*", "c/01.mp3", false},
+		{"Voice Memos", "Voice Memos", true},
+	}
+	for _, tt := range tests {
+		if got := matchPathGlob(tt.pattern, tt.relPath); got != tt.want {
+			t.Errorf("matchPathGlob(%q, %q) = %v, want %v", tt.pattern, tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePathGlob(t *testing.T) {
+	for _, pattern := range []string{"Audiobooks", "/Music/**/*.flac", "[ab]*/Live", `\*`} {
+		if err := validatePathGlob(pattern); err != nil {
+			t.Errorf("validatePathGlob(%q) failed: %s", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"[ab", "Music/[/Live", `Music\`} {
+		if err := validatePathGlob(pattern); err == nil {
+			t.Errorf("validatePathGlob(%q) succeeded, want an error", pattern)
+		}
+	}
+}
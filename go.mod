@@ -6,6 +6,7 @@ require (
 	github.com/Bios-Marcel/wastebasket v0.0.0-20190304193457-ba788b19da79
 	github.com/briandowns/spinner v1.12.0
 	github.com/mattn/go-isatty v0.0.12 // indirect
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
 	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
 )
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"msync/cli"
+	"msync/dzutil"
+)
+
+const (
+	// linkModeCopy copies music files which aren't transcoded into the destination.
+	linkModeCopy = "copy"
+	// linkModeSymlink makes symlinks, in the destination, to music files which aren't transcoded.
+	linkModeSymlink = "symlink"
+	// linkModeHardlink hardlinks music files which aren't transcoded into the destination.
+	linkModeHardlink = "hardlink"
+	// linkModeReflink makes copy-on-write clones (on filesystems supporting them) of music files which aren't transcoded.
+	linkModeReflink = "reflink"
+	// linkModeAuto tries linkModeReflink, then linkModeHardlink, then falls back to linkModeCopy.
+	linkModeAuto = "auto"
+)
+
+// validateLinkMode returns an error if the given string isn't one of the linkMode* constants.
+func validateLinkMode(mode string) error {
+	switch mode {
+	case linkModeCopy, linkModeSymlink, linkModeHardlink, linkModeReflink, linkModeAuto:
+		return nil
+	}
+	return fmt.Errorf("-link-mode must be one of: %s, %s, %s, %s, %s", linkModeCopy, linkModeSymlink, linkModeHardlink, linkModeReflink, linkModeAuto)
+}
+
+// fileLinker places music files which aren't transcoded into a destination, as chosen by -link-mode.
+// When hardlinks or reflinks turn out not to be possible (eg. because the source and destination are on
+// different filesystems), it falls back to copying files.
+type fileLinker struct {
+	mode        string // one of the linkMode* constants
+	copyOptions dzutil.CopyOptions
+	tryReflink  bool
+	tryLink     bool
+}
+
+// newFileLinker returns a fileLinker for the given -link-mode, from the source library at sourceRootPath
+// to the destination at destRootPath. copyOptions applies to copied and reflinked files; hardlinks share
+// their source file's mode, modification time, and extended attributes.
+func newFileLinker(ctx context.Context, mode, sourceRootPath, destRootPath string, copyOptions dzutil.CopyOptions) (*fileLinker, error) {
+	l := &fileLinker{
+		mode:        mode,
+		copyOptions: copyOptions,
+		tryReflink:  mode == linkModeReflink || mode == linkModeAuto,
+		tryLink:     mode == linkModeHardlink || mode == linkModeAuto,
+	}
+	if l.tryReflink || l.tryLink {
+		sameFS, err := dzutil.SameFilesystem(sourceRootPath, destRootPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check whether source and destination are on the same filesystem: %w", err)
+		}
+		if !sameFS {
+			l.tryReflink, l.tryLink = false, false
+			l.fallingBack(ctx, "the source and destination are on different filesystems")
+		}
+	}
+	return l, nil
+}
+
+// Describe returns a past-tense description of what's done with each file, for log messages.
+func (l *fileLinker) Describe() string {
+	switch {
+	case l.mode == linkModeSymlink:
+		return "symlinked"
+	case l.tryReflink && l.tryLink:
+		return "reflinked (or hardlinked, or copied, where that's not possible)"
+	case l.tryReflink:
+		return "reflinked"
+	case l.tryLink:
+		return "hardlinked"
+	}
+	return "copied"
+}
+
+// Link places the file at sourcePath into the destination at destPath, which must not exist, and returns the
+// operation used to do so (one of the syncOp* constants).
+func (l *fileLinker) Link(ctx context.Context, sourcePath, destPath string) (string, error) {
+	if l.mode == linkModeSymlink {
+		cli.Out(ctx).Verbose(fmt.Sprintf("Symlinking '%s' to '%s'", destPath, sourcePath))
+		if err := os.Symlink(sourcePath, destPath); err != nil {
+			return "", fmt.Errorf("failed to symlink '%s' to '%s': %w", destPath, sourcePath, err)
+		}
+		return syncOpSymlink, nil
+	}
+	if l.tryReflink {
+		cli.Out(ctx).Verbose(fmt.Sprintf("Reflinking '%s' to '%s'", sourcePath, destPath))
+		err := dzutil.Reflink(sourcePath, destPath, l.copyOptions)
+		if err == nil {
+			return syncOpReflink, nil
+		}
+		if !errors.Is(err, dzutil.ErrReflinkUnsupported) {
+			return "", fmt.Errorf("failed to reflink '%s' to '%s': %w", sourcePath, destPath, err)
+		}
+		l.tryReflink = false
+		if l.mode == linkModeReflink {
+			l.fallingBack(ctx, err.Error())
+		}
+	}
+	if l.tryLink {
+		cli.Out(ctx).Verbose(fmt.Sprintf("Hardlinking '%s' to '%s'", sourcePath, destPath))
+		err := os.Link(sourcePath, destPath)
+		if err == nil {
+			return syncOpHardlink, nil
+		}
+		if errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("failed to hardlink '%s' to '%s': %w", sourcePath, destPath, err)
+		}
+		if dzutil.IsLinkUnsupported(err) {
+			l.tryLink = false
+			l.fallingBack(ctx, err.Error())
+		} else {
+			// eg. the file already has as many links as the filesystem allows, or (with Linux's
+			// fs.protected_hardlinks) isn't owned by the current user. other files can still be hardlinked:
+			cli.Out(ctx).Verbose(fmt.Sprintf("Could not hardlink '%s' (%s); copying it instead.", sourcePath, err))
+		}
+	}
+	cli.Out(ctx).Verbose(fmt.Sprintf("Copying '%s' to '%s'", sourcePath, destPath))
+	if err := dzutil.CopyFileWithOptions(sourcePath, destPath, l.copyOptions); err != nil {
+		return "", fmt.Errorf("failed to copy '%s' to '%s': %w", sourcePath, destPath, err)
+	}
+	return syncOpCopy, nil
+}
+
+// fallingBack logs that files will be copied, rather than linked as the -link-mode asked, for the given reason.
+// With -link-mode auto, which expects this, it's only logged in verbose mode.
+func (l *fileLinker) fallingBack(ctx context.Context, reason string) {
+	msg := fmt.Sprintf("Files can't be %sed into the destination (%s); they will be copied instead.", l.mode, reason)
+	if l.mode == linkModeAuto {
+		msg = fmt.Sprintf("Files can't be linked into the destination (%s); they will be copied instead.", reason)
+		cli.Out(ctx).Verbose(msg)
+		return
+	}
+	cli.Out(ctx).Warning(msg)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"msync/dzutil"
+)
+
+const (
+	// loudnessOff disables loudness normalization.
+	loudnessOff = "off"
+	// loudnessTrack normalizes each track's loudness independently.
+	loudnessTrack = "track"
+	// loudnessAlbum normalizes each album (ie. each directory of music files) as a whole, preserving
+	// the relative loudness of its tracks.
+	loudnessAlbum = "album"
+
+	// defaultLoudnessTarget is the loudness, in LUFS, that ReplayGain 2.0 normalizes to.
+	defaultLoudnessTarget = -18.0
+	// r128Reference is the loudness, in LUFS, that Opus' R128_*_GAIN tags are relative to (see RFC 7845).
+	r128Reference = -23.0
+)
+
+var (
+	ebur128IntegratedRegex = regexp.MustCompile(`I:\s+(-?[\d.]+|-inf) LUFS`)
+	ebur128PeakRegex       = regexp.MustCompile(`Peak:\s+(-?[\d.]+|-inf) dBFS`)
+)
+
+// loudness is the result of an EBU R128 analysis of a music file.
+type loudness struct {
+	Integrated float64 // integrated loudness, in LUFS
+	Peak       float64 // true peak, as a linear sample value (1.0 is full scale)
+}
+
+// replayGain describes the gain to apply to a music file to normalize its loudness.
+type replayGain struct {
+	TrackGain float64 // in dB
+	TrackPeak float64 // linear
+	AlbumGain float64 // in dB; only meaningful if HasAlbum
+	AlbumPeak float64 // linear; only meaningful if HasAlbum
+	HasAlbum  bool
+}
+
+// Gain returns the gain to apply (in album mode, the album gain; otherwise the track gain).
+func (g replayGain) Gain() float64 {
+	if g.HasAlbum {
+		return g.AlbumGain
+	}
+	return g.TrackGain
+}
+
+// Peak returns the peak corresponding to Gain.
+func (g replayGain) Peak() float64 {
+	if g.HasAlbum {
+		return g.AlbumPeak
+	}
+	return g.TrackPeak
+}
+
+// ClippingSafeGain returns Gain, reduced if necessary so that applying it doesn't push Peak above full scale.
+func (g replayGain) ClippingSafeGain() float64 {
+	gain := g.Gain()
+	if peak := g.Peak(); peak > 0 {
+		if maxGain := -20 * math.Log10(peak); gain > maxGain {
+			gain = maxGain
+		}
+	}
+	return gain
+}
+
+// analyzeLoudness runs an EBU R128 analysis of the given file using ffmpeg's ebur128 filter.
+// ffmpeg is killed if it runs for longer than timeout (unless it's 0).
+func analyzeLoudness(ctx context.Context, timeout time.Duration, path string) (*loudness, error) {
+	// ffmpeg logs the analysis to stderr:
+	_, out, err := dzutil.Exec(ctx, timeout, "ffmpeg", []string{"-nostats", "-hide_banner", "-i", path, "-vn", "-af", "ebur128=peak=true:framelog=verbose", "-f", "null", "-"})
+	if err != nil {
+		return nil, fmt.Errorf("could not run ffmpeg to analyze loudness of '%s': %w", path, err)
+	}
+	// the summary, printed last, is the only thing we care about:
+	integratedMatches := ebur128IntegratedRegex.FindAllStringSubmatch(out, -1)
+	peakMatches := ebur128PeakRegex.FindAllStringSubmatch(out, -1)
+	if len(integratedMatches) == 0 || len(peakMatches) == 0 {
+		return nil, fmt.Errorf("failed to parse loudness analysis from ffmpeg for '%s'", path)
+	}
+	integrated, err := parseDecibels(integratedMatches[len(integratedMatches)-1][1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse loudness '%s' from ffmpeg for '%s'", integratedMatches[len(integratedMatches)-1][1], path)
+	}
+	peakDB, err := parseDecibels(peakMatches[len(peakMatches)-1][1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peak '%s' from ffmpeg for '%s'", peakMatches[len(peakMatches)-1][1], path)
+	}
+	return &loudness{
+		Integrated: integrated,
+		Peak:       math.Pow(10, peakDB/20),
+	}, nil
+}
+
+func parseDecibels(s string) (float64, error) {
+	if s == "-inf" {
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// loudnessResult memoizes the analysis of a single file, so concurrent transcodes of tracks from the
+// same album don't analyze the album's files more than once.
+type loudnessResult struct {
+	once     sync.Once
+	loudness *loudness
+	err      error
+}
+
+// LoudnessAnalyzer computes ReplayGain values for music files, in track or album mode.
+// It's safe for concurrent use.
+type LoudnessAnalyzer struct {
+	mode    string
+	target  float64
+	timeout time.Duration // see analyzeLoudness
+	lock    sync.Mutex
+	results map[string]*loudnessResult
+}
+
+// NewLoudnessAnalyzer returns a LoudnessAnalyzer normalizing to the given target loudness, in LUFS.
+// The analysis of each file is abandoned if it takes longer than timeout (unless it's 0).
+func NewLoudnessAnalyzer(mode string, target float64, timeout time.Duration) *LoudnessAnalyzer {
+	return &LoudnessAnalyzer{
+		mode:    mode,
+		target:  target,
+		timeout: timeout,
+		results: make(map[string]*loudnessResult),
+	}
+}
+
+func (a *LoudnessAnalyzer) analyze(ctx context.Context, n *MusicTreeNode) (*loudness, error) {
+	a.lock.Lock()
+	result, ok := a.results[n.FilesystemPath]
+	if !ok {
+		result = &loudnessResult{}
+		a.results[n.FilesystemPath] = result
+	}
+	a.lock.Unlock()
+	result.once.Do(func() {
+		result.loudness, result.err = analyzeLoudness(ctx, a.timeout, n.FilesystemPath)
+	})
+	return result.loudness, result.err
+}
+
+// Gain analyzes the given source music file and returns its ReplayGain values. In album mode, album
+// must contain all the tracks of the source file's album (including the source file itself); their
+// album loudness is approximated by the duration-weighted energy average of their track loudnesses.
+func (a *LoudnessAnalyzer) Gain(ctx context.Context, source *MusicTreeNode, album []*MusicTreeNode) (*replayGain, error) {
+	track, err := a.analyze(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	gain := &replayGain{
+		TrackGain: a.gainFor(track.Integrated),
+		TrackPeak: track.Peak,
+	}
+	if a.mode != loudnessAlbum || len(album) == 0 {
+		return gain, nil
+	}
+
+	var energy, totalDuration float64
+	for _, n := range album {
+		l, err := a.analyze(ctx, n)
+		if err != nil {
+			return nil, err
+		}
+		if l.Peak > gain.AlbumPeak {
+			gain.AlbumPeak = l.Peak
+		}
+		if math.IsInf(l.Integrated, -1) || n.FileBitrate <= 0 {
+			continue // silence doesn't contribute to the album's loudness
+		}
+		duration := float64(n.FileSize*8) / float64(n.FileBitrate)
+		energy += duration * math.Pow(10, l.Integrated/10)
+		totalDuration += duration
+	}
+	if totalDuration > 0 {
+		gain.AlbumGain = a.gainFor(10 * math.Log10(energy/totalDuration))
+	} else {
+		gain.AlbumGain = gain.TrackGain
+	}
+	gain.HasAlbum = true
+	return gain, nil
+}
+
+func (a *LoudnessAnalyzer) gainFor(integrated float64) float64 {
+	if math.IsInf(integrated, -1) {
+		return 0 // don't try to normalize silence
+	}
+	return a.target - integrated
+}
+
+// albumTracks returns the music files of the album (ie. the directory) containing the given source music
+// file, in the given source tree.
+func albumTracks(sourceTree *MusicTreeNode, source *MusicTreeNode) []*MusicTreeNode {
+	if albumNode := sourceTree.NodeAtTreePath(source.TreePath[:len(source.TreePath)-1]); albumNode != nil {
+		return albumNode.MusicFiles()
+	}
+	return []*MusicTreeNode{source}
+}
+
+// albumDigest returns a digest of the paths, sizes, and modification times of the given album's tracks.
+// An album's gain can only change if its digest does; eg. when a track is added to or removed from it.
+func albumDigest(album []*MusicTreeNode) string {
+	h := sha256.New()
+	for _, n := range album {
+		fmt.Fprintf(h, "%s\x00%d\x00%d\n", strings.Join(n.TreePath, "/"), n.FileSize, n.ModTime.UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replayGainTags returns the metadata tags describing the given gain, for a file with the given extension.
+// The given gain normalizes to target, in LUFS.
+func replayGainTags(g *replayGain, target float64, ext string) map[string]string {
+	tags := map[string]string{
+		"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", g.TrackGain),
+		"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", g.TrackPeak),
+	}
+	if g.HasAlbum {
+		tags["REPLAYGAIN_ALBUM_GAIN"] = fmt.Sprintf("%.2f dB", g.AlbumGain)
+		tags["REPLAYGAIN_ALBUM_PEAK"] = fmt.Sprintf("%.6f", g.AlbumPeak)
+	}
+	switch ext {
+	case ".opus":
+		// Opus players use R128 gains instead (Q7.8 fixed point, relative to the EBU R128 reference level):
+		r128Offset := target - r128Reference
+		tags["R128_TRACK_GAIN"] = strconv.Itoa(int(math.Round((g.TrackGain - r128Offset) * 256)))
+		if g.HasAlbum {
+			tags["R128_ALBUM_GAIN"] = strconv.Itoa(int(math.Round((g.AlbumGain - r128Offset) * 256)))
+		}
+	case ".m4a":
+		// iTunes and Apple devices only understand iTunNORM:
+		tags["iTunNORM"] = iTunNORM(g.Gain(), g.Peak())
+	}
+	return tags
+}
+
+// iTunNORM formats the given gain (in dB) and peak (linear) as an iTunNORM tag value.
+func iTunNORM(gain, peak float64) string {
+	clamp := func(v float64) int64 {
+		if v > 65534 {
+			return 65534
+		}
+		return int64(math.Round(v))
+	}
+	// fields are the gain at 1/1000 W and 1/2500 W references, for the left and right channels, followed
+	// by values iTunes uses internally but ignores when reading, and the peak sample values:
+	g1000 := clamp(1000 * math.Pow(10, -gain/10))
+	g2500 := clamp(2500 * math.Pow(10, -gain/10))
+	p := int64(math.Min(peak, 1) * 32767)
+	return fmt.Sprintf(" %08X %08X %08X %08X %08X %08X %08X %08X %08X %08X", g1000, g1000, g2500, g2500, 0x00024CA8, 0x00024CA8, p, p, 0x00024CA8, 0x00024CA8)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestReplayGainClippingSafeGain(t *testing.T) {
+	tests := []struct {
+		name string
+		gain replayGain
+		want float64
+	}{
+		{"track", replayGain{TrackGain: -3, TrackPeak: 0.9}, -3},
+		{"track, clipping", replayGain{TrackGain: 10, TrackPeak: 0.5}, -20 * math.Log10(0.5)},
+		{"track, no peak", replayGain{TrackGain: 10}, 10},
+		{"album", replayGain{TrackGain: 10, TrackPeak: 0.5, AlbumGain: 2, AlbumPeak: 0.5, HasAlbum: true}, 2},
+		{"album, clipping", replayGain{TrackGain: 2, TrackPeak: 0.5, AlbumGain: 10, AlbumPeak: 0.5, HasAlbum: true}, -20 * math.Log10(0.5)},
+	}
+	for _, tt := range tests {
+		if got := tt.gain.ClippingSafeGain(); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: ClippingSafeGain = %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReplayGainTags(t *testing.T) {
+	track := &replayGain{TrackGain: -3, TrackPeak: 0.5}
+	album := &replayGain{TrackGain: -3, TrackPeak: 0.5, AlbumGain: -4.5, AlbumPeak: 1, HasAlbum: true}
+
+	tests := []struct {
+		name string
+		gain *replayGain
+		ext  string
+		want map[string]string
+	}{
+		{"mp3 track", track, ".mp3", map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "-3.00 dB",
+			"REPLAYGAIN_TRACK_PEAK": "0.500000",
+		}},
+		{"flac album", album, ".flac", map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "-3.00 dB",
+			"REPLAYGAIN_TRACK_PEAK": "0.500000",
+			"REPLAYGAIN_ALBUM_GAIN": "-4.50 dB",
+			"REPLAYGAIN_ALBUM_PEAK": "1.000000",
+		}},
+		{"opus album", album, ".opus", map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "-3.00 dB",
+			"REPLAYGAIN_TRACK_PEAK": "0.500000",
+			"REPLAYGAIN_ALBUM_GAIN": "-4.50 dB",
+			"REPLAYGAIN_ALBUM_PEAK": "1.000000",
+			"R128_TRACK_GAIN":       "-2048",
+			"R128_ALBUM_GAIN":       "-2432",
+		}},
+		{"m4a track", &replayGain{TrackPeak: 1}, ".m4a", map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "0.00 dB",
+			"REPLAYGAIN_TRACK_PEAK": "1.000000",
+			"iTunNORM":              " 000003E8 000003E8 000009C4 000009C4 00024CA8 00024CA8 00007FFF 00007FFF 00024CA8 00024CA8",
+		}},
+	}
+	for _, tt := range tests {
+		if got := replayGainTags(tt.gain, defaultLoudnessTarget, tt.ext); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: replayGainTags = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
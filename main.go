@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"os"
 	"os/signal"
 	"path/filepath"
@@ -16,7 +15,9 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
+	"msync/audioinfo"
 	"msync/cli"
 	"msync/dzutil"
 	"msync/filesize"
@@ -28,6 +29,7 @@ var version = "undefined (dev?)"
 
 func usage() {
 	fmt.Printf("Usage: %s -from /musicsource -to /musicdest [OPTIONS]\n", filepath.Base(os.Args[0]))
+	fmt.Printf("       %s failures [-clear] [SOURCE_FILE ...]\n", filepath.Base(os.Args[0]))
 	fmt.Printf("Sync a music library from a source to dest, re-encoding files with bitrates over -max-kbps and copying or making symlinks for other files.\n")
 	fmt.Printf("Symbolic links in both the source and destination directories are followed.\n\n")
 	fmt.Printf("Options:\n")
@@ -38,19 +40,65 @@ func usage() {
 }
 
 var (
+	channelsFlag                 = flag.String("channels", channelsKeep, "Channel layout of transcoded files: keep, stereo (downmix files with more than two channels), or mono. Files with more channels than this are transcoded.")
+	channelsForFlag              = newStringsFlag("channels-for", "Sets the -channels layout for source files matching a path glob, given as PATTERN=LAYOUT (eg. 'Audiobooks/**=mono'). May be given more than once; later rules take precedence.")
+	codecFlag                    = flag.String("codec", "aac", "ffmpeg audio encoder used for transcoding. One of: aac (.m4a), libmp3lame (.mp3), libopus (.opus), libvorbis (.ogg); or, for lossless destinations, alac (.m4a), flac (.flac).")
+	coverArtFlag                 = flag.String("cover-art", coverArtKeep, "How embedded cover art is handled when transcoding: keep, resize (to -cover-art-max-size), strip, or extract (strip it, and save it once per album as cover.jpg in the destination).")
+	coverArtMaxSizeFlag          = flag.Int("cover-art-max-size", 600, "With -cover-art resize or extract, the maximum width and height, in pixels, of cover art. 0 means no limit (extract only).")
+	coverArtQualityFlag          = flag.Int("cover-art-quality", 3, "With -cover-art resize or extract, the JPEG quality of cover art, on ffmpeg's scale from 2 (best) to 31 (worst).")
+	destinationsFlag             = flag.String("destinations", "", "Path to a JSON file listing destination directories, each with its own encoding settings. The source is scanned once for all of them, and identical transcodes are shared. May be used instead of, or along with, -to.")
 	dryRunFlag                   = flag.Bool("dry-run", false, "If true, do not modify anything on the filesystem.")
+	excludeFlag                  = newStringsFlag("exclude", "Leave source files and directories matching this path glob out of the destination (eg. 'Podcasts'). May be given more than once. Source directories may also contain "+ignoreFileName+" files, listing patterns like a .gitignore file.")
+	failureReportFlag            = flag.String("failure-report", "", "With -keep-going, write the report of files which failed to sync to this file.")
 	fileCreateModeFlag           = flag.String("file-mode", "0644", "Octal value specifying mode for copied music files. Must begin with '0' or '0o'.")
 	fromFlag                     = flag.String("from", "", "Source directory with music library. (Required)")
-	makeSymlinksFlag             = flag.Bool("symlink", false, "If set, make symlinks from the destination to the source for music files below the maximum bitrate. (If not set, make a proper copy of the file.)")
+	hashSourcesFlag              = flag.Bool("hash-sources", false, "If set, record a SHA-256 hash of each source file in the destination's sync state. Source files whose modification time changes but whose content doesn't will then not be re-synced.")
+	includeFlag                  = newStringsFlag("include", "If given, only mirror source files matching this path glob (eg. 'Jazz/**' or '*.flac'). May be given more than once.")
+	keepGoingFlag                = flag.Bool("keep-going", false, "If set, files which fail to sync (eg. because they can't be read or transcoded) are skipped, rather than stopping the sync, and reported at the end of the run. msync then exits with status 3.")
+	linkModeFlag                 = flag.String("link-mode", linkModeCopy, "How music files which aren't transcoded are placed in the destination: copy, symlink, hardlink, reflink (copy-on-write clone; Linux btrfs/XFS only), or auto (reflink if possible, else hardlink if possible, else copy). Hardlinks and reflinks require the source and destination to be on the same filesystem; otherwise files are copied.")
+	loudnessFlag                 = flag.String("loudness", loudnessOff, "Loudness normalization for transcoded files, based on EBU R128 analysis: off, track, or album (which treats each directory as an album).")
+	loudnessApplyFlag            = flag.Bool("loudness-apply", false, "If set, apply the -loudness normalization gain to transcoded audio directly. Otherwise, it's written as ReplayGain (and iTunNORM or R128) tags.")
+	loudnessTargetFlag           = flag.Float64("loudness-target", defaultLoudnessTarget, "Target loudness, in LUFS, for -loudness.")
+	makeSymlinksFlag             = flag.Bool("symlink", false, "If set, make symlinks from the destination to the source for music files below the maximum bitrate. Same as -link-mode symlink.")
+	maxBitDepthFlag              = flag.Int("max-bit-depth", 0, "With a lossless -codec, the highest bit depth (16 or 24) for lossless files in the destination. Deeper files are transcoded, with dithering. 0 means no limit.")
 	maxBitrateKbpsFlag           = flag.Int("max-kbps", 192, "Maximum bitrate, in Kbps, for destination music library.")
+	maxRetranscodesFlag          = flag.Int("max-retranscodes", -1, "Maximum number of destination files, transcoded with outdated encoder settings, to remove and transcode again per run. -1 means no limit; 0 disables re-transcoding.")
+	maxSampleRateFlag            = flag.Int("max-sample-rate", 0, "Highest sample rate, in Hz, for transcoded files (eg. 44100). With a lossless -codec, lossless files with higher sample rates are transcoded. 0 means no limit.")
+	maxSizeFlag                  = flag.String("max-size", "", "If set, the maximum size of the destination music library (eg. 60GB or 55GiB). Albums (ie. directories of music files) which don't fit are left out, in the order given by -max-size-priority.")
+	maxSizeMinKbpsFlag           = flag.Int("max-size-min-kbps", 0, "With -max-size, lower -max-kbps as far as this bitrate, in steps, until the whole library fits. 0 means -max-kbps is never lowered.")
+	maxSizePriorityFlag          = flag.String("max-size-priority", sizePriorityRecent, "With -max-size, which albums are kept first: recent (most recently modified), path (in path order), or rating (highest average rating tag).")
+	musicExtsFlag                = flag.String("music-exts", defaultMusicExts, "Comma-separated list of extensions of files treated as music files. Extensions of transcoding outputs (see -codec) are always included.")
+	preserveMtimeFlag            = flag.Bool("preserve-mtime", false, "If set, music files copied (or reflinked) to the destination get their source file's modification time.")
+	preserveXattrsFlag           = flag.Bool("preserve-xattrs", false, "If set, music files copied (or reflinked) to the destination get their source file's extended attributes (eg. macOS Finder tags), where the destination filesystem supports them. Linux and macOS only.")
 	printVersion                 = flag.Bool("version", false, "Print version and exit.")
+	probeCacheFlag               = flag.String("probe-cache", DefaultProbeCachePath(), "Path to a file caching music files' probed bitrates and tags between runs. Set to an empty string to disable the cache.")
+	probeTimeoutFlag             = flag.Duration("probe-timeout", time.Minute, "Maximum time afinfo or ffprobe may spend probing a single music file (eg. 30s or 2m) before it's killed. 0 means no limit.")
+	proberFlag                   = flag.String("prober", defaultProberSpec, "Comma-separated list of backends used to determine music files' bitrates, tried in order. Backends: native (built-in header parser), afinfo (macOS only), ffprobe.")
+	protectFlag                  = newStringsFlag("protect", "Never remove destination files or directories matching this path glob, relative to the destination (eg. 'Playlists'). May be given more than once.")
+	qualityFlag                  = flag.String("quality", "", "If set, transcode using the encoder's quality-based VBR mode at this quality level, instead of at -max-kbps. The scale depends on -codec: libmp3lame 0-9 (eg. 2 for LAME -V2; lower is better), libvorbis -1-10, aac 0.1-2. Not supported for libopus, which is always VBR.")
+	quarantineFlag               = flag.String("quarantine", DefaultQuarantinePath(), "Path to a file recording music files which failed to transcode, so that those which fail repeatedly are skipped until they change (see -quarantine-after, and the failures command). Set to an empty string to disable.")
+	quarantineAfterFlag          = flag.Int("quarantine-after", defaultQuarantineAfter, "Number of runs in which a music file must fail to transcode before it's skipped, until it changes. 0 disables the quarantine.")
+	rebuildCacheFlag             = flag.Bool("rebuild-cache", false, "If set, discard the contents of the probe cache and re-probe every music file.")
 	removeOtherFilesFromDestFlag = flag.Bool("remove-nonmusic-from-dest", false, "If set, remove any non-music files from the destination.")
-	toFlag                       = flag.String("to", "", "Destination directory for mirrored/re-encoded music library. (Required)")
+	rulesFlag                    = flag.String("rules", "", "Path to a JSON file of rules selecting encoding settings, or a copy/skip action, for source files by path and/or tags. The first matching rule applies to each file.")
+	toFlag                       = flag.String("to", "", "Destination directory for mirrored/re-encoded music library. (Required, unless -destinations is given)")
+	transcodePolicyFlag          = flag.String("transcode-policy", policyBitrate, "Which music files are transcoded: bitrate (files over -max-kbps), lossless (all lossless files, plus lossy files over -max-kbps), lossless-only (all lossless files; lossy files are only re-encoded to meet -channels), or copy (nothing).")
+	transcodeTimeoutFlag         = flag.Duration("transcode-timeout", time.Hour, "Maximum time ffmpeg may spend transcoding a single music file (eg. 30m or 2h) before it's killed. Also applies to loudness analysis and cover art extraction. 0 means no limit.")
+	vbrMaxBitrateKbpsFlag        = flag.Int("vbr-max-kbps", 0, "With -quality, the highest bitrate, in Kbps, accepted for music files in the destination. Defaults to 1.5x -max-kbps.")
 	verboseFlag                  = flag.Bool("verbose", false, "Log detailed output to stderr. Suppresses progress indicators.")
+	verifyCopiesFlag             = flag.Bool("verify-copies", false, "If set, read back each music file copied to the destination, and check that its SHA-256 hash matches the source's, before moving it into place.")
 	askTrashPermissionFlag       = flag.Bool("ask-trash-permission", false, "Try to remove a temporary file to the Trash before starting the sync process. This will cause macOS to display the requisite automation permission dialog immediately.")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "failures" {
+		if err := failuresMain(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	flag.Usage = usage
 	flag.Parse()
 
@@ -59,12 +107,20 @@ func main() {
 		os.Exit(0)
 	}
 
-	if *fromFlag == "" || *toFlag == "" {
+	if *fromFlag == "" || (*toFlag == "" && *destinationsFlag == "") {
 		flag.Usage()
 		os.Exit(1)
 	}
 
 	if err := msyncMain(); err != nil {
+		if errors.Is(err, errInterrupted) {
+			cli.ShowTerminalCursor()
+			os.Exit(exitCodeInterrupted)
+		}
+		if errors.Is(err, errPartialSuccess) {
+			cli.ShowTerminalCursor()
+			os.Exit(exitCodePartialSuccess)
+		}
 		if *verboseFlag && cli.EchoLogsToStdErr() {
 			log.Println(err.Error())
 		}
@@ -74,9 +130,16 @@ func main() {
 	}
 }
 
+// exitCodeInterrupted is msync's exit status when it's stopped early by SIGINT, SIGTERM, or SIGQUIT.
+const exitCodeInterrupted = 130
+
+// errInterrupted is returned by msyncMain when it's stopped early by a signal.
+var errInterrupted = errors.New("interrupted")
+
 type transcodeOp struct {
-	source *MusicTreeNode
-	dest   *MusicTreeNode
+	source  *MusicTreeNode
+	dest    *MusicTreeNode
+	profile EncodingProfile
 }
 
 func msyncMain() error {
@@ -86,6 +149,43 @@ func msyncMain() error {
 	}
 	fileCreateMode := os.FileMode(mode)
 
+	profile := EncodingProfile{
+		Policy:      *transcodePolicyFlag,
+		Codec:       *codecFlag,
+		BitrateKbps: *maxBitrateKbpsFlag,
+		Quality:     *qualityFlag,
+		VBRMaxKbps:  *vbrMaxBitrateKbpsFlag,
+
+		MaxSampleRate: *maxSampleRateFlag,
+		MaxBitDepth:   *maxBitDepthFlag,
+
+		Loudness:       *loudnessFlag,
+		LoudnessApply:  *loudnessApplyFlag,
+		LoudnessTarget: *loudnessTargetFlag,
+
+		CoverArt:        *coverArtFlag,
+		CoverArtMaxSize: *coverArtMaxSizeFlag,
+		CoverArtQuality: *coverArtQualityFlag,
+
+		Channels: *channelsFlag,
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	if err := SetMusicExts(*musicExtsFlag); err != nil {
+		return err
+	}
+	if err := SetProtectPatterns(*protectFlag); err != nil {
+		return err
+	}
+
+	var failures *FailureReport
+	if *keepGoingFlag {
+		failures = &FailureReport{}
+	} else if *failureReportFlag != "" {
+		return errors.New("-failure-report requires -keep-going")
+	}
+
 	if *askTrashPermissionFlag {
 		file, err := ioutil.TempFile("/tmp", "msync")
 		if err != nil {
@@ -97,17 +197,105 @@ func msyncMain() error {
 		}
 	}
 
+	prober, err := NewAudioProber(*proberFlag, *probeTimeoutFlag)
+	if err != nil {
+		return err
+	}
+	var probeCache *ProbeCache
+	readTags := TagReader(audioinfo.ReadTags)
+	if *probeCacheFlag != "" {
+		probeCache, err = LoadProbeCache(*probeCacheFlag, prober.Name(), *rebuildCacheFlag)
+		if err != nil {
+			return err
+		}
+		prober = NewCachingProber(prober, probeCache)
+		readTags = probeCache.ReadTags
+	}
+
+	var quarantine *Quarantine
+	if *quarantineFlag != "" && *quarantineAfterFlag > 0 {
+		quarantine, err = LoadQuarantine(*quarantineFlag, *quarantineAfterFlag)
+		if err != nil {
+			return err
+		}
+	}
+
 	sourceRootPath, err := filepath.Abs(*fromFlag)
 	if err != nil {
 		return err
 	}
-	destRootPath, err := filepath.Abs(*toFlag)
+
+	var rules []*Rule
+	if *rulesFlag != "" {
+		rules, err = LoadRules(*rulesFlag, profile)
+		if err != nil {
+			return err
+		}
+	}
+	profiles, err := NewProfileSelector(profile, sourceRootPath, rules, *channelsForFlag, readTags)
 	if err != nil {
 		return err
 	}
+	sourceFilter, err := NewPathFilter(sourceRootPath, *includeFlag, *excludeFlag)
+	if err != nil {
+		return err
+	}
+	var sizeBudget *SizeBudget
+	if *maxSizeFlag != "" {
+		maxSize, err := filesize.Parse(*maxSizeFlag)
+		if err != nil {
+			return fmt.Errorf("-max-size: %w", err)
+		}
+		sizeBudget = &SizeBudget{
+			MaxSize:  maxSize,
+			Priority: *maxSizePriorityFlag,
+			MinKbps:  *maxSizeMinKbpsFlag,
+		}
+		if err := sizeBudget.Validate(profile); err != nil {
+			return err
+		}
+	}
 
-	if strings.Contains(sourceRootPath, destRootPath) || strings.Contains(destRootPath, sourceRootPath) {
-		return errors.New("source and destination paths must not overlap")
+	linkMode := *linkModeFlag
+	if *makeSymlinksFlag {
+		if linkMode != linkModeCopy && linkMode != linkModeSymlink {
+			return fmt.Errorf("-symlink cannot be used with -link-mode %s", linkMode)
+		}
+		linkMode = linkModeSymlink
+	}
+	if err := validateLinkMode(linkMode); err != nil {
+		return err
+	}
+
+	var destSpecs []*DestinationSpec
+	if *toFlag != "" {
+		destSpecs = append(destSpecs, &DestinationSpec{Path: *toFlag})
+	}
+	if *destinationsFlag != "" {
+		specs, err := LoadDestinations(*destinationsFlag)
+		if err != nil {
+			return err
+		}
+		destSpecs = append(destSpecs, specs...)
+	}
+	var destinations []*destination
+	for _, spec := range destSpecs {
+		dest, err := newDestination(spec, profiles, rules, linkMode, sizeBudget)
+		if err != nil {
+			return err
+		}
+		if pathsOverlap(sourceRootPath, dest.rootPath) {
+			return errors.New("source and destination paths must not overlap")
+		}
+		for _, other := range destinations {
+			if pathsOverlap(other.rootPath, dest.rootPath) {
+				return fmt.Errorf("destination paths must not overlap ('%s' and '%s')", other.rootPath, dest.rootPath)
+			}
+		}
+		destinations = append(destinations, dest)
+	}
+	if len(destinations) == 0 {
+		return fmt.Errorf("no destinations are listed in '%s'", *destinationsFlag)
 	}
 
 	ctx := cli.WithCLIOut(context.Background())
@@ -115,39 +303,256 @@ func msyncMain() error {
 		ctx = cli.WithVerboseOut(ctx)
 	}
 
-	quitSig := make(chan os.Signal, 1)
+	// the first signal stops the sync gracefully: work in progress is canceled (killing any ffmpeg processes)
+	// and cleaned up, and the sync state is saved. a second signal quits immediately.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	quitSig := make(chan os.Signal, 2)
 	signal.Notify(quitSig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	go func() {
 		<-quitSig
+		cancel()
+		cli.Out(ctx).Warning("Interrupted; stopping after cleaning up work in progress. Interrupt again to quit immediately.")
+		<-quitSig
+		dzutil.KillAll() // external commands run in their own process groups, so they didn't get the signal
 		cli.ShowTerminalCursor()
-		os.Exit(0)
+		os.Exit(exitCodeInterrupted)
 	}()
 
+	if probeCache != nil && !*dryRunFlag {
+		defer func() {
+			pruned, err := probeCache.Save()
+			if err != nil {
+				cli.Out(ctx).Warning(fmt.Sprintf("Failed to save probe cache: %s", err))
+			} else {
+				cli.Out(ctx).Verbose(fmt.Sprintf("Saved %d entries to probe cache (%s); pruned %d entries for files that no longer exist.", probeCache.Len(), *probeCacheFlag, pruned))
+			}
+		}()
+	}
+
+	if quarantine != nil && !*dryRunFlag {
+		defer func() {
+			if err := quarantine.Save(); err != nil {
+				cli.Out(ctx).Warning(fmt.Sprintf("Failed to save quarantine: %s", err))
+			}
+		}()
+	}
+
 	cli.Out(ctx).Log(fmt.Sprintf("Scanning source directory (%s) ...", sourceRootPath))
 	spinCtx, _, spinStop := cli.WithSpinner(ctx, "scanning")
-	sourceTree, err := MakeMusicTree(spinCtx, sourceRootPath)
+	sourceTree, err := MakeMusicTree(spinCtx, sourceRootPath, prober, true, sourceFilter, failures)
 	spinStop()
+	if ctx.Err() != nil {
+		cli.Out(ctx).Log("Interrupted while scanning the source directory; nothing was synced.")
+		return errInterrupted
+	}
 	if err != nil {
 		return err
 	}
 	cli.Out(ctx).Log(fmt.Sprintf("Source tree (%s) size is %s", sourceRootPath, filesize.ByteCountBothStyles(sourceTree.CalculateSize())))
+	if profiles.HasRules() {
+		// files matching a skip rule are treated as if they weren't in the source at all:
+		skipCount := sourceTree.Prune(func(n *MusicTreeNode) bool {
+			return n.IsMusicFile && profiles.Select(n).Skip()
+		})
+		if skipCount > 0 {
+			cli.Out(ctx).Log(fmt.Sprintf("Skipping %d music files matched by skip rules.", skipCount))
+		}
+	}
+	run := &syncRun{
+		sourceRootPath: sourceRootPath,
+		sourceTree:     sourceTree,
+		prober:         prober,
+		fileCreateMode: fileCreateMode,
+		copyOptions: dzutil.CopyOptions{
+			Mode:            fileCreateMode,
+			Verify:          *verifyCopiesFlag,
+			PreserveModTime: *preserveMtimeFlag,
+			PreserveXattrs:  *preserveXattrsFlag,
+		},
+		rules:            rules,
+		failures:         failures,
+		quarantine:       quarantine,
+		transcodeTimeout: *transcodeTimeoutFlag,
+		transcodes:       newSharedTranscodes(),
+	}
+	if profile.CoverArt == coverArtExtract {
+		run.coverArt = newCoverArtExtractor(profile, fileCreateMode, *transcodeTimeoutFlag)
+	}
+	if profile.NormalizesLoudness() {
+		run.loudness = NewLoudnessAnalyzer(profile.Loudness, profile.LoudnessTarget, *transcodeTimeoutFlag)
+	}
+	for i, dest := range destinations {
+		if len(destinations) > 1 {
+			cli.Out(ctx).Log("")
+			cli.Out(ctx).Log(fmt.Sprintf("Syncing destination %d of %d (%s) ...", i+1, len(destinations), dest.rootPath))
+		}
+		summary := &syncSummary{rootPath: dest.rootPath}
+		run.summaries = append(run.summaries, summary)
+		if err := run.syncDestination(ctx, dest, summary); err != nil {
+			if ctx.Err() != nil {
+				run.logInterruptedSummary(ctx, destinations)
+				_ = run.reportFailures(ctx)
+				return errInterrupted
+			}
+			return err
+		}
+		summary.complete = true
+	}
+
+	if failures.Len() > 0 {
+		cli.Out(ctx).Log("")
+		cli.Out(ctx).Log("Completed, except for the files which failed to sync:")
+		if err := run.reportFailures(ctx); err != nil {
+			return err
+		}
+		return errPartialSuccess
+	}
+	if err := run.reportFailures(ctx); err != nil {
+		return err
+	}
+	cli.Out(ctx).Log("Completed!")
+
+	return nil
+}
+
+// syncRun holds the state shared by the syncs to each destination in a single run.
+type syncRun struct {
+	sourceRootPath   string
+	sourceTree       *MusicTreeNode
+	prober           AudioProber
+	fileCreateMode   os.FileMode
+	copyOptions      dzutil.CopyOptions
+	rules            []*Rule
+	failures         *FailureReport     // nil unless -keep-going
+	quarantine       *Quarantine        // nil if the quarantine is disabled
+	coverArt         *coverArtExtractor // nil unless cover art is extracted
+	loudness         *LoudnessAnalyzer  // nil unless loudness is normalized
+	transcodeTimeout time.Duration      // for each run of ffmpeg
+	transcodes       *sharedTranscodes
+	summaries        []*syncSummary // one per destination synced so far, in order
+}
+
+// syncSummary counts the changes made to a destination, for the summary logged if the run is interrupted.
+type syncSummary struct {
+	rootPath   string
+	removed    int
+	placed     int // files copied, or linked (see -link-mode), into the destination
+	transcoded int
+	queued     int // files queued for transcoding
+	complete   bool
+}
+
+// logInterruptedSummary logs what was done, before the run was interrupted, to each of the given destinations.
+func (r *syncRun) logInterruptedSummary(ctx context.Context, destinations []*destination) {
+	cli.Out(ctx).Log("")
+	if *dryRunFlag {
+		cli.Out(ctx).Log("[dry run] Interrupted.")
+		return
+	}
+	cli.Out(ctx).Log("Interrupted. Before stopping, msync:")
+	for i, dest := range destinations {
+		if i >= len(r.summaries) {
+			cli.Out(ctx).Log(fmt.Sprintf("- did not start syncing %s.", dest.rootPath))
+			continue
+		}
+		s := r.summaries[i]
+		status := "finished syncing"
+		if !s.complete {
+			status = "partially synced"
+		}
+		cli.Out(ctx).Log(fmt.Sprintf("- %s %s: removed %d files/directories, copied or linked %d files, and transcoded %d of %d queued files.", status, s.rootPath, s.removed, s.placed, s.transcoded, s.queued))
+	}
+	cli.Out(ctx).Log("Files which were in progress were removed; the next run will pick up where this one left off.")
+}
+
+// reportFailures logs the files which failed to sync, if any, and writes them to the -failure-report file, if one is given.
+func (r *syncRun) reportFailures(ctx context.Context) error {
+	if r.failures.Len() > 0 {
+		cli.Out(ctx).LogMulti(r.failures.Lines())
+	}
+	if *failureReportFlag != "" {
+		return r.failures.WriteFile(*failureReportFlag)
+	}
+	return nil
+}
+
+// syncDestination syncs the source tree to the given destination, counting the changes it makes in summary.
+// If the given context is canceled, the sync stops, and the context's error is returned.
+func (r *syncRun) syncDestination(ctx context.Context, dest *destination, summary *syncSummary) error {
+	sourceRootPath, destRootPath := r.sourceRootPath, dest.rootPath
+	sourceTree := r.sourceTree.Clone() // pruned below, depending on the destination's settings
+	profiles := dest.profiles
+	sizeBudget := dest.sizeBudget
+
+	syncState, err := LoadSyncState(destRootPath)
+	if err != nil {
+		return err
+	}
+	if !*dryRunFlag {
+		defer func() {
+			if err := syncState.Save(); err != nil {
+				cli.Out(ctx).Warning(fmt.Sprintf("Failed to save sync state: %s", err))
+			}
+		}()
+	}
+
+	if sizeBudget != nil {
+		cli.Out(ctx).Log(fmt.Sprintf("Planning sync to fit within %s ...", filesize.ByteCountBothStyles(sizeBudget.MaxSize)))
+		baseKbps := profiles.Base().BitrateKbps
+		previousKbps := syncState.BudgetKbps()
+		plan := PlanSizeBudget(sourceTree, profiles, *sizeBudget, previousKbps)
+		if plan.BitrateKbps != baseKbps {
+			cli.Out(ctx).Log(fmt.Sprintf("Lowered -max-kbps from %d to %d to fit more music.", baseKbps, plan.BitrateKbps))
+		}
+		if previousKbps != 0 && plan.BitrateKbps != previousKbps {
+			cli.Out(ctx).Warning(fmt.Sprintf("The planned bitrate changed from %d to %d Kbps since the last sync; files transcoded at %d Kbps will be transcoded again (subject to -max-retranscodes).", previousKbps, plan.BitrateKbps, previousKbps))
+		}
+		syncState.SetBudgetKbps(plan.BitrateKbps)
+		if len(plan.LeftOut) > 0 {
+			leftOut := make(map[*MusicTreeNode]bool)
+			for _, album := range plan.LeftOut {
+				for _, f := range album.files {
+					leftOut[f] = true
+				}
+				if !album.dir.HasSubdirectories() && album.dir != sourceTree {
+					leftOut[album.dir] = true
+				}
+				albumMsg := fmt.Sprintf("Leaving out '%s' (%s) because it doesn't fit within -max-size", album.dir.FilesystemPath, filesize.ByteCountSI(album.size))
+				if *dryRunFlag {
+					cli.Out(ctx).Log("[dry run] " + albumMsg)
+				} else {
+					cli.Out(ctx).Verbose(albumMsg)
+				}
+			}
+			// albums which don't fit are treated as if they weren't in the source at all:
+			sourceTree.Prune(func(n *MusicTreeNode) bool {
+				return leftOut[n]
+			})
+			cli.Out(ctx).Log(fmt.Sprintf("Left out %d albums (%d music files, an estimated %s) to fit within -max-size.", len(plan.LeftOut), plan.LeftOutFiles, filesize.ByteCountBothStyles(plan.LeftOutSize)))
+		}
+		cli.Out(ctx).Log(fmt.Sprintf("Planned %d albums, an estimated %s.", len(plan.Included), filesize.ByteCountBothStyles(plan.Size)))
+	}
+
+	profile := profiles.Base()
 
 	cli.Out(ctx).Log(fmt.Sprintf("Scanning destination directory (%s) ...", destRootPath))
-	spinCtx, _, spinStop = cli.WithSpinner(ctx, "scanning")
-	destTree, err := MakeMusicTree(spinCtx, destRootPath)
+	spinCtx, _, spinStop := cli.WithSpinner(ctx, "scanning")
+	destTree, err := MakeMusicTree(spinCtx, destRootPath, syncStateProber{inner: r.prober, state: syncState, destRootPath: destRootPath}, false, nil, r.failures)
 	spinStop()
 	if err != nil {
 		return err
 	}
+	_ = destTree.Walk(func(n *MusicTreeNode) error {
+		if n.IsFile {
+			n.SyncState = syncState.Get(relativePath(destRootPath, n.FilesystemPath))
+		}
+		return nil
+	})
 	cli.Out(ctx).Log(fmt.Sprintf("Destination tree (%s) size is %s", destRootPath, filesize.ByteCountBothStyles(destTree.CalculateSize())))
 
-	// ffmpeg's aac encoder produces files a little bit above the target bitrate. so, when transcoding,
-	// we tell ffmpeg to target (max bitrate - 5Kbps), and we allow files in the destination dir to be
-	// (max bitrate + 5 Kbps). This mostly avoids deleting & re-transcoding the same files over and
-	// over across multiple runs with the same configuration.
-	targetTranscodeBitrate := *maxBitrateKbpsFlag*1000 - 5000 // target bitrate for encoding
-	maxBitrateForDestFiles := targetTranscodeBitrate + 10000  // allowed bitrate for files in dest. dir
-	const transcodeFileExt = ".m4a"
+	// encoders don't hit the requested bitrate exactly, so each codec has a tolerance (see codecs).
+	// the profile accounts for this when deciding which files need transcoding (see NeedsTranscode and AcceptsDestFile).
 
 	// we could do this more efficiently by eg. combining remove passes, but I don't care.
 	// this makes the program logic easier to follow, and a separate count pass makes reporting progress easier.
@@ -156,15 +561,17 @@ func msyncMain() error {
 	cli.Out(ctx).Log("Removing files/directories from the destination directory tree that are missing in source directory tree ...")
 	destI := int64(0)
 	spinCtx, spinProgress, spinStop := cli.WithProgress(ctx, "checking", destTree.CountNodes())
-	removeCount, err := destTree.RemoveChildrenMatching(func(n *MusicTreeNode) bool {
+	removeCount, err := destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
 		destI++
 		spinProgress(destI)
-		return !sourceTree.HasNodeAtTreePath(n.TreePath)
-	}, "item is gone from source directory")
+		// (files whose source couldn't be scanned, with -keep-going, aren't known to be gone.)
+		return !sourceTree.HasNodeAtTreePath(n.TreePath) && !sourceTree.IsUnscanned(n.TreePath) && !profile.IsExtractedCoverArt(n, sourceTree)
+	}, "item is gone from source directory", r.failures)
 	spinStop()
 	if err != nil {
 		return err
 	}
+	summary.removed += removeCount
 	if removeCount > 0 {
 		if *dryRunFlag {
 			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d files/directories from destination (%s) because the equivalent item is gone from source directory (%s)", removeCount, destTree.FilesystemPath, sourceTree.FilesystemPath))
@@ -175,20 +582,127 @@ func msyncMain() error {
 		cli.Out(ctx).Log("0 files/directories affected.")
 	}
 
+	// remove anything from dest whose source file has changed since it was synced:
+	cli.Out(ctx).Log("Removing files from the destination directory tree whose source files have changed since they were synced ...")
+	destI = 0
+	adoptedCount := 0
+	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "checking", destTree.CountNodes())
+	removeCount, err = destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
+		destI++
+		spinProgress(destI)
+		if !n.IsMusicFile {
+			return false
+		}
+		sourceNode := sourceTree.NodeAtTreePath(n.TreePath)
+		if sourceNode == nil || !sourceNode.IsFile {
+			return false
+		}
+		destRelPath := relativePath(destRootPath, n.FilesystemPath)
+		if n.SyncState == nil {
+			// this file predates msync's state tracking; assume it's up to date with its source:
+			entry, err := AdoptSyncStateEntry(sourceRootPath, sourceNode, n)
+			if err != nil {
+				cli.Out(spinCtx).Verbose(fmt.Sprintf("Could not begin tracking '%s': %s", n.FilesystemPath, err))
+				return false
+			}
+			syncState.Set(destRelPath, entry)
+			n.SyncState = entry
+			adoptedCount++
+			return false
+		}
+		if !n.SyncState.MatchesSource(sourceRootPath, sourceNode) {
+			return true
+		}
+		if !n.SyncState.SourceModTime.Equal(sourceNode.ModTime) {
+			// the source was touched, but its content hash is unchanged:
+			entry := *n.SyncState
+			entry.SourceModTime = sourceNode.ModTime
+			syncState.Set(destRelPath, &entry)
+			n.SyncState = &entry
+		}
+		return false
+	}, "its source file has changed", r.failures)
+	spinStop()
+	if err != nil {
+		return err
+	}
+	if adoptedCount > 0 {
+		cli.Out(ctx).Verbose(fmt.Sprintf("Began tracking source state for %d existing destination files.", adoptedCount))
+	}
+	summary.removed += removeCount
+	if removeCount > 0 {
+		if *dryRunFlag {
+			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d files from destination (%s) because their source files have changed; they will be re-synced", removeCount, destTree.FilesystemPath))
+		} else {
+			cli.Out(ctx).Log(fmt.Sprintf("Removed %d files from destination (%s) because their source files have changed; they will be re-synced", removeCount, destTree.FilesystemPath))
+		}
+	} else {
+		cli.Out(ctx).Log("0 files affected.")
+	}
+
+	// remove transcodes from dest that were made with different encoder settings:
+	cli.Out(ctx).Log(fmt.Sprintf("Removing files from the destination directory tree that were transcoded with settings other than %s ...", profile))
+	destI = 0
+	outdatedCount := 0
+	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "checking", destTree.CountNodes())
+	removeCount, err = destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
+		destI++
+		spinProgress(destI)
+		if !n.IsMusicFile || n.SyncState == nil || n.SyncState.Operation != syncOpTranscode {
+			return false
+		}
+		source := sourceTree.NodeAtTreePath(n.TreePath)
+		destProfile := profiles.For(source)
+		if n.SyncState.EncoderSettings == "" {
+			// this file's encoder settings weren't recorded because it predates the sync state.
+			// we can still tell if it was made with a different codec, though:
+			if strings.EqualFold(filepath.Ext(n.FilesystemPath), destProfile.Ext()) {
+				return false
+			}
+		} else if n.SyncState.EncoderSettings == destProfile.ID() {
+			// with album loudness normalization, the file's album gain is outdated if tracks have since been
+			// added to, removed from, or changed in its album. (files transcoded before album digests were
+			// recorded are left alone.)
+			if destProfile.Loudness != loudnessAlbum || source == nil || n.SyncState.AlbumDigest == "" || n.SyncState.AlbumDigest == albumDigest(albumTracks(r.sourceTree, source)) {
+				return false
+			}
+		}
+		outdatedCount++
+		return *maxRetranscodesFlag < 0 || outdatedCount <= *maxRetranscodesFlag
+	}, "it was transcoded with outdated encoder settings", r.failures)
+	spinStop()
+	if err != nil {
+		return err
+	}
+	summary.removed += removeCount
+	if removeCount > 0 {
+		if *dryRunFlag {
+			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d files from destination (%s) because they were transcoded with outdated settings; they will be transcoded again", removeCount, destTree.FilesystemPath))
+		} else {
+			cli.Out(ctx).Log(fmt.Sprintf("Removed %d files from destination (%s) because they were transcoded with outdated settings; they will be transcoded again", removeCount, destTree.FilesystemPath))
+		}
+	} else {
+		cli.Out(ctx).Log("0 files affected.")
+	}
+	if outdatedCount > removeCount {
+		cli.Out(ctx).Log(fmt.Sprintf("%d more files transcoded with outdated settings were left in place due to -max-retranscodes.", outdatedCount-removeCount))
+	}
+
 	if *removeOtherFilesFromDestFlag {
 		// remove anything from dest that isn't a music file:
 		cli.Out(ctx).Log("Removing non-music files from the destination directory tree ...")
 		destI = 0
 		spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "checking", destTree.CountNodes())
-		removeCount, err = destTree.RemoveChildrenMatching(func(n *MusicTreeNode) bool {
+		removeCount, err = destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
 			destI++
 			spinProgress(destI)
-			return !(n.IsDirectory || n.IsMusicFile)
-		}, "file is not a music file")
+			return !(n.IsDirectory || n.IsMusicFile || profile.IsExtractedCoverArt(n, sourceTree))
+		}, "file is not a music file", r.failures)
 		spinStop()
 		if err != nil {
 			return err
 		}
+		summary.removed += removeCount
 		if removeCount > 0 {
 			if *dryRunFlag {
 				cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d non-music files from destination (%s)", removeCount, destTree.FilesystemPath))
@@ -200,43 +714,51 @@ func msyncMain() error {
 		}
 	}
 
-	// remove anything from dest that has too-high bitrate:
-	cli.Out(ctx).Log(fmt.Sprintf("Removing music files that exceed %d Kbps from the destination directory tree ...", *maxBitrateKbpsFlag))
+	// remove anything from dest that should have been transcoded (eg. because its bitrate is too high):
+	cli.Out(ctx).Log(fmt.Sprintf("Removing music files that don't meet the transcoding policy (%s) from the destination directory tree ...", profile.DescribePolicy()))
 	destI = 0
 	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "checking", destTree.CountNodes())
-	removeCount, err = destTree.RemoveChildrenMatching(func(n *MusicTreeNode) bool {
+	removeCount, err = destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
 		destI++
 		spinProgress(destI)
-		return n.IsMusicFile && n.FileBitrate > maxBitrateForDestFiles
-	}, fmt.Sprintf("its bitrate exceeds %d Kbps", *maxBitrateKbpsFlag))
+		return n.IsMusicFile && !profiles.For(sourceTree.NodeAtTreePath(n.TreePath)).AcceptsDestFile(n)
+	}, fmt.Sprintf("it doesn't meet the transcoding policy (%s)", profile.DescribePolicy()), r.failures)
 	spinStop()
 	if err != nil {
 		return err
 	}
+	summary.removed += removeCount
 	if removeCount > 0 {
 		if *dryRunFlag {
-			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d files from destination (%s) because their bitrate exceeded %d Kbps", removeCount, destTree.FilesystemPath, *maxBitrateKbpsFlag))
+			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d files from destination (%s) because they didn't meet the transcoding policy (%s)", removeCount, destTree.FilesystemPath, profile.DescribePolicy()))
 		} else {
-			cli.Out(ctx).Log(fmt.Sprintf("Removed %d files from destination (%s) because their bitrate exceeded %d Kbps", removeCount, destTree.FilesystemPath, *maxBitrateKbpsFlag))
+			cli.Out(ctx).Log(fmt.Sprintf("Removed %d files from destination (%s) because they didn't meet the transcoding policy (%s)", removeCount, destTree.FilesystemPath, profile.DescribePolicy()))
 		}
 	} else {
 		cli.Out(ctx).Log("0 files affected.")
 	}
 
-	ffmpegBitrateStr := strconv.Itoa(*maxBitrateKbpsFlag) + "k"
 	didMkdir := make(map[string]bool)
+	ruleMatchCounts := make(map[*Rule]int)
 	filesSyncedCount := 0
 	var transcodeQueue []transcodeOp
 
 	// either copy/link or re-encode all music files & directories from source that aren't in dest:
-	if *makeSymlinksFlag {
-		cli.Out(ctx).Log(fmt.Sprintf("Syncing music files from source to destination. Files over %d Kbps will be queued for transcoding; others will be symlinked.", *maxBitrateKbpsFlag))
-	} else {
-		cli.Out(ctx).Log(fmt.Sprintf("Syncing music files from source to destination. Files over %d Kbps will be queued for transcoding; others will be copied.", *maxBitrateKbpsFlag))
+	linker, err := newFileLinker(ctx, dest.linkMode, sourceRootPath, destRootPath, r.copyOptions)
+	if err != nil {
+		return err
 	}
+	linkStage := failureStageCopy
+	if dest.linkMode == linkModeSymlink {
+		linkStage = failureStageSymlink
+	}
+	cli.Out(ctx).Log(fmt.Sprintf("Syncing music files from source to destination. Files which don't meet the transcoding policy (%s) will be queued for transcoding; others will be %s.", profile.DescribePolicy(), linker.Describe()))
 	sourceI := int64(0)
 	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "syncing", sourceTree.CountNodes())
 	err = sourceTree.Walk(func(n *MusicTreeNode) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		sourceI++
 		spinProgress(sourceI)
 		if n.IsFile && !n.IsMusicFile {
@@ -246,17 +768,34 @@ func msyncMain() error {
 			destPath := strings.Replace(n.FilesystemPath, sourceRootPath, destRootPath, 1)
 
 			// file dest path may be different if re-encoding.
+			selection := profiles.Select(nil)
+			ruleDesc := ""
+			if n.IsMusicFile {
+				selection = profiles.Select(n)
+				if selection.rule != nil {
+					ruleMatchCounts[selection.rule]++
+					ruleDesc = fmt.Sprintf(" (rule '%s')", selection.rule.Name)
+				}
+			}
+			fileProfile := selection.profile
 			needsTranscode := false
-			if n.IsFile && n.IsMusicFile && n.FileBitrate > maxBitrateForDestFiles {
+			var planMsg string
+			if n.IsFile && n.IsMusicFile && fileProfile.NeedsTranscode(n) {
+				if r.quarantine.IsQuarantined(n) {
+					cli.Out(spinCtx).Warning(fmt.Sprintf("Skipping '%s': it failed to transcode in %d runs, and hasn't changed since. See `msync failures`.", n.FilesystemPath, r.quarantine.Failures(n)))
+					return nil
+				}
 				needsTranscode = true
-				destPath = dzutil.RemoveExt(destPath) + transcodeFileExt
-				cli.Out(spinCtx).Verbose(fmt.Sprintf("%s is missing from destination; will be transcoded to %s", n.FilesystemPath, destPath))
+				destPath = dzutil.RemoveExt(destPath) + fileProfile.Ext()
+				planMsg = fmt.Sprintf("%s is missing from destination; will be transcoded to %s%s", n.FilesystemPath, destPath, ruleDesc)
 			} else {
-				if *makeSymlinksFlag {
-					cli.Out(spinCtx).Verbose(fmt.Sprintf("%s is missing from destination; will be symlinked to %s", n.FilesystemPath, destPath))
-				} else {
-					cli.Out(spinCtx).Verbose(fmt.Sprintf("%s is missing from destination; will be copied to %s", n.FilesystemPath, destPath))
-				}
+				planMsg = fmt.Sprintf("%s is missing from destination; will be %s to %s%s", n.FilesystemPath, linker.Describe(), destPath, ruleDesc)
+			}
+			if *dryRunFlag && ruleDesc != "" {
+				// show which rule applies to each file when previewing a sync with rules:
+				cli.Out(spinCtx).Log("[dry run] " + planMsg)
+			} else {
+				cli.Out(spinCtx).Verbose(planMsg)
 			}
 
 			destDirPath := destPath
@@ -268,7 +807,7 @@ func msyncMain() error {
 					cli.Out(spinCtx).Verbose(fmt.Sprintf("mkdir -p '%s'", destDirPath))
 					err := os.MkdirAll(destDirPath, destTree.Mode)
 					if err != nil {
-						return err
+						return r.failures.Record(spinCtx, &FileFailure{Stage: failureStageMkdir, Path: n.FilesystemPath, Destination: destRootPath, Err: err})
 					}
 				} else {
 					cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would mkdir -p '%s'", destDirPath))
@@ -314,7 +853,7 @@ func msyncMain() error {
 			destFileNameNormalized := normalizeFileNameForComparing(destFileName)
 
 			if needsTranscode {
-				cli.Out(spinCtx).Verbose(fmt.Sprintf("Queueing transcode of '%s' to '%s' at %s ...", n.FilesystemPath, destPath, ffmpegBitrateStr))
+				cli.Out(spinCtx).Verbose(fmt.Sprintf("Queueing transcode of '%s' to '%s' as %s ...", n.FilesystemPath, destPath, selection.Describe()))
 				destNode := &MusicTreeNode{
 					TreePath:           append(destDirPartsNormalized, destFileNameNormalized),
 					FilesystemPath:     destPath,
@@ -322,49 +861,43 @@ func msyncMain() error {
 					IsMusicFile:        true,
 					BaseName:           destFileName,
 					BaseNameNormalized: destFileNameNormalized,
-					FileBitrate:        targetTranscodeBitrate,
+					FileBitrate:        fileProfile.ExpectedBitrate(n),
+					FileCodec:          fileProfile.ProbedCodec(),
+					FileLossless:       fileProfile.IsLossless(),
 				}
 				destDirNode.Children[destFileNameNormalized] = destNode
+				summary.queued++
 				transcodeQueue = append(transcodeQueue, transcodeOp{
-					source: n,
-					dest:   destNode,
+					source:  n,
+					dest:    destNode,
+					profile: fileProfile,
 				})
 			} else {
-				if *makeSymlinksFlag {
-					if !*dryRunFlag {
-						cli.Out(spinCtx).Verbose(fmt.Sprintf("Symlinking '%s' to '%s'", destPath, n.FilesystemPath))
-						err := os.Symlink(n.FilesystemPath, destPath)
-						if err != nil {
-							return fmt.Errorf("failed to symlink '%s' to '%s': %w", destPath, n.FilesystemPath, err)
-						}
-					} else {
-						cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would symlink '%s' to '%s'", destPath, n.FilesystemPath))
+				var operation string
+				if !*dryRunFlag {
+					var err error
+					operation, err = linker.Link(spinCtx, n.FilesystemPath, destPath)
+					if err != nil {
+						return r.failures.Record(spinCtx, &FileFailure{Stage: linkStage, Path: n.FilesystemPath, Destination: destRootPath, Err: err})
 					}
+					summary.placed++
 				} else {
-					if !*dryRunFlag {
-						cli.Out(spinCtx).Verbose(fmt.Sprintf("Copying '%s' to '%s'", n.FilesystemPath, destPath))
-						err := dzutil.CopyFile(n.FilesystemPath, destPath, fileCreateMode)
-						if err != nil {
-							return fmt.Errorf("failed to copy '%s' to '%s': %w", n.FilesystemPath, destPath, err)
-						}
-					} else {
-						cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would copy '%s' to '%s'", n.FilesystemPath, destPath))
-					}
+					cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] '%s' would be %s to '%s'", n.FilesystemPath, linker.Describe(), destPath))
 				}
 				var newFileSize int64
 				var newFileMode os.FileMode
 				if !*dryRunFlag {
 					info, err := os.Stat(destPath)
 					if err != nil {
-						return err
+						return r.failures.Record(spinCtx, &FileFailure{Stage: linkStage, Path: n.FilesystemPath, Destination: destRootPath, Err: err})
 					}
 					newFileSize = info.Size()
 					newFileMode = info.Mode()
 				} else {
 					newFileSize = n.FileSize
-					newFileMode = fileCreateMode
+					newFileMode = r.fileCreateMode
 				}
-				destDirNode.Children[destFileNameNormalized] = &MusicTreeNode{
+				destNode := &MusicTreeNode{
 					TreePath:           append(destDirPartsNormalized, destFileNameNormalized),
 					FilesystemPath:     destPath,
 					IsFile:             true,
@@ -372,9 +905,18 @@ func msyncMain() error {
 					BaseName:           destFileName,
 					BaseNameNormalized: destFileNameNormalized,
 					FileSize:           newFileSize,
-					FileBitrate:        n.FileBitrate,
 					Mode:               newFileMode,
 				}
+				destNode.SetAudioInfo(n.AudioInfo())
+				destDirNode.Children[destFileNameNormalized] = destNode
+				if !*dryRunFlag {
+					entry, err := NewSyncStateEntry(sourceRootPath, n, destPath, n.AudioInfo(), operation, "")
+					if err != nil {
+						// (the file is left in place, untracked; the next run will begin tracking it.)
+						return r.failures.Record(spinCtx, &FileFailure{Stage: linkStage, Path: n.FilesystemPath, Destination: destRootPath, Err: err})
+					}
+					syncState.Set(relativePath(destRootPath, destPath), entry)
+				}
 			}
 			filesSyncedCount++
 		}
@@ -389,6 +931,11 @@ func msyncMain() error {
 	} else {
 		cli.Out(ctx).Log(fmt.Sprintf("Synchronized or enqueued %d music files.", filesSyncedCount))
 	}
+	for _, rule := range r.rules {
+		if rule.Action != ruleActionSkip {
+			cli.Out(ctx).Log(fmt.Sprintf("Rule '%s' (%s) matched %d of those files.", rule.Name, rule.Action, ruleMatchCounts[rule]))
+		}
+	}
 
 	cli.Out(ctx).Log(fmt.Sprintf("Transcoding %d music files from source to destination ...", len(transcodeQueue)))
 	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "transcoding", int64(len(transcodeQueue)))
@@ -397,13 +944,31 @@ func msyncMain() error {
 	currentIdx := -1
 	var transcodeQueueLock sync.Mutex
 	var wg sync.WaitGroup
+	// failTranscode handles a failed transcode, returning true iff the sync should stop.
+	// with -keep-going, the failure is recorded, and the transcode is dropped from the destination tree.
+	failTranscode := func(op transcodeOp, transErr error) bool {
+		if ctx.Err() == nil {
+			r.quarantine.RecordFailure(op.source, transErr)
+		}
+		transErr = r.failures.Record(spinCtx, &FileFailure{Stage: failureStageTranscode, Path: op.source.FilesystemPath, Destination: destRootPath, Err: transErr})
+		transcodeQueueLock.Lock()
+		defer transcodeQueueLock.Unlock()
+		if transErr != nil {
+			err = transErr // it's possible that up to NumCPUs errors occur and we only see the most recent one, but we'll still exit, so whatever
+			return true
+		}
+		if destDirNode := destTree.NodeAtTreePath(op.dest.TreePath[:len(op.dest.TreePath)-1]); destDirNode != nil {
+			delete(destDirNode.Children, op.dest.BaseNameNormalized)
+		}
+		return false
+	}
 	for i := 0; i <= cpuCount; i++ {
 		wg.Add(1)
 		go func() {
 			for {
 				transcodeQueueLock.Lock()
 				currentIdx++
-				if currentIdx >= len(transcodeQueue) || err != nil {
+				if currentIdx >= len(transcodeQueue) || err != nil || ctx.Err() != nil {
 					transcodeQueueLock.Unlock()
 					wg.Done()
 					return
@@ -413,49 +978,89 @@ func msyncMain() error {
 				transcodeQueueLock.Unlock()
 
 				if !*dryRunFlag {
-					cli.Out(spinCtx).Verbose(fmt.Sprintf("Transcoding '%s' to '%s' at %s ...", op.source.FilesystemPath, op.dest.FilesystemPath, ffmpegBitrateStr))
-					// try without discarding album art; and if that fails try once more discarding video entirely:
-					out, transErr := dzutil.Exec("ffmpeg", []string{"-loglevel", "warning", "-hide_banner", "-i", op.source.FilesystemPath, "-c:v", "copy", "-c:a", "aac", "-b:a", ffmpegBitrateStr, op.dest.FilesystemPath})
+					transErr := r.transcode(spinCtx, op)
 					if transErr != nil {
-						_ = os.Remove(op.dest.FilesystemPath)
-						cli.Out(spinCtx).Verbose(fmt.Sprintf("Transcoding of '%s' failed. Trying again without video. Error was: %s %s", op.source.FilesystemPath, out, transErr))
-						out, transErr = dzutil.Exec("ffmpeg", []string{"-loglevel", "warning", "-hide_banner", "-i", op.source.FilesystemPath, "-vn", "-c:a", "aac", "-b:a", ffmpegBitrateStr, op.dest.FilesystemPath})
-						if transErr != nil {
-							_ = os.Remove(op.dest.FilesystemPath)
-							transcodeQueueLock.Lock()
-							err = fmt.Errorf("transcode '%s' failed: %w: %s", op.source.FilesystemPath, transErr, out) // it's possible that up to NumCPUs errors occur and we only see the most recent one, but we'll still exit, so whatever
-							transcodeQueueLock.Unlock()
+						if failTranscode(op, transErr) {
 							wg.Done()
 							return
 						}
+						continue
 					}
 					destInfo, transErr := os.Stat(op.dest.FilesystemPath)
 					if transErr != nil {
 						_ = os.Remove(op.dest.FilesystemPath)
-						transcodeQueueLock.Lock()
-						err = transErr
-						transcodeQueueLock.Unlock()
-						wg.Done()
-						return
+						if failTranscode(op, transErr) {
+							wg.Done()
+							return
+						}
+						continue
 					}
 					op.dest.Mode = destInfo.Mode()
 					op.dest.FileSize = destInfo.Size()
+					if probed, probeErr := r.prober.Probe(spinCtx, op.dest.FilesystemPath); probeErr == nil {
+						op.dest.SetAudioInfo(probed)
+					} else {
+						cli.Out(spinCtx).Verbose(fmt.Sprintf("Could not probe transcoded file '%s': %s", op.dest.FilesystemPath, probeErr))
+					}
+					entry, transErr := NewSyncStateEntry(sourceRootPath, op.source, op.dest.FilesystemPath, op.dest.AudioInfo(), syncOpTranscode, op.profile.ID())
+					if transErr != nil {
+						// an untracked transcode would be mistaken for a file copied from the source on the next run:
+						_ = os.Remove(op.dest.FilesystemPath)
+						if failTranscode(op, transErr) {
+							wg.Done()
+							return
+						}
+						continue
+					}
+					if op.profile.Loudness == loudnessAlbum {
+						entry.AlbumDigest = albumDigest(albumTracks(r.sourceTree, op.source))
+					}
+					syncState.Set(relativePath(destRootPath, op.dest.FilesystemPath), entry)
+					op.dest.SyncState = entry
+					r.transcodes.Put(op.source.FilesystemPath, op.profile.ID(), op.dest.FilesystemPath)
+					r.quarantine.RecordSuccess(op.source)
+					transcodeQueueLock.Lock()
+					summary.transcoded++
+					transcodeQueueLock.Unlock()
+
+					if r.coverArt != nil {
+						coverPath, coverErr := r.coverArt.Extract(spinCtx, op.source.FilesystemPath, filepath.Dir(op.dest.FilesystemPath))
+						if coverErr != nil {
+							cli.Out(spinCtx).Verbose(coverErr.Error())
+						} else if coverPath != "" {
+							cli.Out(spinCtx).Verbose(fmt.Sprintf("Extracted cover art from '%s' to '%s'", op.source.FilesystemPath, coverPath))
+							if entry, coverErr := NewSyncStateEntry(sourceRootPath, op.source, coverPath, nil, syncOpExtractArt, ""); coverErr == nil {
+								syncState.Set(relativePath(destRootPath, coverPath), entry)
+							}
+						}
+					}
 				} else {
-					cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would transcode '%s' to '%s' at %s", op.source.FilesystemPath, op.dest.FilesystemPath, ffmpegBitrateStr))
-					op.dest.Mode = fileCreateMode
-					op.dest.FileSize = int64(math.Round(float64(op.source.FileSize) / float64(op.source.FileBitrate) * float64(targetTranscodeBitrate)))
+					if sharedPath, ok := r.transcodes.Get(op.source.FilesystemPath, op.profile.ID()); ok {
+						cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would reuse '%s' as the transcode of '%s' to '%s'", sharedPath, op.source.FilesystemPath, op.dest.FilesystemPath))
+					} else {
+						cli.Out(spinCtx).Verbose(fmt.Sprintf("[dry run] Would transcode '%s' to '%s' as %s", op.source.FilesystemPath, op.dest.FilesystemPath, op.profile))
+						r.transcodes.Put(op.source.FilesystemPath, op.profile.ID(), op.dest.FilesystemPath)
+					}
+					op.dest.Mode = r.fileCreateMode
+					op.dest.FileSize = estimatedDestSize(op.source, op.profile)
 				}
 			}
 		}()
 	}
 	wg.Wait()
 	spinStop()
+	if ctx.Err() != nil {
+		// transcodes cut short by the interruption failed, too; report the interruption itself:
+		return ctx.Err()
+	}
 	if err != nil {
 		return err
 	}
 	if len(transcodeQueue) > 0 {
 		if *dryRunFlag {
 			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would transcode %d music files.", len(transcodeQueue)))
+		} else if failed := len(transcodeQueue) - summary.transcoded; failed > 0 {
+			cli.Out(ctx).Log(fmt.Sprintf("Transcoded %d music files; %d failed.", summary.transcoded, failed))
 		} else {
 			cli.Out(ctx).Log(fmt.Sprintf("Transcoded %d music files.", len(transcodeQueue)))
 		}
@@ -466,15 +1071,16 @@ func msyncMain() error {
 	cli.Out(ctx).Log("Removing empty directories from the destination directory tree ...")
 	destI = 0
 	spinCtx, spinProgress, spinStop = cli.WithProgress(ctx, "checking", destTree.CountNodes())
-	removeCount, err = destTree.RemoveChildrenMatching(func(n *MusicTreeNode) bool {
+	removeCount, err = destTree.RemoveChildrenMatching(spinCtx, func(n *MusicTreeNode) bool {
 		destI++
 		spinProgress(destI)
 		return n.IsDirectory && len(n.Children) == 0
-	}, "directory is empty")
+	}, "directory is empty", r.failures)
 	spinStop()
 	if err != nil {
 		return err
 	}
+	summary.removed += removeCount
 	if removeCount > 0 {
 		if *dryRunFlag {
 			cli.Out(ctx).Log(fmt.Sprintf("[dry run] Would remove %d empty directories from destination (%s)", removeCount, destTree.FilesystemPath))
@@ -485,9 +1091,17 @@ func msyncMain() error {
 		cli.Out(ctx).Log("0 directories affected.")
 	}
 
+	// later destinations can reuse this destination's transcodes, including those made in earlier runs:
+	_ = destTree.Walk(func(n *MusicTreeNode) error {
+		if n.IsMusicFile && n.SyncState != nil && n.SyncState.Operation == syncOpTranscode && n.SyncState.EncoderSettings != "" {
+			r.transcodes.Put(filepath.Join(sourceRootPath, n.SyncState.SourcePath), n.SyncState.EncoderSettings, n.FilesystemPath)
+		}
+		return nil
+	})
+
 	cli.Out(ctx).Log("")
 	symlinkPart := ""
-	if *makeSymlinksFlag {
+	if dest.linkMode == linkModeSymlink {
 		symlinkPart = " (after resolving symlinks created during sync)"
 	}
 	if !*dryRunFlag {
@@ -495,7 +1109,59 @@ func msyncMain() error {
 	} else {
 		cli.Out(ctx).Log(fmt.Sprintf("[dry run] Destination library size is estimated to be %s%s.", filesize.ByteCountBothStyles(destTree.CalculateSize()), symlinkPart))
 	}
-	cli.Out(ctx).Log("Completed!")
 
 	return nil
 }
+
+// transcode produces the destination file for the given transcode operation. If another destination already
+// has the same transcode (see sharedTranscodes), it's hardlinked or copied; otherwise, ffmpeg is run.
+func (r *syncRun) transcode(ctx context.Context, op transcodeOp) error {
+	if sharedPath, ok := r.transcodes.Get(op.source.FilesystemPath, op.profile.ID()); ok {
+		cli.Out(ctx).Verbose(fmt.Sprintf("Reusing '%s' as the transcode of '%s' to '%s' ...", sharedPath, op.source.FilesystemPath, op.dest.FilesystemPath))
+		linkErr := linkOrCopy(sharedPath, op.dest.FilesystemPath, op.source.ModTime, r.copyOptions)
+		if linkErr == nil {
+			return nil
+		}
+		_ = os.Remove(op.dest.FilesystemPath)
+		cli.Out(ctx).Verbose(fmt.Sprintf("Could not reuse '%s' (%s); transcoding '%s' instead.", sharedPath, linkErr, op.source.FilesystemPath))
+	}
+
+	var gain *replayGain
+	if r.loudness != nil {
+		var err error
+		if gain, err = r.loudness.Gain(ctx, op.source, albumTracks(r.sourceTree, op.source)); err != nil {
+			return err
+		}
+	}
+
+	cli.Out(ctx).Verbose(fmt.Sprintf("Transcoding '%s' to '%s' as %s ...", op.source.FilesystemPath, op.dest.FilesystemPath, op.profile))
+	// ffmpeg writes to a temporary file, which is moved into place once it's complete, so an interrupted
+	// transcode never leaves a partial file in the destination:
+	tmpPath, err := dzutil.TempFileFor(op.dest.FilesystemPath)
+	if err != nil {
+		return fmt.Errorf("transcode '%s' failed: %w", op.source.FilesystemPath, err)
+	}
+	defer os.Remove(tmpPath) // no-op once the transcode has been moved into place
+	// try with the profile's cover art handling; and if that fails (and the art was to be kept) try once more discarding video entirely:
+	args := append([]string{"-loglevel", "warning", "-hide_banner", "-i", op.source.FilesystemPath}, op.profile.FFmpegCoverArtArgs()...)
+	args = append(args, op.profile.FFmpegArgs(op.source, gain)...)
+	_, _, err = dzutil.Exec(ctx, r.transcodeTimeout, "ffmpeg", append(args, "-y", tmpPath))
+	var execErr *dzutil.ExecError
+	if errors.As(err, &execErr) && execErr.ExitCode >= 0 && op.profile.EmbedsCoverArt() {
+		// (ffmpeg exited with an error, rather than being killed because it timed out or the sync was interrupted.)
+		cli.Out(ctx).Verbose(fmt.Sprintf("Transcoding of '%s' failed. Trying again without video. Error was: %s", op.source.FilesystemPath, err))
+		firstErr := execErr
+		args = append([]string{"-loglevel", "warning", "-hide_banner", "-i", op.source.FilesystemPath, "-vn"}, op.profile.FFmpegArgs(op.source, gain)...)
+		_, _, err = dzutil.Exec(ctx, r.transcodeTimeout, "ffmpeg", append(args, "-y", tmpPath))
+		if err == nil {
+			cli.Out(ctx).Warning(fmt.Sprintf("Transcoded '%s' without its cover art, which ffmpeg could not carry over (%s). Consider -cover-art strip or extract.", op.source.FilesystemPath, firstErr.StderrTail))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("transcode '%s' failed: %w", op.source.FilesystemPath, err)
+	}
+	if err := dzutil.CommitTempFile(tmpPath, op.dest.FilesystemPath, r.fileCreateMode); err != nil {
+		return fmt.Errorf("transcode '%s' failed: %w", op.source.FilesystemPath, err)
+	}
+	return nil
+}
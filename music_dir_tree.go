@@ -2,15 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"msync/audioinfo"
 	"msync/cli"
 	"msync/dzutil"
 
@@ -28,17 +32,50 @@ type MusicTreeNode struct {
 	BaseNameNormalized string                    // base name of this entity, normalized to lowercase and with music file extensions removed
 	FileSize           int64                     // size of this entity, iff it's a file
 	FileBitrate        int                       // bitrate of this entity, iff it's a music file
+	FileCodec          string                    // codec of this entity (see audioinfo.Info), iff it's a music file
+	FileLossless       bool                      // whether this entity's codec is lossless, iff it's a music file
+	FileSampleRate     int                       // sample rate of this entity, in Hz, iff it's a music file; 0 if unknown
+	FileBitDepth       int                       // bit depth of this entity, iff it's a music file with a lossless codec; 0 if unknown
+	FileChannels       int                       // number of audio channels in this entity, iff it's a music file; 0 if unknown
+	ModTime            time.Time                 // modification time of this entity
 	Mode               os.FileMode               // file mode of this entity
+	SyncState          *SyncStateEntry           // how this file was produced, iff it's a destination file recorded in the sync state
 	Children           map[string]*MusicTreeNode // map of BaseNameNormalized -> *MusicTreeNode, iff it's a directory. nil if it's a file.
+	Unscanned          [][]string                // tree paths of descendants which couldn't be scanned, and were left out of the tree (with -keep-going). only set on the root node.
+}
+
+// treeScan holds the state of a single MakeMusicTree scan.
+type treeScan struct {
+	failures     *FailureReport
+	unlistedExts map[string]int // counts of audio files skipped because their extensions aren't in musicExts
+	unscanned    [][]string     // see MusicTreeNode.Unscanned
 }
 
 // MakeMusicTree builds a music tree rooted at the given path on disk.
-// The given progress function is called with each path as it's scanned.
-func MakeMusicTree(ctx context.Context, filePath string) (*MusicTreeNode, error) {
-	tree, err := makeMusicTreeNode(ctx, filePath, nil, true)
+// The bitrate of each music file in the tree is determined using the given prober.
+// If skipUnprobeable is set, music files which can't be probed because their format or codec is unsupported
+// (see audioinfo.ErrUnsupportedFormat) are reported and then treated as non-music files; otherwise, and for
+// any other probe error (eg. a timeout), failing to probe a file is an error.
+// Files and directories excluded by the given filter (which may be nil) are left out of the tree entirely.
+// Files which can't be scanned or probed are recorded in the given failure report, if it's not nil (see
+// FailureReport.Record); files which can't be scanned are then left out of the tree (see Unscanned), and
+// music files which can't be probed are left in it, with unknown bitrates.
+// If the given context is canceled, scanning stops, and the context's error is returned.
+func MakeMusicTree(ctx context.Context, filePath string, prober AudioProber, skipUnprobeable bool, filter *PathFilter, failures *FailureReport) (*MusicTreeNode, error) {
+	scan := &treeScan{failures: failures, unlistedExts: make(map[string]int)}
+	tree, err := makeMusicTreeNode(ctx, filePath, nil, true, filter, scan)
 	if err != nil {
 		return tree, err
 	}
+	tree.Unscanned = scan.unscanned
+	sortedUnlistedExts := make([]string, 0, len(scan.unlistedExts))
+	for ext := range scan.unlistedExts {
+		sortedUnlistedExts = append(sortedUnlistedExts, ext)
+	}
+	sort.Strings(sortedUnlistedExts)
+	for _, ext := range sortedUnlistedExts {
+		cli.Out(ctx).Warning(fmt.Sprintf("Skipped %d '%s' file(s) in '%s'. Add '%s' to -music-exts to treat them as music files.", scan.unlistedExts[ext], ext, filePath, strings.TrimPrefix(ext, ".")))
+	}
 	var nodesNeedingBitrate []*MusicTreeNode
 	_ = tree.Walk(func(n *MusicTreeNode) error {
 		if n.IsMusicFile && n.FileBitrate == 0 {
@@ -57,14 +94,26 @@ func MakeMusicTree(ctx context.Context, filePath string) (*MusicTreeNode, error)
 			for {
 				nodesQueueLock.Lock()
 				currentIdx++
-				if currentIdx >= len(nodesNeedingBitrate) || err != nil {
+				if currentIdx >= len(nodesNeedingBitrate) || err != nil || ctx.Err() != nil {
 					nodesQueueLock.Unlock()
 					wg.Done()
 					return
 				}
 				n := nodesNeedingBitrate[currentIdx]
 				nodesQueueLock.Unlock()
-				bitrate, brErr := fileBitrate(n.FilesystemPath)
+				info, brErr := prober.Probe(ctx, n.FilesystemPath)
+				if brErr != nil && skipUnprobeable && errors.Is(brErr, audioinfo.ErrUnsupportedFormat) {
+					cli.Out(ctx).Warning(fmt.Sprintf("Skipping '%s': %s", n.FilesystemPath, brErr))
+					failures.Add(&FileFailure{Stage: failureStageProbe, Path: n.FilesystemPath, Err: brErr})
+					n.IsMusicFile = false
+					continue
+				}
+				if brErr != nil {
+					if brErr = failures.Record(ctx, &FileFailure{Stage: failureStageProbe, Path: n.FilesystemPath, Err: brErr}); brErr == nil {
+						// left in the tree with an unknown bitrate
+						continue
+					}
+				}
 				if brErr != nil {
 					nodesQueueLock.Lock()
 					err = brErr // it's possible that up to NumCPUs errors occur and we only see the most recent one, but we'll still exit, so whatever
@@ -72,16 +121,23 @@ func MakeMusicTree(ctx context.Context, filePath string) (*MusicTreeNode, error)
 					wg.Done()
 					return
 				}
-				n.FileBitrate = bitrate
+				n.SetAudioInfo(info)
 			}
 		}()
 	}
 	wg.Wait()
+	if err == nil {
+		err = ctx.Err()
+	}
 	return tree, err
 }
 
-// makeMusicTreeNode returns nil if the path does not point to a directory, regular file, or symlink.
-func makeMusicTreeNode(ctx context.Context, filePath string, parentNodePath []string, isRootNode bool) (*MusicTreeNode, error) {
+// makeMusicTreeNode returns nil if the path does not point to a directory, regular file, or symlink,
+// or if it's excluded by the given filter.
+func makeMusicTreeNode(ctx context.Context, filePath string, parentNodePath []string, isRootNode bool, filter *PathFilter, scan *treeScan) (*MusicTreeNode, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if *verboseFlag {
 		log.Printf("Scanning '%s' ...", filePath)
 	}
@@ -93,6 +149,7 @@ func makeMusicTreeNode(ctx context.Context, filePath string, parentNodePath []st
 		BaseName:           rootInfo.Name(),
 		BaseNameNormalized: normalizeFileNameForComparing(rootInfo.Name()),
 		FilesystemPath:     filePath,
+		ModTime:            rootInfo.ModTime(),
 		Mode:               rootInfo.Mode(),
 	}
 	if !isRootNode {
@@ -106,16 +163,35 @@ func makeMusicTreeNode(ctx context.Context, filePath string, parentNodePath []st
 		cli.Out(ctx).Warning(fmt.Sprintf("Skipping '%s': it is not a regular file.", filePath))
 		return nil, nil
 	}
+	if !isRootNode && filter.Excludes(filePath, n.IsDirectory) {
+		if *verboseFlag {
+			log.Printf("Excluding '%s'.", filePath)
+		}
+		return nil, nil
+	}
 	if n.IsDirectory {
 		n.Children = make(map[string]*MusicTreeNode)
 		children, err := ioutil.ReadDir(filePath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to list '%s': %w", filePath, err)
 		}
+		filter, err := filter.WithIgnoreFile(filePath)
+		if err != nil {
+			return nil, err
+		}
 		for _, child := range children {
-			childNode, err := makeMusicTreeNode(ctx, filepath.Join(filePath, child.Name()), n.TreePath, false)
+			if isRootNode && child.Name() == syncStateDirName {
+				// msync's own state directory is never part of the music tree.
+				continue
+			}
+			childPath := filepath.Join(filePath, child.Name())
+			childNode, err := makeMusicTreeNode(ctx, childPath, n.TreePath, false, filter, scan)
 			if err != nil {
-				return nil, err
+				if err := scan.failures.Record(ctx, &FileFailure{Stage: failureStageScan, Path: childPath, Err: err}); err != nil {
+					return nil, err
+				}
+				scan.unscanned = append(scan.unscanned, append(append([]string{}, n.TreePath...), normalizeFileNameForComparing(child.Name())))
+				continue
 			}
 			if childNode != nil {
 				if existingNode, ok := n.Children[childNode.BaseNameNormalized]; ok {
@@ -124,15 +200,48 @@ func makeMusicTreeNode(ctx context.Context, filePath string, parentNodePath []st
 				n.Children[childNode.BaseNameNormalized] = childNode
 			}
 		}
+		if !isRootNode && len(n.Children) == 0 && filter.PrunesEmptyDirs() {
+			return nil, nil
+		}
 	} else if n.IsFile {
 		n.FileSize = rootInfo.Size()
-		if isMusicFile(filePath) {
-			n.IsMusicFile = true
+		if dzutil.IsTempFile(filePath) {
+			// a partial file left behind by an interrupted sync; it's not in the source, so it'll be removed:
+			n.IsMusicFile = false
+		} else if isMusicFile(filePath) {
+			n.IsMusicFile = isPlayableMusicFile(ctx, filePath)
+		} else if ext := strings.ToLower(filepath.Ext(filePath)); knownAudioExts[ext] {
+			scan.unlistedExts[ext]++
 		}
 	}
 	return n, nil
 }
 
+// AudioInfo returns the known audio properties of this node, iff it's a music file.
+func (n *MusicTreeNode) AudioInfo() *audioinfo.Info {
+	if !n.IsMusicFile {
+		return nil
+	}
+	return &audioinfo.Info{
+		Codec:      n.FileCodec,
+		Lossless:   n.FileLossless,
+		Bitrate:    n.FileBitrate,
+		SampleRate: n.FileSampleRate,
+		BitDepth:   n.FileBitDepth,
+		Channels:   n.FileChannels,
+	}
+}
+
+// SetAudioInfo updates this node's audio properties from the given probe result.
+func (n *MusicTreeNode) SetAudioInfo(info *audioinfo.Info) {
+	n.FileBitrate = info.Bitrate
+	n.FileCodec = info.Codec
+	n.FileLossless = info.Lossless
+	n.FileSampleRate = info.SampleRate
+	n.FileBitDepth = info.BitDepth
+	n.FileChannels = info.Channels
+}
+
 // CalculateSize calculates the size on disk of this node and all its children.
 // It returns bytes.
 func (n *MusicTreeNode) CalculateSize() int64 {
@@ -182,6 +291,68 @@ func (n *MusicTreeNode) NodeAtTreePath(normalizedTreePath []string) *MusicTreeNo
 	return nil
 }
 
+// IsUnscanned returns true iff the node at the specified path down the tree from this root node (or one of its
+// ancestors) was left out of the tree because it couldn't be scanned; see Unscanned.
+// The given path must be normalized.
+func (n *MusicTreeNode) IsUnscanned(normalizedTreePath []string) bool {
+	for _, unscanned := range n.Unscanned {
+		if hasTreePathPrefix(normalizedTreePath, unscanned) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTreePathPrefix(treePath, prefix []string) bool {
+	if len(prefix) > len(treePath) {
+		return false
+	}
+	for i, part := range prefix {
+		if treePath[i] != part {
+			return false
+		}
+	}
+	return true
+}
+
+// MusicFiles returns the music files directly within this directory node, sorted by base name.
+// msync treats each directory of music files as an album.
+func (n *MusicTreeNode) MusicFiles() []*MusicTreeNode {
+	var files []*MusicTreeNode
+	for _, child := range n.Children {
+		if child.IsMusicFile {
+			files = append(files, child)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].BaseName < files[j].BaseName
+	})
+	return files
+}
+
+// Clone returns a deep copy of the tree rooted at this node, which can be modified (eg. via Prune)
+// without affecting this tree.
+func (n *MusicTreeNode) Clone() *MusicTreeNode {
+	clone := *n
+	if n.Children != nil {
+		clone.Children = make(map[string]*MusicTreeNode, len(n.Children))
+		for key, child := range n.Children {
+			clone.Children[key] = child.Clone()
+		}
+	}
+	return &clone
+}
+
+// HasSubdirectories returns true iff any of the node's direct children is a directory.
+func (n *MusicTreeNode) HasSubdirectories() bool {
+	for _, child := range n.Children {
+		if child.IsDirectory {
+			return true
+		}
+	}
+	return false
+}
+
 // Walk walks every node in the given tree, calling the given callback for every node.
 func (n *MusicTreeNode) Walk(callback func(n *MusicTreeNode) error) error {
 	for _, childNode := range n.Children {
@@ -192,31 +363,64 @@ func (n *MusicTreeNode) Walk(callback func(n *MusicTreeNode) error) error {
 	return callback(n)
 }
 
+// Prune removes any descendant nodes for which the given pruneMatchFunc returns true from the tree.
+// Unlike RemoveChildrenMatching, this doesn't touch the filesystem.
+// Returns the number of nodes pruned (not counting their descendants).
+func (n *MusicTreeNode) Prune(pruneMatchFunc func(n *MusicTreeNode) bool) int {
+	pruneCount := 0
+	for childKey, childNode := range n.Children {
+		if pruneMatchFunc(childNode) {
+			delete(n.Children, childKey)
+			pruneCount++
+			continue
+		}
+		pruneCount += childNode.Prune(pruneMatchFunc)
+	}
+	return pruneCount
+}
+
 // RemoveChildrenMatching will remove any child nodes _and the filesystem objects they represent_ for which
-// the given removeMatchFunc returns true.
+// the given removeMatchFunc returns true. Nodes matching a protect pattern (see SetProtectPatterns), and
+// directories containing them, are never removed.
+// Filesystem objects which can't be removed are recorded in the given failure report, if it's not nil (see
+// FailureReport.Record), and their nodes are left in the tree.
 // Returns the number of nodes removed, and an error if one is encountered.
-func (n *MusicTreeNode) RemoveChildrenMatching(removeMatchFunc func(n *MusicTreeNode) bool, logReason string) (int, error) {
+func (n *MusicTreeNode) RemoveChildrenMatching(ctx context.Context, removeMatchFunc func(n *MusicTreeNode) bool, logReason string, failures *FailureReport) (int, error) {
+	return n.removeChildrenMatching(ctx, n.FilesystemPath, removeMatchFunc, logReason, failures)
+}
+
+func (n *MusicTreeNode) removeChildrenMatching(ctx context.Context, rootPath string, removeMatchFunc func(n *MusicTreeNode) bool, logReason string, failures *FailureReport) (int, error) {
 	removeCount := 0
 	if n.Children != nil {
 		for childKey, childNode := range n.Children {
-			count, err := childNode.RemoveChildrenMatching(removeMatchFunc, logReason)
+			count, err := childNode.removeChildrenMatching(ctx, rootPath, removeMatchFunc, logReason, failures)
 			removeCount += count
 			if err != nil {
 				return removeCount, err
 			}
 
 			if removeMatchFunc(childNode) {
-				delete(n.Children, childKey)
-
+				if isProtected(rootPath, childNode) {
+					if *verboseFlag {
+						log.Printf("Not removing '%s' (even though %s) because it's protected.", childNode.FilesystemPath, logReason)
+					}
+					continue
+				}
 				if !*dryRunFlag {
 					if *verboseFlag {
 						log.Printf("Removing '%s' because %s.", childNode.FilesystemPath, logReason)
 					}
 					if err := wastebasket.Trash(childNode.FilesystemPath); err != nil {
-						return removeCount, fmt.Errorf("failed to trash '%s': %w", childNode.FilesystemPath, err)
+						err = fmt.Errorf("failed to trash '%s': %w", childNode.FilesystemPath, err)
+						if err := failures.Record(ctx, &FileFailure{Stage: failureStageTrash, Path: childNode.FilesystemPath, Err: err}); err != nil {
+							return removeCount, err
+						}
+						continue
 					}
+					delete(n.Children, childKey)
 					removeCount++
 				} else {
+					delete(n.Children, childKey)
 					removeCount++
 					if *verboseFlag {
 						log.Printf("[dry run] Would remove '%s' because %s.", childNode.FilesystemPath, logReason)
@@ -228,10 +432,89 @@ func (n *MusicTreeNode) RemoveChildrenMatching(removeMatchFunc func(n *MusicTree
 	return removeCount, nil
 }
 
+// defaultMusicExts is the default value of the -music-exts flag.
+const defaultMusicExts = "aif,aifc,aiff,alac,ape,dsf,flac,m4a,mp3,mp4,oga,ogg,opus,wav,wma,wv"
+
+// musicExts is the set of (lowercase, dot-prefixed) extensions of files treated as music files.
+// See SetMusicExts.
+var musicExts = parseMusicExts(defaultMusicExts)
+
+// knownAudioExts lists extensions of audio files which msync may not be configured to sync.
+// Files with these extensions that aren't in musicExts are reported, rather than silently ignored.
+var knownAudioExts = map[string]bool{
+	".aac": true, ".ac3": true, ".aif": true, ".aifc": true, ".aiff": true, ".alac": true, ".amr": true,
+	".ape": true, ".au": true, ".caf": true, ".dff": true, ".dsf": true, ".dts": true, ".flac": true,
+	".m4a": true, ".m4b": true, ".m4p": true, ".mka": true, ".mp2": true, ".mp3": true, ".mpc": true,
+	".oga": true, ".ogg": true, ".opus": true, ".shn": true, ".spx": true, ".tak": true, ".tta": true,
+	".wav": true, ".wma": true, ".wv": true,
+}
+
+// sniffedMusicExts lists extensions of container formats that are commonly used for both music
+// and video (or for DRM-protected audio). Files with these extensions are inspected to determine
+// whether they really are music files.
+var sniffedMusicExts = map[string]bool{
+	".m4a": true,
+	".m4b": true,
+	".m4v": true,
+	".mp4": true,
+	".ogg": true,
+}
+
+func parseMusicExts(spec string) map[string]bool {
+	exts := make(map[string]bool)
+	for _, ext := range strings.Split(spec, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		exts[ext] = true
+	}
+	return exts
+}
+
+// SetMusicExts configures which file extensions are treated as music files, from a comma-separated
+// list (eg. "mp3,m4a,flac"). Extensions of transcoding outputs (see codecs) are always included,
+// so that msync recognizes the files it creates.
+func SetMusicExts(spec string) error {
+	exts := parseMusicExts(spec)
+	if len(exts) == 0 {
+		return errors.New("-music-exts must list at least one file extension")
+	}
+	for _, c := range codecs {
+		exts[c.ext] = true
+	}
+	musicExts = exts
+	return nil
+}
+
 func isMusicFile(path string) bool {
-	ext := strings.ToLower(filepath.Ext(path))
-	// could also add m3a, mp4 but my library doesn't have these
-	return ext == ".mp3" || ext == ".m4a" || ext == ".flac" || ext == ".alac"
+	return musicExts[strings.ToLower(filepath.Ext(path))]
+}
+
+// isPlayableMusicFile inspects the given music file, if its extension is ambiguous (see sniffedMusicExts),
+// and returns false (with a warning) if it turns out to be a video or DRM-protected file.
+func isPlayableMusicFile(ctx context.Context, path string) bool {
+	if !sniffedMusicExts[strings.ToLower(filepath.Ext(path))] {
+		return true
+	}
+	contents, err := audioinfo.Sniff(path)
+	if err != nil {
+		// let the prober deal with it
+		cli.Out(ctx).Verbose(fmt.Sprintf("could not inspect '%s': %s", path, err))
+		return true
+	}
+	switch {
+	case contents.Protected:
+		cli.Out(ctx).Warning(fmt.Sprintf("Skipping '%s': its audio is DRM-protected.", path))
+	case contents.HasVideo:
+		cli.Out(ctx).Warning(fmt.Sprintf("Skipping '%s': it contains video.", path))
+	case !contents.HasAudio:
+		cli.Out(ctx).Warning(fmt.Sprintf("Skipping '%s': it contains no audio.", path))
+	}
+	return contents.IsMusic()
 }
 
 func normalizeFileNameForComparing(name string) string {
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"msync/audioinfo"
+)
+
+// fakeProber is an AudioProber which returns the info in its map for files with the given base names,
+// and fails to probe any other file.
+type fakeProber map[string]*audioinfo.Info
+
+func (p fakeProber) Name() string {
+	return "fake"
+}
+
+func (p fakeProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	if info, ok := p[filepath.Base(path)]; ok {
+		return info, nil
+	}
+	return nil, fmt.Errorf("failed to probe '%s': %w", path, audioinfo.ErrUnsupportedFormat)
+}
+
+// errProbeTimeout is returned by timeoutProber.
+var errProbeTimeout = errors.New("probe timed out")
+
+// timeoutProber is an AudioProber which times out probing files named broken.flac, and otherwise
+// behaves like the embedded fakeProber.
+type timeoutProber struct {
+	fakeProber
+}
+
+func (p timeoutProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	if filepath.Base(path) == "broken.flac" {
+		return nil, fmt.Errorf("failed to probe '%s': %w", path, errProbeTimeout)
+	}
+	return p.fakeProber.Probe(ctx, path)
+}
+
+var testProber = fakeProber{
+	"01.mp3":  {Codec: "mp3", Bitrate: 320000, SampleRate: 44100, Channels: 2},
+	"02.MP3":  {Codec: "mp3", Bitrate: 128000, SampleRate: 44100, Channels: 2},
+	"01.flac": {Codec: "flac", Lossless: true, Bitrate: 900000, SampleRate: 96000, BitDepth: 24, Channels: 2},
+}
+
+// writeTestFile writes the given contents to the file at the given slash-separated path under root,
+// creating its parent directories as needed.
+func writeTestFile(t *testing.T, root, relPath, contents string) string {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(relPath))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// makeTestLibrary creates a source library for MakeMusicTree tests, returning its root path.
+func makeTestLibrary(t *testing.T) string {
+	root := t.TempDir()
+	writeTestFile(t, root, ignoreFileName, "Demos/\n")
+	writeTestFile(t, root, "Band/Album/01.mp3", "first")
+	writeTestFile(t, root, "Band/Album/02.MP3", "second")
+	writeTestFile(t, root, "Band/Album/cover.jpg", "cover")
+	writeTestFile(t, root, "Band/Hi-Res/01.flac", "hi-res")
+	writeTestFile(t, root, "Band/Hi-Res/broken.flac", "broken")
+	writeTestFile(t, root, "Demos/01.mp3", "demo")
+	writeTestFile(t, root, syncStateDirName+"/state.json", "{}")
+	return root
+}
+
+func TestMakeMusicTree(t *testing.T) {
+	root := makeTestLibrary(t)
+	filter, err := NewPathFilter(root, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failures := &FailureReport{}
+	tree, err := MakeMusicTree(context.Background(), root, testProber, true, filter, failures)
+	if err != nil {
+		t.Fatalf("MakeMusicTree failed: %s", err)
+	}
+
+	for _, treePath := range [][]string{{"demos"}, {syncStateDirName}} {
+		if tree.HasNodeAtTreePath(treePath) {
+			t.Errorf("tree has excluded node %v", treePath)
+		}
+	}
+	album := tree.NodeAtTreePath([]string{"band", "album"})
+	if album == nil || !album.IsDirectory || album.BaseName != "Album" {
+		t.Fatalf("tree has no Band/Album directory: %+v", album)
+	}
+	if len(album.Children) != 3 {
+		t.Errorf("Band/Album has %d children, want 3", len(album.Children))
+	}
+	var musicFiles []string
+	for _, f := range album.MusicFiles() {
+		musicFiles = append(musicFiles, f.BaseName)
+	}
+	if fmt.Sprint(musicFiles) != "[01.mp3 02.MP3]" {
+		t.Errorf("Band/Album music files = %v, want [01.mp3 02.MP3]", musicFiles)
+	}
+
+	mp3 := tree.NodeAtTreePath([]string{"band", "album", "02"})
+	if mp3 == nil {
+		t.Fatalf("tree has no node for Band/Album/02.MP3")
+	}
+	if !mp3.IsMusicFile || mp3.FileBitrate != 128000 || mp3.FileCodec != "mp3" || mp3.FileSize != int64(len("second")) {
+		t.Errorf("Band/Album/02.MP3 = %+v", mp3)
+	}
+	if mp3.FilesystemPath != filepath.Join(root, "Band", "Album", "02.MP3") {
+		t.Errorf("Band/Album/02.MP3 has filesystem path '%s'", mp3.FilesystemPath)
+	}
+	if cover := tree.NodeAtTreePath([]string{"band", "album", "cover.jpg"}); cover == nil || !cover.IsFile || cover.IsMusicFile {
+		t.Errorf("Band/Album/cover.jpg = %+v, want a non-music file", cover)
+	}
+	flac := tree.NodeAtTreePath([]string{"band", "hi-res", "01"})
+	if flac == nil || !flac.FileLossless || flac.FileSampleRate != 96000 || flac.FileBitDepth != 24 {
+		t.Errorf("Band/Hi-Res/01.flac = %+v", flac)
+	}
+
+	// with skipUnprobeable, the unprobeable file is reported, and kept as a non-music file:
+	broken := tree.NodeAtTreePath([]string{"band", "hi-res", "broken"})
+	if broken == nil || broken.IsMusicFile {
+		t.Errorf("Band/Hi-Res/broken.flac = %+v, want a non-music file", broken)
+	}
+	if failures.Len() != 1 || failures.failures[0].Stage != failureStageProbe {
+		t.Errorf("failures = %v, want one probe failure", failures.Lines())
+	}
+}
+
+func TestMakeMusicTreeProbeFailures(t *testing.T) {
+	root := makeTestLibrary(t)
+
+	_, err := MakeMusicTree(context.Background(), root, testProber, false, nil, nil)
+	if !errors.Is(err, audioinfo.ErrUnsupportedFormat) {
+		t.Errorf("MakeMusicTree error = %v, want the prober's error", err)
+	}
+
+	// with -keep-going, the unprobeable file is reported, and kept as a music file with an unknown bitrate:
+	failures := &FailureReport{}
+	tree, err := MakeMusicTree(context.Background(), root, testProber, false, nil, failures)
+	if err != nil {
+		t.Fatalf("MakeMusicTree with a failure report failed: %s", err)
+	}
+	broken := tree.NodeAtTreePath([]string{"band", "hi-res", "broken"})
+	if broken == nil || !broken.IsMusicFile || broken.FileBitrate != 0 {
+		t.Errorf("Band/Hi-Res/broken.flac = %+v, want a music file with an unknown bitrate", broken)
+	}
+	if failures.Len() != 1 || failures.failures[0].Stage != failureStageProbe {
+		t.Errorf("failures = %v, want one probe failure", failures.Lines())
+	}
+	// without a filter, ignore files aren't applied:
+	if !tree.HasNodeAtTreePath([]string{"demos", "01"}) {
+		t.Errorf("tree has no node for Demos/01.mp3")
+	}
+}
+
+func TestMakeMusicTreeProbeErrors(t *testing.T) {
+	root := makeTestLibrary(t)
+	prober := timeoutProber{testProber}
+
+	// even with skipUnprobeable, only files in unsupported formats are treated as non-music files:
+	if _, err := MakeMusicTree(context.Background(), root, prober, true, nil, nil); !errors.Is(err, errProbeTimeout) {
+		t.Errorf("MakeMusicTree error = %v, want the prober's error", err)
+	}
+
+	failures := &FailureReport{}
+	tree, err := MakeMusicTree(context.Background(), root, prober, true, nil, failures)
+	if err != nil {
+		t.Fatalf("MakeMusicTree with a failure report failed: %s", err)
+	}
+	broken := tree.NodeAtTreePath([]string{"band", "hi-res", "broken"})
+	if broken == nil || !broken.IsMusicFile || broken.FileBitrate != 0 {
+		t.Errorf("Band/Hi-Res/broken.flac = %+v, want a music file with an unknown bitrate", broken)
+	}
+	if failures.Len() != 1 || failures.failures[0].Stage != failureStageProbe {
+		t.Errorf("failures = %v, want one probe failure", failures.Lines())
+	}
+}
+
+func TestMakeMusicTreeUnscanned(t *testing.T) {
+	root := makeTestLibrary(t)
+	if err := os.Symlink(filepath.Join(root, "missing.mp3"), filepath.Join(root, "Band", "Album", "03.mp3")); err != nil {
+		t.Skipf("can't create symlinks: %s", err)
+	}
+
+	if _, err := MakeMusicTree(context.Background(), root, testProber, true, nil, nil); err == nil {
+		t.Errorf("MakeMusicTree with a broken symlink succeeded")
+	}
+
+	failures := &FailureReport{}
+	tree, err := MakeMusicTree(context.Background(), root, testProber, true, nil, failures)
+	if err != nil {
+		t.Fatalf("MakeMusicTree with a failure report failed: %s", err)
+	}
+	unscanned := []string{"band", "album", "03"}
+	if tree.HasNodeAtTreePath(unscanned) || !tree.IsUnscanned(unscanned) {
+		t.Errorf("Band/Album/03.mp3 wasn't left out of the tree as unscanned (Unscanned = %v)", tree.Unscanned)
+	}
+	if tree.IsUnscanned([]string{"band", "album", "01"}) {
+		t.Errorf("Band/Album/01.mp3 is unscanned")
+	}
+	if failures.Len() != 2 {
+		t.Errorf("failures = %v, want a scan and a probe failure", failures.Lines())
+	}
+}
+
+func TestMakeMusicTreeCanceled(t *testing.T) {
+	root := makeTestLibrary(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := MakeMusicTree(ctx, root, testProber, true, nil, &FailureReport{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("MakeMusicTree error = %v, want context.Canceled", err)
+	}
+}
+
+// testMP4Box returns an MP4 box of the given type, holding the given payload.
+func testMP4Box(boxType string, payload ...[]byte) []byte {
+	p := bytes.Join(payload, nil)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(8+len(p)))
+	return append(append(size, boxType...), p...)
+}
+
+// testMP4Track returns an enabled MP4 track with the given handler type (eg. "soun") and sample entry type (eg. "mp4a").
+func testMP4Track(handler, entryType string) []byte {
+	tkhd := testMP4Box("tkhd", []byte{0, 0, 0, 1}, make([]byte, 80))
+	hdlr := testMP4Box("hdlr", make([]byte, 8), []byte(handler), make([]byte, 12))
+	stsd := testMP4Box("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, testMP4Box(entryType, make([]byte, 28)))
+	return testMP4Box("trak", tkhd, testMP4Box("mdia", hdlr, testMP4Box("minf", testMP4Box("stbl", stsd))))
+}
+
+func TestIsPlayableMusicFile(t *testing.T) {
+	ftyp := testMP4Box("ftyp", []byte("M4A "), make([]byte, 4))
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"music.m4a", append(ftyp, testMP4Box("moov", testMP4Track("soun", "mp4a"))...), true},
+		{"protected.m4a", append(ftyp, testMP4Box("moov", testMP4Track("soun", "drms"))...), false},
+		{"video.m4a", append(ftyp, testMP4Box("moov", testMP4Track("vide", "avc1"), testMP4Track("soun", "mp4a"))...), false},
+		{"unsniffed.mp3", []byte("not an mp4 file"), true},
+	}
+	root := t.TempDir()
+	for _, tt := range tests {
+		path := writeTestFile(t, root, tt.name, string(tt.data))
+		if got := isPlayableMusicFile(context.Background(), path); got != tt.want {
+			t.Errorf("isPlayableMusicFile('%s') = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"msync/audioinfo"
+	"msync/dzutil"
+)
+
+const probeCacheVersion = 2
+
+// ProbeCache is a persistent, on-disk cache of AudioProber results, and of music files' tags (as read by
+// rules), keyed by file path, size, and modification time. It is safe for concurrent use.
+type ProbeCache struct {
+	path    string
+	prober  string // Name of the AudioProber whose results are cached
+	lock    sync.Mutex
+	entries map[string]*probeCacheEntry
+	tags    map[string]*tagCacheEntry
+	seen    map[string]bool // paths looked up or stored during this run
+}
+
+type probeCacheEntry struct {
+	Size    int64          `json:"size"`
+	ModTime time.Time      `json:"mtime"`
+	Info    audioinfo.Info `json:"info"`
+}
+
+type tagCacheEntry struct {
+	Size    int64          `json:"size"`
+	ModTime time.Time      `json:"mtime"`
+	Tags    audioinfo.Tags `json:"tags"`
+}
+
+type probeCacheFile struct {
+	Version int                         `json:"version"`
+	Prober  string                      `json:"prober"`
+	Entries map[string]*probeCacheEntry `json:"entries"`
+	Tags    map[string]*tagCacheEntry   `json:"tags,omitempty"`
+}
+
+// DefaultProbeCachePath returns the default location for the probe cache, in the user's cache
+// directory. If that directory can't be determined, it returns an empty string.
+func DefaultProbeCachePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "msync", "probe-cache.json")
+}
+
+// LoadProbeCache loads the probe cache stored at the given path. A missing cache file is not an error.
+// proberName is the Name of the AudioProber whose results will be cached; results cached from a different
+// prober are discarded, since backends can disagree about a file's bitrate. If rebuild is true, any existing
+// cache contents are discarded.
+func LoadProbeCache(path string, proberName string, rebuild bool) (*ProbeCache, error) {
+	c := &ProbeCache{
+		path:    path,
+		prober:  proberName,
+		entries: make(map[string]*probeCacheEntry),
+		tags:    make(map[string]*tagCacheEntry),
+		seen:    make(map[string]bool),
+	}
+	if rebuild {
+		return c, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read probe cache '%s': %w", path, err)
+	}
+	var f probeCacheFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse probe cache '%s' (use -rebuild-cache to discard it): %w", path, err)
+	}
+	if f.Version == probeCacheVersion && f.Prober == c.prober && f.Entries != nil {
+		c.entries = f.Entries
+	}
+	if f.Version == probeCacheVersion && f.Tags != nil {
+		c.tags = f.Tags
+	}
+	return c, nil
+}
+
+// Get returns the cached probe result for the given path, iff one exists and the file's size
+// and modification time match those recorded in the cache.
+func (c *ProbeCache) Get(path string, size int64, modTime time.Time) (*audioinfo.Info, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seen[path] = true
+	e, ok := c.entries[path]
+	if !ok || e.Size != size || !e.ModTime.Equal(modTime) {
+		return nil, false
+	}
+	info := e.Info
+	return &info, true
+}
+
+// Put stores the given probe result for the given path.
+func (c *ProbeCache) Put(path string, size int64, modTime time.Time, info *audioinfo.Info) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seen[path] = true
+	c.entries[path] = &probeCacheEntry{
+		Size:    size,
+		ModTime: modTime,
+		Info:    *info,
+	}
+}
+
+// ReadTags returns the tags of the music file at the given path, from the cache if they're cached and the
+// file's size and modification time match; and otherwise by reading them with audioinfo.ReadTags, and
+// storing them in the cache. It's a TagReader.
+func (c *ProbeCache) ReadTags(path string) (audioinfo.Tags, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.seen[path] = true
+	e, ok := c.tags[path]
+	c.lock.Unlock()
+	if ok && e.Size == stat.Size() && e.ModTime.Equal(stat.ModTime()) {
+		return e.Tags, nil
+	}
+	tags, err := audioinfo.ReadTags(path)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tags[path] = &tagCacheEntry{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Tags:    tags,
+	}
+	return tags, nil
+}
+
+// Save prunes entries for files that no longer exist, then writes the cache to disk.
+// It returns the number of entries pruned.
+func (c *ProbeCache) Save() (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pruned := 0
+	for path := range c.entries {
+		if c.seen[path] {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(c.entries, path)
+			pruned++
+		}
+	}
+	for path := range c.tags {
+		if c.seen[path] {
+			continue
+		}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(c.tags, path)
+		}
+	}
+
+	raw, err := json.Marshal(probeCacheFile{
+		Version: probeCacheVersion,
+		Prober:  c.prober,
+		Entries: c.entries,
+		Tags:    c.tags,
+	})
+	if err != nil {
+		return pruned, err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return pruned, fmt.Errorf("failed to create probe cache directory: %w", err)
+	}
+	if err := dzutil.WriteFileAtomic(c.path, raw, 0644); err != nil {
+		return pruned, fmt.Errorf("failed to write probe cache: %w", err)
+	}
+	return pruned, nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *ProbeCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// cachingProber wraps another AudioProber, consulting a ProbeCache before probing any file.
+type cachingProber struct {
+	inner AudioProber
+	cache *ProbeCache
+}
+
+// NewCachingProber returns an AudioProber which returns results from the given cache where
+// possible, and otherwise uses the given prober and stores its results in the cache.
+func NewCachingProber(inner AudioProber, cache *ProbeCache) AudioProber {
+	return cachingProber{inner: inner, cache: cache}
+}
+
+func (p cachingProber) Name() string {
+	return p.inner.Name()
+}
+
+func (p cachingProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat '%s': %w", path, err)
+	}
+	if info, ok := p.cache.Get(path, stat.Size(), stat.ModTime()); ok {
+		return info, nil
+	}
+	info, err := p.inner.Probe(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.Put(path, stat.Size(), stat.ModTime(), info)
+	return info, nil
+}
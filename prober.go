@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"msync/audioinfo"
+)
+
+// AudioProber determines the properties of the audio stream in a music file.
+type AudioProber interface {
+	// Name returns the name of this prober, as given to the -prober flag.
+	Name() string
+	// Probe returns information about the audio stream in the file at the given path.
+	// At minimum, the returned Info's Bitrate is populated. Probers which run external commands kill them if ctx is done.
+	// The returned error wraps audioinfo.ErrUnsupportedFormat iff the file's format or codec isn't supported.
+	Probe(ctx context.Context, path string) (*audioinfo.Info, error)
+}
+
+// NewAudioProber returns the AudioProber described by the given comma-separated list of backend
+// names (see -prober). If more than one backend is given, the returned prober tries each in order.
+// Backends which run external commands kill them if they run for longer than timeout (unless it's 0).
+func NewAudioProber(spec string, timeout time.Duration) (AudioProber, error) {
+	var probers []AudioProber
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		var p AudioProber
+		var err error
+		switch name {
+		case "native":
+			p = nativeProber{}
+		case "afinfo":
+			p, err = newAfinfoProber(timeout)
+		case "ffprobe":
+			p = ffprobeProber{timeout: timeout}
+		default:
+			err = fmt.Errorf("unknown prober '%s' (must be one of: native, afinfo, ffprobe)", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		probers = append(probers, p)
+	}
+	if len(probers) == 1 {
+		return probers[0], nil
+	}
+	return chainProber(probers), nil
+}
+
+// nativeProber reads audio properties directly from file headers, using the audioinfo package.
+type nativeProber struct{}
+
+func (nativeProber) Name() string {
+	return "native"
+}
+
+func (nativeProber) Probe(_ context.Context, path string) (*audioinfo.Info, error) {
+	return audioinfo.Read(path)
+}
+
+// chainProber tries each of its probers in order, returning the first successful result.
+type chainProber []AudioProber
+
+func (c chainProber) Name() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Probe returns the first successful result. If every prober fails, the returned error only wraps
+// audioinfo.ErrUnsupportedFormat if every prober found the file's format unsupported.
+func (c chainProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	var errs []string
+	unsupported := true
+	for _, p := range c {
+		info, err := p.Probe(ctx, path)
+		if err == nil {
+			return info, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if *verboseFlag {
+			log.Printf("%s could not probe '%s': %s", p.Name(), path, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", p.Name(), err))
+		unsupported = unsupported && errors.Is(err, audioinfo.ErrUnsupportedFormat)
+	}
+	if unsupported {
+		return nil, fmt.Errorf("%w: all probers failed for '%s' (%s)", audioinfo.ErrUnsupportedFormat, path, strings.Join(errs, "; "))
+	}
+	return nil, fmt.Errorf("all probers failed for '%s' (%s)", path, strings.Join(errs, "; "))
+}
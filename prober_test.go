@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"msync/audioinfo"
+)
+
+func TestChainProber(t *testing.T) {
+	ctx := context.Background()
+	chain := chainProber{fakeProber{}, testProber}
+	if info, err := chain.Probe(ctx, "01.mp3"); err != nil || info.Bitrate != 320000 {
+		t.Errorf("Probe = %+v, %v; want the second prober's result", info, err)
+	}
+	if _, err := chain.Probe(ctx, "03.mp3"); !errors.Is(err, audioinfo.ErrUnsupportedFormat) {
+		t.Errorf("Probe error = %v, want ErrUnsupportedFormat when no prober supports the file", err)
+	}
+
+	chain = chainProber{testProber, timeoutProber{testProber}}
+	_, err := chain.Probe(ctx, "broken.flac")
+	if err == nil || errors.Is(err, audioinfo.ErrUnsupportedFormat) {
+		t.Errorf("Probe error = %v, want an error other than ErrUnsupportedFormat when a prober fails otherwise", err)
+	}
+}
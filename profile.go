@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// codecSpec describes an ffmpeg audio encoder msync can transcode with.
+type codecSpec struct {
+	ext           string   // file extension (including the leading dot) for the output container
+	probedCodec   string   // the codec name probers report for this encoder's output (see audioinfo.Info)
+	toleranceKbps int      // how far, in Kbps, the encoder's output may stray from the requested bitrate
+	extraArgs     []string // additional ffmpeg output options needed for this codec/container
+	minQuality    float64  // lowest valid value for the encoder's -q:a option
+	maxQuality    float64  // highest valid value for the encoder's -q:a option; 0 if the encoder has no quality-based VBR mode
+	lossless      bool     // whether the encoder is lossless; lossless encoders take no bitrate or quality options
+	sampleFmts    []string // for lossless encoders, the ffmpeg sample formats to use for 16- and 24-bit output, respectively
+}
+
+// codecs maps ffmpeg encoder names to their specs.
+//
+// ffmpeg's aac encoder produces files a little bit above the target bitrate, and the Opus and Vorbis
+// encoders are VBR even when given a target bitrate. Their tolerances allow for this, which mostly
+// avoids deleting & re-transcoding the same files over and over across multiple runs with the same
+// configuration.
+//
+// Quality scales differ per encoder: for libmp3lame, -q:a 2 is LAME's -V2 (lower is better);
+// for libvorbis and aac, higher is better. libopus has no quality scale; it's always VBR.
+//
+// The lossless encoders (alac and flac) are meant for destinations which should stay lossless, but
+// with a limited sample rate and/or bit depth (see EncodingProfile.MaxSampleRate and MaxBitDepth).
+var codecs = map[string]codecSpec{
+	"aac":        {ext: ".m4a", probedCodec: "aac", toleranceKbps: 5, minQuality: 0.1, maxQuality: 2},
+	"alac":       {ext: ".m4a", probedCodec: "alac", lossless: true, sampleFmts: []string{"s16p", "s32p"}},
+	"flac":       {ext: ".flac", probedCodec: "flac", lossless: true, sampleFmts: []string{"s16", "s32"}},
+	"libmp3lame": {ext: ".mp3", probedCodec: "mp3", toleranceKbps: 2, extraArgs: []string{"-id3v2_version", "3"}, minQuality: 0, maxQuality: 9},
+	"libopus":    {ext: ".opus", probedCodec: "opus", toleranceKbps: 16},
+	"libvorbis":  {ext: ".ogg", probedCodec: "vorbis", toleranceKbps: 16, minQuality: -1, maxQuality: 10},
+}
+
+const (
+	// policyBitrate transcodes music files whose bitrate exceeds the profile's maximum.
+	policyBitrate = "bitrate"
+	// policyLossless transcodes all lossless music files, plus lossy files whose bitrate exceeds the profile's maximum.
+	policyLossless = "lossless"
+	// policyLosslessOnly transcodes all lossless music files, and never re-encodes lossy files.
+	policyLosslessOnly = "lossless-only"
+	// policyCopy never transcodes; music files are copied as-is.
+	policyCopy = "copy"
+)
+
+const (
+	// channelsKeep keeps source files' channel layouts when transcoding.
+	channelsKeep = "keep"
+	// channelsStereo downmixes source files with more than two channels to stereo.
+	channelsStereo = "stereo"
+	// channelsMono downmixes source files to mono.
+	channelsMono = "mono"
+)
+
+// ditherMethod is the dither used by ffmpeg's aresample filter when reducing bit depth.
+const ditherMethod = "triangular"
+
+// vbrDefaultMaxFactor is multiplied by BitrateKbps to determine the highest bitrate accepted for
+// destination files in quality-based VBR mode, if no explicit limit is given.
+const vbrDefaultMaxFactor = 1.5
+
+// codecNames returns the names of all supported codecs, sorted.
+func codecNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EncodingProfile describes the settings used to transcode music files for the destination.
+//
+// In bitrate mode (the default), files are transcoded at BitrateKbps. In quality-based VBR mode (iff
+// Quality is set), files are transcoded at the given encoder quality level instead; BitrateKbps still
+// determines which source files need transcoding, and VBRMaxKbps determines which destination files
+// are acceptable.
+//
+// If MaxSampleRate or MaxBitDepth are set, transcodes are resampled (with dithering, when reducing bit
+// depth) to fit within them. With a lossless codec, lossless source files are transcoded only if they
+// exceed these limits (or, under the lossless policies, if they aren't already in that codec), and
+// lossy files are always copied as-is.
+type EncodingProfile struct {
+	Policy      string // which files are transcoded; one of the policy* constants
+	Codec       string // ffmpeg audio encoder name; a key of codecs
+	BitrateKbps int    // target bitrate, in Kbps
+	Quality     string // encoder-specific VBR quality level, passed to ffmpeg's -q:a; empty for bitrate mode
+	VBRMaxKbps  int    // in VBR mode, the highest bitrate, in Kbps, accepted for destination files; 0 for the default
+
+	MaxSampleRate int // highest sample rate, in Hz, for transcoded files; 0 for no limit
+	MaxBitDepth   int // highest bit depth (16 or 24) for lossless files in the destination; 0 for no limit
+
+	Loudness       string  // loudness normalization mode for transcoded files; one of the loudness* constants
+	LoudnessApply  bool    // if set, normalization gain is applied to the audio; otherwise it's written as ReplayGain tags
+	LoudnessTarget float64 // target loudness, in LUFS
+
+	CoverArt        string // how embedded cover art is handled when transcoding; one of the coverArt* constants
+	CoverArtMaxSize int    // in resize and extract modes, the maximum width/height, in pixels, of cover art; 0 for no limit
+	CoverArtQuality int    // in resize and extract modes, the JPEG quality of cover art, on ffmpeg's -q:v scale (2-31; lower is better)
+
+	Channels string // channel layout of transcoded files; one of the channels* constants
+}
+
+// Validate returns an error if this profile's settings are not supported.
+func (p EncodingProfile) Validate() error {
+	switch p.Policy {
+	case policyBitrate, policyLossless, policyLosslessOnly, policyCopy:
+	default:
+		return fmt.Errorf("unsupported transcode policy '%s' (must be one of: %s, %s, %s, %s)", p.Policy, policyBitrate, policyLossless, policyLosslessOnly, policyCopy)
+	}
+	if _, ok := codecs[p.Codec]; !ok {
+		return fmt.Errorf("unsupported codec '%s' (must be one of: %s)", p.Codec, strings.Join(codecNames(), ", "))
+	}
+	if p.BitrateKbps <= 0 {
+		return fmt.Errorf("bitrate must be positive (got %d Kbps)", p.BitrateKbps)
+	}
+	if p.MaxSampleRate < 0 || (p.MaxSampleRate > 0 && p.MaxSampleRate < 8000) {
+		return fmt.Errorf("maximum sample rate must be at least 8000 Hz (got %d)", p.MaxSampleRate)
+	}
+	switch p.MaxBitDepth {
+	case 0:
+	case 16, 24:
+		if !codecs[p.Codec].lossless {
+			return fmt.Errorf("a maximum bit depth requires a lossless codec (alac or flac); got '%s'", p.Codec)
+		}
+	default:
+		return fmt.Errorf("maximum bit depth must be 16 or 24 (got %d)", p.MaxBitDepth)
+	}
+	switch p.Loudness {
+	case loudnessOff, loudnessTrack, loudnessAlbum:
+	default:
+		return fmt.Errorf("unsupported loudness mode '%s' (must be one of: %s, %s, %s)", p.Loudness, loudnessOff, loudnessTrack, loudnessAlbum)
+	}
+	if p.LoudnessTarget < -70 || p.LoudnessTarget > 0 {
+		return fmt.Errorf("loudness target must be from -70 to 0 LUFS (got %g)", p.LoudnessTarget)
+	}
+	switch p.Channels {
+	case channelsKeep, channelsStereo, channelsMono:
+	default:
+		return fmt.Errorf("unsupported channel layout '%s' (must be one of: %s, %s, %s)", p.Channels, channelsKeep, channelsStereo, channelsMono)
+	}
+	switch p.CoverArt {
+	case coverArtKeep, coverArtStrip:
+	case coverArtResize, coverArtExtract:
+		if p.CoverArtMaxSize < 0 || (p.CoverArt == coverArtResize && p.CoverArtMaxSize == 0) {
+			return fmt.Errorf("maximum cover art size must be positive (got %d)", p.CoverArtMaxSize)
+		}
+		if p.CoverArtQuality < 2 || p.CoverArtQuality > 31 {
+			return fmt.Errorf("cover art quality must be from 2 to 31 (got %d)", p.CoverArtQuality)
+		}
+	default:
+		return fmt.Errorf("unsupported cover art policy '%s' (must be one of: %s, %s, %s, %s)", p.CoverArt, coverArtKeep, coverArtResize, coverArtStrip, coverArtExtract)
+	}
+	if p.Quality != "" {
+		spec := codecs[p.Codec]
+		if spec.maxQuality == 0 {
+			return fmt.Errorf("codec '%s' has no quality-based VBR mode", p.Codec)
+		}
+		q, err := strconv.ParseFloat(p.Quality, 64)
+		if err != nil || q < spec.minQuality || q > spec.maxQuality {
+			return fmt.Errorf("quality for codec '%s' must be a number from %g to %g (got '%s')", p.Codec, spec.minQuality, spec.maxQuality, p.Quality)
+		}
+	}
+	return nil
+}
+
+// IsVBR returns true iff this profile uses quality-based VBR mode.
+func (p EncodingProfile) IsVBR() bool {
+	return p.Quality != ""
+}
+
+// IsLossless returns true iff this profile's codec is lossless.
+func (p EncodingProfile) IsLossless() bool {
+	return codecs[p.Codec].lossless
+}
+
+// ProbedCodec returns the codec name probers report for files transcoded with this profile.
+func (p EncodingProfile) ProbedCodec() string {
+	return codecs[p.Codec].probedCodec
+}
+
+// Ext returns the file extension (including the leading dot) for files transcoded with this profile.
+func (p EncodingProfile) Ext() string {
+	return codecs[p.Codec].ext
+}
+
+// ExpectedBitrate returns the bitrate, in bits per second, that the given source file is expected to
+// have once transcoded with this profile. This is used to estimate sizes. In VBR mode, this is only a
+// rough guess; with a lossless codec, it's scaled down from the source's bitrate.
+func (p EncodingProfile) ExpectedBitrate(source *MusicTreeNode) int {
+	if p.IsLossless() {
+		bitrate := float64(source.FileBitrate)
+		if rate := p.outputSampleRate(source); rate > 0 && source.FileSampleRate > 0 {
+			bitrate *= float64(rate) / float64(source.FileSampleRate)
+		}
+		if depth := p.outputBitDepth(source); depth > 0 && source.FileBitDepth > 0 {
+			bitrate *= float64(depth) / float64(source.FileBitDepth)
+		}
+		if channels := p.outputChannels(source); channels > 0 && source.FileChannels > 0 {
+			bitrate *= float64(channels) / float64(source.FileChannels)
+		}
+		return int(bitrate)
+	}
+	if p.IsVBR() {
+		return p.BitrateKbps * 1000
+	}
+	return (p.BitrateKbps - codecs[p.Codec].toleranceKbps) * 1000
+}
+
+// TranscodeThreshold returns the bitrate, in bits per second, above which source files need transcoding.
+func (p EncodingProfile) TranscodeThreshold() int {
+	return (p.BitrateKbps + codecs[p.Codec].toleranceKbps) * 1000
+}
+
+// MaxAcceptableBitrate returns the highest bitrate, in bits per second, that a destination music file
+// transcoded by msync may have and still be considered to meet this profile. In VBR mode, this allows for
+// outputs whose average bitrate wanders above BitrateKbps.
+func (p EncodingProfile) MaxAcceptableBitrate() int {
+	if !p.IsVBR() {
+		return p.TranscodeThreshold()
+	}
+	if p.VBRMaxKbps > 0 {
+		return p.VBRMaxKbps * 1000
+	}
+	return int(float64(p.BitrateKbps) * vbrDefaultMaxFactor * 1000)
+}
+
+// exceedsFormatLimits returns true iff the given music file's sample rate, bit depth, or channel count
+// is above this profile's limits.
+func (p EncodingProfile) exceedsFormatLimits(n *MusicTreeNode) bool {
+	return (p.MaxSampleRate > 0 && n.FileSampleRate > p.MaxSampleRate) || (p.MaxBitDepth > 0 && n.FileBitDepth > p.MaxBitDepth) || p.exceedsChannels(n)
+}
+
+// maxChannels returns the highest number of channels allowed by this profile's channel layout, or 0 for no limit.
+func (p EncodingProfile) maxChannels() int {
+	switch p.Channels {
+	case channelsMono:
+		return 1
+	case channelsStereo:
+		return 2
+	}
+	return 0
+}
+
+// exceedsChannels returns true iff the given music file has more channels than this profile allows.
+func (p EncodingProfile) exceedsChannels(n *MusicTreeNode) bool {
+	return p.maxChannels() > 0 && n.FileChannels > p.maxChannels()
+}
+
+// outputChannels returns the number of channels the given source file will be downmixed to when
+// transcoding, or 0 if it won't be downmixed.
+func (p EncodingProfile) outputChannels(source *MusicTreeNode) int {
+	max := p.maxChannels()
+	if max > 0 && (source.FileChannels > max || (source.FileChannels == 0 && max == 1)) {
+		return max
+	}
+	return 0
+}
+
+// outputSampleRate returns the sample rate the given source file will be resampled to when transcoding,
+// or 0 if it won't be resampled.
+func (p EncodingProfile) outputSampleRate(source *MusicTreeNode) int {
+	if p.MaxSampleRate > 0 && source.FileSampleRate > p.MaxSampleRate {
+		return p.MaxSampleRate
+	}
+	return 0
+}
+
+// outputBitDepth returns the bit depth the given source file will have when transcoded with a lossless
+// codec, or 0 if that's unknown or not applicable.
+func (p EncodingProfile) outputBitDepth(source *MusicTreeNode) int {
+	if !p.IsLossless() || source.FileBitDepth <= 0 {
+		return 0
+	}
+	if p.MaxBitDepth > 0 && source.FileBitDepth > p.MaxBitDepth {
+		return p.MaxBitDepth
+	}
+	return source.FileBitDepth
+}
+
+// NeedsTranscode returns true iff the given source music file must be transcoded, rather than
+// copied as-is, under this profile's policy.
+func (p EncodingProfile) NeedsTranscode(n *MusicTreeNode) bool {
+	if p.Policy == policyCopy {
+		return false
+	}
+	if p.IsLossless() {
+		if !n.FileLossless {
+			return false
+		}
+		return p.exceedsFormatLimits(n) || (p.Policy != policyBitrate && n.FileCodec != p.ProbedCodec())
+	}
+	if p.Policy != policyBitrate && n.FileLossless {
+		return true
+	}
+	if p.Policy == policyLosslessOnly {
+		// lossy files aren't transcoded for their bitrate, but still are to downmix them:
+		return p.exceedsChannels(n)
+	}
+	return n.FileBitrate > p.TranscodeThreshold() || p.exceedsChannels(n)
+}
+
+// AcceptsDestFile returns true iff the given destination music file meets this profile's policy.
+// Files which don't are removed from the destination, so they can be replaced with a transcode.
+func (p EncodingProfile) AcceptsDestFile(n *MusicTreeNode) bool {
+	if p.Policy == policyCopy {
+		return true
+	}
+	if p.IsLossless() {
+		if !n.FileLossless {
+			return true
+		}
+		return !p.exceedsFormatLimits(n) && (p.Policy == policyBitrate || n.FileCodec == p.ProbedCodec())
+	}
+	if p.Policy != policyBitrate && n.FileLossless {
+		return false
+	}
+	if p.Policy == policyLosslessOnly {
+		return !p.exceedsChannels(n)
+	}
+	// only files msync transcoded get the VBR allowance; copies are held to the threshold their source was:
+	maxBitrate := p.TranscodeThreshold()
+	if n.SyncState != nil && n.SyncState.Operation == syncOpTranscode {
+		maxBitrate = p.MaxAcceptableBitrate()
+	}
+	return n.FileBitrate <= maxBitrate && !p.exceedsChannels(n)
+}
+
+// DescribePolicy returns a short human-readable description of which files meet this profile's policy.
+func (p EncodingProfile) DescribePolicy() string {
+	if p.Policy == policyCopy {
+		return "no transcoding"
+	}
+	if p.IsLossless() {
+		var limits []string
+		if p.MaxSampleRate > 0 {
+			limits = append(limits, fmt.Sprintf("max. %d Hz", p.MaxSampleRate))
+		}
+		if p.MaxBitDepth > 0 {
+			limits = append(limits, fmt.Sprintf("max. %d-bit", p.MaxBitDepth))
+		}
+		if p.Policy != policyBitrate {
+			limits = append(limits, "lossless files as "+p.ProbedCodec())
+		}
+		if len(limits) == 0 {
+			return "lossless files as-is"
+		}
+		return strings.Join(limits, ", ")
+	}
+	maxKbps := p.MaxAcceptableBitrate() / 1000
+	if !p.IsVBR() {
+		maxKbps = p.BitrateKbps
+	}
+	switch p.Policy {
+	case policyLossless:
+		return fmt.Sprintf("no lossless files; max. %d Kbps", maxKbps)
+	case policyLosslessOnly:
+		return "no lossless files"
+	default:
+		return fmt.Sprintf("max. %d Kbps", maxKbps)
+	}
+}
+
+// NormalizesLoudness returns true iff this profile normalizes the loudness of transcoded files.
+func (p EncodingProfile) NormalizesLoudness() bool {
+	return p.Loudness != loudnessOff
+}
+
+// FFmpegArgs returns the ffmpeg output options for transcoding the given source file with this
+// profile's encoder and settings. If this profile normalizes loudness, gain must describe the source
+// file's ReplayGain values; otherwise it's ignored and may be nil.
+func (p EncodingProfile) FFmpegArgs(source *MusicTreeNode, gain *replayGain) []string {
+	args := p.encoderArgs()
+
+	var filters []string
+	if p.NormalizesLoudness() && p.LoudnessApply {
+		filters = append(filters, fmt.Sprintf("volume=%.2fdB", gain.ClippingSafeGain()))
+	}
+	var resampleOpts []string
+	if rate := p.outputSampleRate(source); rate > 0 {
+		resampleOpts = append(resampleOpts, "osr="+strconv.Itoa(rate))
+	}
+	depth := p.outputBitDepth(source)
+	if depth > 0 && depth < source.FileBitDepth {
+		sampleFmt := codecs[p.Codec].sampleFmts[0]
+		if depth > 16 {
+			sampleFmt = codecs[p.Codec].sampleFmts[1]
+		}
+		resampleOpts = append(resampleOpts, "osf="+sampleFmt, "dither_method="+ditherMethod)
+	}
+	if len(resampleOpts) > 0 {
+		filters = append(filters, "aresample="+strings.Join(resampleOpts, ":"))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-af", strings.Join(filters, ","))
+	}
+	if channels := p.outputChannels(source); channels > 0 {
+		args = append(args, "-ac", strconv.Itoa(channels))
+	}
+	if depth > 16 {
+		// 24-bit samples are carried in 32-bit sample formats; this tells the encoder how many bits are real:
+		args = append(args, "-bits_per_raw_sample", strconv.Itoa(depth))
+	}
+
+	if p.NormalizesLoudness() && !p.LoudnessApply {
+		tags := replayGainTags(gain, p.LoudnessTarget, p.Ext())
+		keys := make([]string, 0, len(tags))
+		for k := range tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			args = append(args, "-metadata", k+"="+tags[k])
+		}
+		if p.Ext() == ".m4a" {
+			// ffmpeg's MP4 muxer drops tags it doesn't know about, otherwise:
+			args = append(args, "-movflags", "+use_metadata_tags")
+		}
+	}
+	return args
+}
+
+// encoderArgs returns the ffmpeg output options which select this profile's encoder and its settings,
+// independent of any particular source file.
+func (p EncodingProfile) encoderArgs() []string {
+	args := []string{"-c:a", p.Codec}
+	if p.IsLossless() {
+		return append(args, codecs[p.Codec].extraArgs...)
+	}
+	if p.IsVBR() {
+		args = append(args, "-q:a", p.Quality)
+	} else {
+		args = append(args, "-b:a", strconv.Itoa(p.BitrateKbps)+"k")
+	}
+	return append(args, codecs[p.Codec].extraArgs...)
+}
+
+// ID returns a string uniquely identifying this profile's encoder settings. It's recorded in the
+// sync state for each transcoded file, so files produced with outdated settings can be found later.
+func (p EncodingProfile) ID() string {
+	if p.Policy == policyCopy {
+		return policyCopy // nothing is transcoded, so any transcoded file is outdated
+	}
+	id := strings.Join(p.encoderArgs(), " ")
+	if p.MaxSampleRate > 0 {
+		id += " max-sample-rate=" + strconv.Itoa(p.MaxSampleRate)
+	}
+	if p.MaxBitDepth > 0 {
+		id += " max-bit-depth=" + strconv.Itoa(p.MaxBitDepth)
+	}
+	switch p.CoverArt {
+	case coverArtResize:
+		id += fmt.Sprintf(" cover-art=%s:%d:%d", p.CoverArt, p.CoverArtMaxSize, p.CoverArtQuality)
+	case coverArtStrip, coverArtExtract:
+		id += " cover-art=" + p.CoverArt
+	}
+	if p.Channels != channelsKeep {
+		id += " channels=" + p.Channels
+	}
+	if p.NormalizesLoudness() {
+		id += fmt.Sprintf(" loudness=%s:%g", p.Loudness, p.LoudnessTarget)
+		if p.LoudnessApply {
+			id += ":apply"
+		}
+	}
+	return id
+}
+
+// String returns a short human-readable description of this profile.
+func (p EncodingProfile) String() string {
+	s := p.Codec
+	if p.IsVBR() {
+		s += " q" + p.Quality
+	} else if !p.IsLossless() {
+		s += " " + strconv.Itoa(p.BitrateKbps) + "k"
+	}
+	if p.Channels != channelsKeep {
+		s += " " + p.Channels
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"msync/audioinfo"
+)
+
+// TagReader reads the tags of the music file at the given path; see audioinfo.ReadTags and ProbeCache.ReadTags.
+type TagReader func(path string) (audioinfo.Tags, error)
+
+// channelRule sets the channel layout for source music files whose paths match a glob (see -channels-for).
+type channelRule struct {
+	pattern  string
+	channels string
+}
+
+// profileSelection is the outcome of selecting a profile for a source music file.
+type profileSelection struct {
+	profile EncodingProfile
+	rule    *Rule // the rule which matched the file, if any
+}
+
+// Skip returns true iff the file should be left out of the destination.
+func (s profileSelection) Skip() bool {
+	return s.rule != nil && s.rule.Action == ruleActionSkip
+}
+
+// Describe returns a short human-readable description of the selection, for log messages.
+func (s profileSelection) Describe() string {
+	if s.rule == nil {
+		return s.profile.String()
+	}
+	return fmt.Sprintf("%s (rule '%s')", s.profile, s.rule.Name)
+}
+
+// ProfileSelector picks the encoding profile for each source music file, starting from a base profile
+// and applying the first rule (see LoadRules) whose conditions match the file, followed by any -channels-for
+// rules matching its path (relative to the source root). It's safe for concurrent use.
+type ProfileSelector struct {
+	base           EncodingProfile
+	sourceRootPath string
+	rules          []*Rule
+	readTags       TagReader
+	channelRules   []channelRule
+	matches        *ruleMatches // shared by selectors derived from one another via WithBase
+}
+
+// ruleMatches caches the rule matching each source file (by path), since matching may require reading tags.
+type ruleMatches struct {
+	lock     sync.Mutex
+	bySource map[string]*Rule // nil if no rule matched
+}
+
+// NewProfileSelector returns a ProfileSelector for the given base profile, rules, and -channels-for
+// rules, each of the form "PATTERN=LAYOUT". Later -channels-for rules take precedence over earlier ones.
+// Tags, for rules which match on them, are read with the given TagReader.
+func NewProfileSelector(base EncodingProfile, sourceRootPath string, rules []*Rule, channelRuleSpecs []string, readTags TagReader) (*ProfileSelector, error) {
+	s := &ProfileSelector{
+		base:           base,
+		sourceRootPath: sourceRootPath,
+		rules:          rules,
+		readTags:       readTags,
+		matches:        &ruleMatches{bySource: make(map[string]*Rule)},
+	}
+	for _, spec := range channelRuleSpecs {
+		idx := strings.LastIndex(spec, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("-channels-for must be given as PATTERN=LAYOUT (got '%s')", spec)
+		}
+		rule := channelRule{pattern: spec[:idx], channels: spec[idx+1:]}
+		if err := validatePathGlob(rule.pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern '%s': %w", rule.pattern, err)
+		}
+		profile := base
+		profile.Channels = rule.channels
+		if err := profile.Validate(); err != nil {
+			return nil, err
+		}
+		s.channelRules = append(s.channelRules, rule)
+	}
+	return s, nil
+}
+
+// WithBase returns a ProfileSelector with the same rules as this one, but the given base profile.
+// The two selectors share their cache of rule matches.
+func (s *ProfileSelector) WithBase(base EncodingProfile) *ProfileSelector {
+	derived := *s
+	derived.base = base
+	return &derived
+}
+
+// Base returns the profile used for files no rule matches.
+func (s *ProfileSelector) Base() EncodingProfile {
+	return s.base
+}
+
+// HasRules returns true iff any rules were loaded.
+func (s *ProfileSelector) HasRules() bool {
+	return len(s.rules) > 0
+}
+
+// For returns the profile for the given source music file. If source is nil, the base profile is returned.
+func (s *ProfileSelector) For(source *MusicTreeNode) EncodingProfile {
+	return s.Select(source).profile
+}
+
+// Select matches the given source music file against the rules. If source is nil, the base profile is selected.
+func (s *ProfileSelector) Select(source *MusicTreeNode) profileSelection {
+	if source == nil {
+		return profileSelection{profile: s.base}
+	}
+	relPath := filepath.ToSlash(relativePath(s.sourceRootPath, source.FilesystemPath))
+	selection := profileSelection{profile: s.base, rule: s.match(source, relPath)}
+	if selection.rule != nil {
+		selection.profile = selection.rule.Apply(s.base)
+	}
+	for i := len(s.channelRules) - 1; i >= 0; i-- {
+		if matchPathGlob(s.channelRules[i].pattern, relPath) {
+			selection.profile.Channels = s.channelRules[i].channels
+			break
+		}
+	}
+	return selection
+}
+
+// match returns the first rule matching the given source music file, or nil.
+func (s *ProfileSelector) match(source *MusicTreeNode, relPath string) *Rule {
+	s.matches.lock.Lock()
+	rule, ok := s.matches.bySource[source.FilesystemPath]
+	s.matches.lock.Unlock()
+	if ok {
+		return rule
+	}
+
+	var tags audioinfo.Tags
+	tagsRead := false
+	for _, candidate := range s.rules {
+		if candidate.NeedsTags() && !tagsRead {
+			tagsRead = true
+			var err error
+			if tags, err = s.readTags(source.FilesystemPath); err != nil && *verboseFlag {
+				log.Printf("could not read tags from '%s': %s", source.FilesystemPath, err)
+			}
+		}
+		if candidate.Matches(relPath, tags) {
+			rule = candidate
+			break
+		}
+	}
+
+	s.matches.lock.Lock()
+	s.matches.bySource[source.FilesystemPath] = rule
+	s.matches.lock.Unlock()
+	return rule
+}
+
+// ReadTags reads the tags of the music file at the given path, with the selector's TagReader.
+func (s *ProfileSelector) ReadTags(path string) (audioinfo.Tags, error) {
+	return s.readTags(path)
+}
+
+// SetBaseBitrate changes the bitrate of the base profile (see -max-size-min-kbps). Files matching rules
+// which set their own bitrate are unaffected. It must not be called concurrently with other methods.
+func (s *ProfileSelector) SetBaseBitrate(kbps int) {
+	s.base.BitrateKbps = kbps
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"msync/audioinfo"
+)
+
+func TestProfileSelectorChannelRules(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "music")
+	base := testProfile(policyBitrate, "aac", 256, channelsStereo)
+	s, err := NewProfileSelector(base, root, nil, []string{"Audiobooks=mono", "Audiobooks/Radio Plays=keep"}, nil)
+	if err != nil {
+		t.Fatalf("NewProfileSelector failed: %s", err)
+	}
+	tests := map[string]string{
+		"Band/Album/01.flac":                  channelsStereo,
+		"Audiobooks/Book/01.mp3":              channelsMono,
+		"Audiobooks/Radio Plays/Play/01.flac": channelsKeep,
+	}
+	for relPath, want := range tests {
+		source := &MusicTreeNode{FilesystemPath: filepath.Join(root, filepath.FromSlash(relPath))}
+		if got := s.For(source).Channels; got != want {
+			t.Errorf("channels for '%s' = %s, want %s", relPath, got, want)
+		}
+	}
+	if got := s.For(nil); got != base {
+		t.Errorf("For(nil) = %+v, want the base profile", got)
+	}
+
+	for _, spec := range []string{"Audiobooks", "=mono", "Audiobooks=quad", "[Audiobooks=mono"} {
+		if _, err := NewProfileSelector(base, root, nil, []string{spec}, nil); err == nil {
+			t.Errorf("NewProfileSelector succeeded with -channels-for '%s'", spec)
+		}
+	}
+}
+
+func TestProfileSelectorRules(t *testing.T) {
+	root := filepath.Join(string(filepath.Separator), "music")
+	base := testProfile(policyBitrate, "aac", 256, channelsKeep)
+	mono := channelsMono
+	rules := []*Rule{
+		{Name: "books", Match: RuleMatch{Path: "Audiobooks"}, Action: ruleActionTranscode, Profile: RuleProfile{Channels: &mono}},
+		{Name: "demos", Match: RuleMatch{Path: "*/Demos"}, Action: ruleActionSkip},
+		{Name: "classical", Match: RuleMatch{Genre: "*classical*"}, Action: ruleActionCopy},
+		{Name: "hi-res", Match: RuleMatch{Path: "*.flac"}, Action: ruleActionCopy},
+	}
+	tagsRead := 0
+	readTags := func(path string) (audioinfo.Tags, error) {
+		tagsRead++
+		if strings.Contains(path, "Classical") {
+			return audioinfo.Tags{audioinfo.TagGenre: {"Classical"}}, nil
+		}
+		return nil, errors.New("no tags")
+	}
+	s, err := NewProfileSelector(base, root, rules, []string{"Audiobooks/Radio Plays=stereo"}, readTags)
+	if err != nil {
+		t.Fatalf("NewProfileSelector failed: %s", err)
+	}
+	tests := []struct {
+		relPath      string
+		wantRule     string
+		wantPolicy   string
+		wantChannels string
+	}{
+		{"Band/Album/01.mp3", "", policyBitrate, channelsKeep},
+		{"Audiobooks/Book/01.mp3", "books", policyBitrate, channelsMono},
+		{"Audiobooks/Radio Plays/Play/01.mp3", "books", policyBitrate, channelsStereo},
+		{"Band/Demos/01.mp3", "demos", policyBitrate, channelsKeep},
+		{"Band/Album/01.flac", "hi-res", policyCopy, channelsKeep},
+		{"Classical/Album/01.mp3", "classical", policyCopy, channelsKeep},
+	}
+	for _, tt := range tests {
+		selection := s.Select(&MusicTreeNode{FilesystemPath: filepath.Join(root, filepath.FromSlash(tt.relPath))})
+		rule := ""
+		if selection.rule != nil {
+			rule = selection.rule.Name
+		}
+		if rule != tt.wantRule || selection.profile.Policy != tt.wantPolicy || selection.profile.Channels != tt.wantChannels {
+			t.Errorf("selection for '%s' = %s, want rule '%s' with policy %s and channels %s", tt.relPath, selection.Describe(), tt.wantRule, tt.wantPolicy, tt.wantChannels)
+		}
+		if selection.Skip() != (tt.wantRule == "demos") {
+			t.Errorf("Skip for '%s' = %v", tt.relPath, selection.Skip())
+		}
+	}
+	// tags are only read for files which no path-only rule matched first:
+	if tagsRead != 3 {
+		t.Errorf("tags were read %d times, want 3", tagsRead)
+	}
+}
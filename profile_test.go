@@ -0,0 +1,193 @@
+package main
+
+import "testing"
+
+// testProfile returns a valid profile with the given policy, codec, bitrate, and channel layout.
+func testProfile(policy, codec string, kbps int, channels string) EncodingProfile {
+	return EncodingProfile{
+		Policy:      policy,
+		Codec:       codec,
+		BitrateKbps: kbps,
+		Loudness:    loudnessOff,
+		CoverArt:    coverArtKeep,
+		Channels:    channels,
+	}
+}
+
+func lossyTestFile(codec string, kbps, channels int) *MusicTreeNode {
+	return &MusicTreeNode{IsFile: true, IsMusicFile: true, FileCodec: codec, FileBitrate: kbps * 1000, FileSampleRate: 44100, FileChannels: channels}
+}
+
+func losslessTestFile(codec string, sampleRate, bitDepth, channels int) *MusicTreeNode {
+	return &MusicTreeNode{
+		IsFile:         true,
+		IsMusicFile:    true,
+		FileCodec:      codec,
+		FileLossless:   true,
+		FileBitrate:    sampleRate * bitDepth * channels,
+		FileSampleRate: sampleRate,
+		FileBitDepth:   bitDepth,
+		FileChannels:   channels,
+	}
+}
+
+func TestProfileBitrates(t *testing.T) {
+	tests := []struct {
+		name              string
+		codec             string
+		kbps              int
+		quality           string
+		vbrMaxKbps        int
+		wantThreshold     int
+		wantMaxAcceptable int
+	}{
+		{"mp3", "libmp3lame", 192, "", 0, 194000, 194000},
+		{"aac", "aac", 256, "", 0, 261000, 261000},
+		{"opus", "libopus", 128, "", 0, 144000, 144000},
+		{"mp3 vbr", "libmp3lame", 192, "2", 0, 194000, 288000},
+		{"mp3 vbr with max", "libmp3lame", 192, "2", 320, 194000, 320000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testProfile(policyBitrate, tt.codec, tt.kbps, channelsKeep)
+			p.Quality = tt.quality
+			p.VBRMaxKbps = tt.vbrMaxKbps
+			if err := p.Validate(); err != nil {
+				t.Fatalf("invalid profile: %s", err)
+			}
+			if got := p.TranscodeThreshold(); got != tt.wantThreshold {
+				t.Errorf("TranscodeThreshold = %d, want %d", got, tt.wantThreshold)
+			}
+			if got := p.MaxAcceptableBitrate(); got != tt.wantMaxAcceptable {
+				t.Errorf("MaxAcceptableBitrate = %d, want %d", got, tt.wantMaxAcceptable)
+			}
+		})
+	}
+}
+
+func TestProfileValidateQuality(t *testing.T) {
+	tests := []struct {
+		codec   string
+		quality string
+		valid   bool
+	}{
+		{"libmp3lame", "0", true},
+		{"libmp3lame", "9", true},
+		{"libmp3lame", "10", false},
+		{"libvorbis", "-1", true},
+		{"libvorbis", "4.5", true},
+		{"aac", "0", false},
+		{"aac", "1.5", true},
+		{"libopus", "5", false},
+		{"libmp3lame", "V2", false},
+	}
+	for _, tt := range tests {
+		p := testProfile(policyBitrate, tt.codec, 192, channelsKeep)
+		p.Quality = tt.quality
+		if err := p.Validate(); (err == nil) != tt.valid {
+			t.Errorf("Validate with codec '%s' and quality '%s' = %v, want valid = %v", tt.codec, tt.quality, err, tt.valid)
+		}
+	}
+}
+
+func TestProfilePolicies(t *testing.T) {
+	mp3High := lossyTestFile("mp3", 320, 2)
+	mp3Low := lossyTestFile("mp3", 128, 2)
+	mp3Mono := lossyTestFile("mp3", 128, 1)
+	aacSurround := lossyTestFile("aac", 128, 6)
+	flacCD := losslessTestFile("flac", 44100, 16, 2)
+	flacHiRes := losslessTestFile("flac", 96000, 24, 2)
+	flacSurround := losslessTestFile("flac", 48000, 24, 6)
+	alacCD := losslessTestFile("alac", 44100, 16, 2)
+
+	limited := testProfile(policyBitrate, "flac", 900, channelsKeep)
+	limited.MaxSampleRate = 48000
+	limited.MaxBitDepth = 16
+
+	tests := []struct {
+		name          string
+		profile       EncodingProfile
+		file          *MusicTreeNode
+		wantTranscode bool
+		wantAccept    bool
+	}{
+		{"bitrate: high bitrate", testProfile(policyBitrate, "libmp3lame", 192, channelsKeep), mp3High, true, false},
+		{"bitrate: low bitrate", testProfile(policyBitrate, "libmp3lame", 192, channelsKeep), mp3Low, false, true},
+		{"bitrate: within tolerance", testProfile(policyBitrate, "libmp3lame", 127, channelsKeep), mp3Low, false, true},
+		{"bitrate: lossless", testProfile(policyBitrate, "libmp3lame", 192, channelsKeep), flacCD, true, false},
+		{"bitrate: surround", testProfile(policyBitrate, "libmp3lame", 192, channelsKeep), aacSurround, false, true},
+		{"bitrate, stereo: surround", testProfile(policyBitrate, "libmp3lame", 192, channelsStereo), aacSurround, true, false},
+		{"bitrate, stereo: stereo", testProfile(policyBitrate, "libmp3lame", 192, channelsStereo), mp3Low, false, true},
+		{"bitrate, mono: stereo", testProfile(policyBitrate, "libmp3lame", 192, channelsMono), mp3Low, true, false},
+		{"bitrate, mono: mono", testProfile(policyBitrate, "libmp3lame", 192, channelsMono), mp3Mono, false, true},
+
+		{"lossless: lossless", testProfile(policyLossless, "aac", 256, channelsKeep), flacCD, true, false},
+		{"lossless: high bitrate", testProfile(policyLossless, "aac", 256, channelsKeep), mp3High, true, false},
+		{"lossless: low bitrate", testProfile(policyLossless, "aac", 256, channelsKeep), mp3Low, false, true},
+		{"lossless, stereo: surround", testProfile(policyLossless, "aac", 256, channelsStereo), aacSurround, true, false},
+
+		{"lossless-only: lossless", testProfile(policyLosslessOnly, "aac", 256, channelsKeep), flacCD, true, false},
+		{"lossless-only: high bitrate", testProfile(policyLosslessOnly, "aac", 256, channelsKeep), mp3High, false, true},
+		{"lossless-only: surround", testProfile(policyLosslessOnly, "aac", 256, channelsKeep), aacSurround, false, true},
+		{"lossless-only, stereo: surround", testProfile(policyLosslessOnly, "aac", 256, channelsStereo), aacSurround, true, false},
+		{"lossless-only, stereo: high bitrate", testProfile(policyLosslessOnly, "aac", 256, channelsStereo), mp3High, false, true},
+
+		{"copy: lossless", testProfile(policyCopy, "aac", 256, channelsKeep), flacCD, false, true},
+		{"copy, stereo: surround", testProfile(policyCopy, "aac", 256, channelsStereo), flacSurround, false, true},
+
+		{"flac limits: within limits", limited, flacCD, false, true},
+		{"flac limits: over sample rate & bit depth", limited, flacHiRes, true, false},
+		{"flac limits: other lossless codec", limited, alacCD, false, true},
+		{"flac limits: lossy", limited, mp3High, false, true},
+		{"flac, stereo: surround", testProfile(policyBitrate, "flac", 900, channelsStereo), flacSurround, true, false},
+		{"flac, lossless: other lossless codec", testProfile(policyLossless, "flac", 900, channelsKeep), alacCD, true, false},
+		{"flac, lossless: same codec", testProfile(policyLossless, "flac", 900, channelsKeep), flacHiRes, false, true},
+		{"flac, lossless: lossy", testProfile(policyLossless, "flac", 900, channelsKeep), mp3High, false, true},
+		{"alac, lossless-only: other lossless codec", testProfile(policyLosslessOnly, "alac", 900, channelsKeep), flacCD, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.profile.Validate(); err != nil {
+				t.Fatalf("invalid profile: %s", err)
+			}
+			if got := tt.profile.NeedsTranscode(tt.file); got != tt.wantTranscode {
+				t.Errorf("NeedsTranscode = %v, want %v", got, tt.wantTranscode)
+			}
+			if got := tt.profile.AcceptsDestFile(tt.file); got != tt.wantAccept {
+				t.Errorf("AcceptsDestFile = %v, want %v", got, tt.wantAccept)
+			}
+		})
+	}
+}
+
+func TestProfileAcceptsVBRDestFiles(t *testing.T) {
+	vbr := testProfile(policyBitrate, "libmp3lame", 192, channelsKeep)
+	vbr.Quality = "2"
+	vbrWithMax := vbr
+	vbrWithMax.VBRMaxKbps = 320
+
+	withOperation := func(n *MusicTreeNode, operation string) *MusicTreeNode {
+		n.SyncState = &SyncStateEntry{Operation: operation}
+		return n
+	}
+	tests := []struct {
+		name    string
+		profile EncodingProfile
+		file    *MusicTreeNode
+		want    bool
+	}{
+		{"transcoded, within default max", vbr, withOperation(lossyTestFile("mp3", 256, 2), syncOpTranscode), true},
+		{"transcoded, over default max", vbr, withOperation(lossyTestFile("mp3", 300, 2), syncOpTranscode), false},
+		{"transcoded, within explicit max", vbrWithMax, withOperation(lossyTestFile("mp3", 300, 2), syncOpTranscode), true},
+		{"copied, over threshold", vbr, withOperation(lossyTestFile("mp3", 256, 2), syncOpCopy), false},
+		{"copied, within threshold", vbr, withOperation(lossyTestFile("mp3", 192, 2), syncOpCopy), true},
+		{"unknown origin, over threshold", vbr, lossyTestFile("mp3", 256, 2), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.AcceptsDestFile(tt.file); got != tt.want {
+				t.Errorf("AcceptsDestFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
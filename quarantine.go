@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"msync/dzutil"
+)
+
+const quarantineVersion = 1
+
+// defaultQuarantineAfter is the default value of the -quarantine-after flag.
+const defaultQuarantineAfter = 3
+
+// Quarantine is a persistent, on-disk record of source music files which failed to transcode, keyed by file
+// path, size, and modification time. Files which have failed to transcode (in as many runs) as the quarantine's
+// threshold are skipped until they change. It is safe for concurrent use.
+// A nil *Quarantine, used when the quarantine is disabled, records nothing and skips nothing.
+type Quarantine struct {
+	path          string
+	threshold     int
+	lock          sync.Mutex
+	entries       map[string]*quarantineEntry
+	failedThisRun map[string]bool // so a file failing for several destinations is only counted once per run
+}
+
+type quarantineEntry struct {
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mtime"`
+	Failures    int       `json:"failures"` // number of runs in which the file failed to transcode
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error"`
+}
+
+type quarantineFile struct {
+	Version int                         `json:"version"`
+	Entries map[string]*quarantineEntry `json:"entries"`
+}
+
+// DefaultQuarantinePath returns the default location for the quarantine, in the user's cache
+// directory. If that directory can't be determined, it returns an empty string.
+func DefaultQuarantinePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "msync", "failures.json")
+}
+
+// LoadQuarantine loads the quarantine stored at the given path. A missing quarantine file is not an error.
+// Files which have failed to transcode threshold times are quarantined.
+func LoadQuarantine(path string, threshold int) (*Quarantine, error) {
+	q := newQuarantine(path, threshold)
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read quarantine '%s': %w", path, err)
+	}
+	var f quarantineFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse quarantine '%s' (use `msync failures -clear` to discard it): %w", path, err)
+	}
+	if f.Version == quarantineVersion && f.Entries != nil {
+		q.entries = f.Entries
+	}
+	return q, nil
+}
+
+func newQuarantine(path string, threshold int) *Quarantine {
+	return &Quarantine{
+		path:          path,
+		threshold:     threshold,
+		entries:       make(map[string]*quarantineEntry),
+		failedThisRun: make(map[string]bool),
+	}
+}
+
+// entry returns the entry for the given source file, iff one exists and the file's size and
+// modification time match those recorded in it. The caller must hold q.lock.
+func (q *Quarantine) entry(n *MusicTreeNode) *quarantineEntry {
+	e, ok := q.entries[n.FilesystemPath]
+	if !ok || e.Size != n.FileSize || !e.ModTime.Equal(n.ModTime) {
+		return nil
+	}
+	return e
+}
+
+// Failures returns the number of runs in which the given source file, as it is now, failed to transcode.
+func (q *Quarantine) Failures(n *MusicTreeNode) int {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if e := q.entry(n); e != nil {
+		return e.Failures
+	}
+	return 0
+}
+
+// IsQuarantined returns true iff the given source file should be skipped, rather than transcoded, because
+// it has repeatedly failed to transcode.
+func (q *Quarantine) IsQuarantined(n *MusicTreeNode) bool {
+	return q != nil && q.Failures(n) >= q.threshold
+}
+
+// RecordFailure records that the given source file failed to transcode, with the given error.
+// Only failures of the file itself count; that is, ffmpeg exiting with an error, or timing out.
+func (q *Quarantine) RecordFailure(n *MusicTreeNode, err error) {
+	var execErr *dzutil.ExecError
+	if q == nil || !errors.As(err, &execErr) || (execErr.ExitCode < 0 && !execErr.TimedOut) {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.failedThisRun[n.FilesystemPath] {
+		return
+	}
+	q.failedThisRun[n.FilesystemPath] = true
+	e := q.entry(n)
+	if e == nil {
+		e = &quarantineEntry{Size: n.FileSize, ModTime: n.ModTime}
+		q.entries[n.FilesystemPath] = e
+	}
+	e.Failures++
+	e.LastFailure = time.Now()
+	e.LastError = err.Error()
+}
+
+// RecordSuccess records that the given source file was transcoded successfully, removing any record of its failures.
+func (q *Quarantine) RecordSuccess(n *MusicTreeNode) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	delete(q.entries, n.FilesystemPath)
+}
+
+// Clear removes the entries for the given source file paths, or all entries if none are given.
+// It returns the number of entries removed.
+func (q *Quarantine) Clear(paths []string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(paths) == 0 {
+		cleared := len(q.entries)
+		q.entries = make(map[string]*quarantineEntry)
+		return cleared
+	}
+	cleared := 0
+	for _, path := range paths {
+		if _, ok := q.entries[path]; ok {
+			delete(q.entries, path)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// Save prunes entries for files that no longer exist, then writes the quarantine to disk.
+func (q *Quarantine) Save() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for path := range q.entries {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(q.entries, path)
+		}
+	}
+
+	raw, err := json.Marshal(quarantineFile{
+		Version: quarantineVersion,
+		Entries: q.entries,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	if err := dzutil.WriteFileAtomic(q.path, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write quarantine: %w", err)
+	}
+	return nil
+}
+
+// failuresMain implements the `msync failures` command, which lists and clears the quarantine's entries.
+func failuresMain(args []string) error {
+	fs := flag.NewFlagSet("failures", flag.ExitOnError)
+	quarantinePath := fs.String("quarantine", DefaultQuarantinePath(), "Path to the file recording music files which failed to transcode.")
+	quarantineAfter := fs.Int("quarantine-after", defaultQuarantineAfter, "Number of runs in which a music file must fail to transcode before it's skipped.")
+	clear := fs.Bool("clear", false, "Clear the entries for the given source files, or all entries if none are given, so they'll be transcoded again.")
+	fs.Usage = func() {
+		fmt.Printf("Usage: %s failures [-quarantine PATH] [-clear] [SOURCE_FILE ...]\n", filepath.Base(os.Args[0]))
+		fmt.Printf("List the source music files which have failed to transcode, or clear their entries so they'll be transcoded again.\n\n")
+		fmt.Printf("Options:\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if *quarantinePath == "" {
+		return errors.New("-quarantine must be given, since the user cache directory can't be determined")
+	}
+
+	var paths []string
+	for _, arg := range fs.Args() {
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	q, err := LoadQuarantine(*quarantinePath, *quarantineAfter)
+	if err != nil && !*clear {
+		return err
+	}
+	if *clear {
+		if err != nil {
+			// an unreadable quarantine can only be cleared entirely:
+			if len(paths) > 0 {
+				return err
+			}
+			q = newQuarantine(*quarantinePath, *quarantineAfter)
+		}
+		cleared := q.Clear(paths)
+		if err := q.Save(); err != nil {
+			return err
+		}
+		fmt.Printf("Cleared %d entries from %s.\n", cleared, *quarantinePath)
+		return nil
+	}
+
+	listed := make(map[string]bool)
+	for _, path := range paths {
+		listed[path] = true
+	}
+	var entryPaths []string
+	for path := range q.entries {
+		if len(paths) == 0 || listed[path] {
+			entryPaths = append(entryPaths, path)
+		}
+	}
+	sort.Strings(entryPaths)
+	if len(entryPaths) == 0 {
+		fmt.Println("No music files have failed to transcode.")
+		return nil
+	}
+	for _, path := range entryPaths {
+		e := q.entries[path]
+		status := fmt.Sprintf("failed in %d runs", e.Failures)
+		if info, err := os.Stat(path); err != nil || info.Size() != e.Size || !info.ModTime().Equal(e.ModTime) {
+			status += "; it has changed since, and will be transcoded again"
+		} else if e.Failures >= q.threshold {
+			status += "; skipped until it changes"
+		}
+		fmt.Printf("%s (%s)\n", path, status)
+		fmt.Printf("  last failed %s: %s\n", e.LastFailure.Format(time.RFC3339), e.LastError)
+	}
+	return nil
+}
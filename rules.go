@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"msync/audioinfo"
+)
+
+const (
+	// ruleActionTranscode applies the rule's profile settings (the default action).
+	ruleActionTranscode = "transcode"
+	// ruleActionCopy copies matching files as-is, regardless of the transcoding policy.
+	ruleActionCopy = "copy"
+	// ruleActionSkip leaves matching files out of the destination entirely.
+	ruleActionSkip = "skip"
+)
+
+// Rule selects how source music files matching its conditions are synced.
+// Rules are loaded from the file given by -rules; for each file, the first matching rule applies.
+type Rule struct {
+	Name    string      `json:"name"`
+	Match   RuleMatch   `json:"match"`
+	Action  string      `json:"action,omitempty"`  // one of the ruleAction* constants; defaults to ruleActionTranscode
+	Profile RuleProfile `json:"profile,omitempty"` // with ruleActionTranscode, overrides for the base encoding profile
+}
+
+// RuleMatch holds a rule's conditions. All conditions given must match; a rule without conditions
+// matches every file. Tag conditions are case-insensitive globs (eg. "*classical*"), and match if any
+// of the file's values for that tag matches.
+type RuleMatch struct {
+	Path        string `json:"path,omitempty"` // glob matched against the file's path, relative to the source root (see matchPathGlob)
+	Genre       string `json:"genre,omitempty"`
+	AlbumArtist string `json:"album_artist,omitempty"`
+}
+
+// RuleProfile holds a rule's (or a destination's; see LoadDestinations) overrides for the base encoding
+// profile. Fields correspond to the command-line flags of the same name.
+type RuleProfile struct {
+	Codec           *string `json:"codec,omitempty"`
+	MaxKbps         *int    `json:"max_kbps,omitempty"`
+	Quality         *string `json:"quality,omitempty"`
+	VBRMaxKbps      *int    `json:"vbr_max_kbps,omitempty"`
+	TranscodePolicy *string `json:"transcode_policy,omitempty"`
+	MaxSampleRate   *int    `json:"max_sample_rate,omitempty"`
+	MaxBitDepth     *int    `json:"max_bit_depth,omitempty"`
+	Channels        *string `json:"channels,omitempty"`
+}
+
+type rulesFile struct {
+	Rules []*Rule `json:"rules"`
+}
+
+// LoadRules reads the rules in the given JSON file, and validates them against the given base profile.
+func LoadRules(rulesPath string, base EncodingProfile) ([]*Rule, error) {
+	data, err := ioutil.ReadFile(rulesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules from '%s': %w", rulesPath, err)
+	}
+	var f rulesFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse rules from '%s': %w", rulesPath, err)
+	}
+	for i, rule := range f.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if rule.Action == "" {
+			rule.Action = ruleActionTranscode
+		}
+		switch rule.Action {
+		case ruleActionTranscode, ruleActionCopy, ruleActionSkip:
+		default:
+			return nil, fmt.Errorf("rule '%s': unsupported action '%s' (must be one of: %s, %s, %s)", rule.Name, rule.Action, ruleActionTranscode, ruleActionCopy, ruleActionSkip)
+		}
+		for _, pattern := range []string{rule.Match.Genre, rule.Match.AlbumArtist} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule '%s': invalid pattern '%s': %w", rule.Name, pattern, err)
+			}
+		}
+		if err := validatePathGlob(rule.Match.Path); err != nil {
+			return nil, fmt.Errorf("rule '%s': invalid pattern '%s': %w", rule.Name, rule.Match.Path, err)
+		}
+		if err := rule.Apply(base).Validate(); err != nil {
+			return nil, fmt.Errorf("rule '%s': %w", rule.Name, err)
+		}
+	}
+	return f.Rules, nil
+}
+
+// NeedsTags returns true iff this rule matches on tags, which must then be read from each file.
+func (r *Rule) NeedsTags() bool {
+	return r.Match.Genre != "" || r.Match.AlbumArtist != ""
+}
+
+// Matches returns true iff this rule's conditions match the file with the given relative path and tags.
+// tags may be nil if the rule doesn't need them (see NeedsTags), or if they couldn't be read.
+func (r *Rule) Matches(relPath string, tags audioinfo.Tags) bool {
+	if r.Match.Path != "" && !matchPathGlob(r.Match.Path, relPath) {
+		return false
+	}
+	return matchTagGlob(r.Match.Genre, tags[audioinfo.TagGenre]) && matchTagGlob(r.Match.AlbumArtist, tags[audioinfo.TagAlbumArtist])
+}
+
+// matchTagGlob returns true iff pattern is empty, or any of the given tag values matches it.
+func matchTagGlob(pattern string, values []string) bool {
+	if pattern == "" {
+		return true
+	}
+	for _, v := range values {
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(v)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the given base profile, modified according to this rule.
+func (r *Rule) Apply(base EncodingProfile) EncodingProfile {
+	if r.Action == ruleActionCopy {
+		p := base
+		p.Policy = policyCopy
+		return p
+	}
+	return r.Profile.Apply(base)
+}
+
+// Apply returns the given base profile, with these overrides applied.
+func (o RuleProfile) Apply(base EncodingProfile) EncodingProfile {
+	p := base
+	if o.Codec != nil {
+		p.Codec = *o.Codec
+	}
+	if o.MaxKbps != nil {
+		p.BitrateKbps = *o.MaxKbps
+	}
+	if o.Quality != nil {
+		p.Quality = *o.Quality
+	}
+	if o.VBRMaxKbps != nil {
+		p.VBRMaxKbps = *o.VBRMaxKbps
+	}
+	if o.TranscodePolicy != nil {
+		p.Policy = *o.TranscodePolicy
+	}
+	if o.MaxSampleRate != nil {
+		p.MaxSampleRate = *o.MaxSampleRate
+	}
+	if o.MaxBitDepth != nil {
+		p.MaxBitDepth = *o.MaxBitDepth
+	}
+	if o.Channels != nil {
+		p.Channels = *o.Channels
+	}
+	return p
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"msync/audioinfo"
+)
+
+func TestLoadRules(t *testing.T) {
+	base := testProfile(policyBitrate, "aac", 256, channelsKeep)
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "rules.json", `{"rules": [
+		{"name": "books", "match": {"path": "Audiobooks"}, "profile": {"max_kbps": 64, "channels": "mono"}},
+		{"match": {"genre": "*classical*"}, "action": "copy"},
+		{"name": "demos", "match": {"path": "*/Demos"}, "action": "skip"}
+	]}`)
+	rules, err := LoadRules(path, base)
+	if err != nil {
+		t.Fatalf("LoadRules failed: %s", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("LoadRules returned %d rules, want 3", len(rules))
+	}
+	if rules[0].Action != ruleActionTranscode || rules[1].Name != "#2" {
+		t.Errorf("LoadRules didn't fill in defaults: %+v, %+v", rules[0], rules[1])
+	}
+	if p := rules[0].Apply(base); p.BitrateKbps != 64 || p.Channels != channelsMono || p.Codec != "aac" {
+		t.Errorf("rule 'books' applied = %+v", p)
+	}
+	if p := rules[1].Apply(base); p.Policy != policyCopy {
+		t.Errorf("copy rule applied = %+v, want policy %s", p, policyCopy)
+	}
+	if rules[0].NeedsTags() || !rules[1].NeedsTags() {
+		t.Errorf("NeedsTags = %v, %v, want false, true", rules[0].NeedsTags(), rules[1].NeedsTags())
+	}
+
+	invalid := map[string]string{
+		"action":  `{"rules": [{"action": "delete"}]}`,
+		"pattern": `{"rules": [{"match": {"genre": "[rock"}}]}`,
+		"path":    `{"rules": [{"match": {"path": "[Audiobooks"}}]}`,
+		"profile": `{"rules": [{"profile": {"channels": "quad"}}]}`,
+		"json":    `{"rules": [`,
+	}
+	for name, contents := range invalid {
+		path := writeTestFile(t, dir, name+".json", contents)
+		if _, err := LoadRules(path, base); err == nil {
+			t.Errorf("LoadRules succeeded with an invalid %s", name)
+		}
+	}
+	if _, err := LoadRules(filepath.Join(dir, "missing.json"), base); err == nil {
+		t.Errorf("LoadRules succeeded with a missing file")
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	rule := &Rule{Match: RuleMatch{Path: "Classical", Genre: "*classical*", AlbumArtist: "Berliner*"}}
+	tests := []struct {
+		name    string
+		relPath string
+		tags    audioinfo.Tags
+		want    bool
+	}{
+		{"all match", "Classical/Album/01.flac", audioinfo.Tags{audioinfo.TagGenre: {"Modern Classical"}, audioinfo.TagAlbumArtist: {"Berliner Philharmoniker"}}, true},
+		{"any tag value", "Classical/Album/01.flac", audioinfo.Tags{audioinfo.TagGenre: {"Jazz", "CLASSICAL"}, audioinfo.TagAlbumArtist: {"berliner philharmoniker"}}, true},
+		{"path mismatch", "Rock/Album/01.flac", audioinfo.Tags{audioinfo.TagGenre: {"Classical"}, audioinfo.TagAlbumArtist: {"Berliner Philharmoniker"}}, false},
+		{"genre mismatch", "Classical/Album/01.flac", audioinfo.Tags{audioinfo.TagGenre: {"Jazz"}, audioinfo.TagAlbumArtist: {"Berliner Philharmoniker"}}, false},
+		{"no tags", "Classical/Album/01.flac", nil, false},
+	}
+	for _, tt := range tests {
+		if got := rule.Matches(tt.relPath, tt.tags); got != tt.want {
+			t.Errorf("%s: Matches = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if !(&Rule{}).Matches("Any/01.mp3", nil) {
+		t.Errorf("a rule without conditions doesn't match every file")
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"msync/audioinfo"
+	"msync/dzutil"
+)
+
+const (
+	syncStateDirName  = ".msync"
+	syncStateFileName = "state.json"
+	syncStateVersion  = 1
+)
+
+// SyncState records, for each file msync has placed in a destination directory, the state of the
+// source file it was built from. It is stored in the destination directory, and is safe for concurrent use.
+type SyncState struct {
+	path       string
+	lock       sync.Mutex
+	entries    map[string]*SyncStateEntry
+	budgetKbps int
+}
+
+// SyncStateEntry describes how a single file in the destination directory was produced.
+type SyncStateEntry struct {
+	SourcePath      string          `json:"source_path"` // path of the source file, relative to the source root
+	SourceSize      int64           `json:"source_size"`
+	SourceModTime   time.Time       `json:"source_mtime"`
+	SourceHash      string          `json:"source_sha256,omitempty"`    // SHA-256 of the source file, iff -hash-sources was set when this entry was recorded
+	Operation       string          `json:"operation"`                  // one of the syncOp* constants
+	EncoderSettings string          `json:"encoder_settings,omitempty"` // ffmpeg codec options used to produce the file, iff it was transcoded (and the settings are known)
+	AlbumDigest     string          `json:"album_digest,omitempty"`     // albumDigest of the source file's album, iff the file was transcoded with album loudness normalization
+	DestSize        int64           `json:"dest_size"`
+	DestModTime     time.Time       `json:"dest_mtime"`
+	DestInfo        *audioinfo.Info `json:"dest_info,omitempty"` // probed properties of the destination file, as of DestSize/DestModTime
+	MsyncVersion    string          `json:"msync_version"`
+	SyncedAt        time.Time       `json:"synced_at"`
+}
+
+const (
+	syncOpCopy      = "copy"
+	syncOpSymlink   = "symlink"
+	syncOpHardlink  = "hardlink"
+	syncOpReflink   = "reflink"
+	syncOpTranscode = "transcode"
+	// syncOpExtractArt marks a cover art file extracted from the source file (see coverArtExtract).
+	syncOpExtractArt = "extract-art"
+)
+
+type syncStateFile struct {
+	Version    int                        `json:"version"`
+	BudgetKbps int                        `json:"budget_kbps,omitempty"` // base bitrate chosen by the last -max-size plan; see PlanSizeBudget
+	Entries    map[string]*SyncStateEntry `json:"entries"`
+}
+
+// LoadSyncState loads the sync state stored in the given destination root directory.
+// A missing state file is not an error.
+func LoadSyncState(destRootPath string) (*SyncState, error) {
+	s := &SyncState{
+		path:    filepath.Join(destRootPath, syncStateDirName, syncStateFileName),
+		entries: make(map[string]*SyncStateEntry),
+	}
+	raw, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync state '%s': %w", s.path, err)
+	}
+	var f syncStateFile
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state '%s': %w", s.path, err)
+	}
+	if f.Version == syncStateVersion {
+		s.budgetKbps = f.BudgetKbps
+		if f.Entries != nil {
+			s.entries = f.Entries
+		}
+	}
+	return s, nil
+}
+
+// Get returns the entry for the given destination path (relative to the destination root), or nil.
+func (s *SyncState) Get(destRelPath string) *SyncStateEntry {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.entries[destRelPath]
+}
+
+// Set records the entry for the given destination path (relative to the destination root).
+func (s *SyncState) Set(destRelPath string, e *SyncStateEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[destRelPath] = e
+}
+
+// BudgetKbps returns the base bitrate, in Kbps, chosen by the -max-size plan of the last sync to the
+// destination, or 0 if there was none.
+func (s *SyncState) BudgetKbps() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.budgetKbps
+}
+
+// SetBudgetKbps records the base bitrate, in Kbps, chosen by this sync's -max-size plan.
+func (s *SyncState) SetBudgetKbps(kbps int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.budgetKbps = kbps
+}
+
+// Save prunes entries for destination files that no longer exist, then writes the state to disk.
+func (s *SyncState) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	destRootPath := filepath.Dir(filepath.Dir(s.path))
+	for destRelPath := range s.entries {
+		if _, err := os.Stat(filepath.Join(destRootPath, destRelPath)); os.IsNotExist(err) {
+			delete(s.entries, destRelPath)
+		}
+	}
+
+	raw, err := json.MarshalIndent(syncStateFile{
+		Version:    syncStateVersion,
+		BudgetKbps: s.budgetKbps,
+		Entries:    s.entries,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create sync state directory: %w", err)
+	}
+	if err := dzutil.WriteFileAtomic(s.path, raw, 0644); err != nil {
+		return fmt.Errorf("failed to write sync state: %w", err)
+	}
+	return nil
+}
+
+// NewSyncStateEntry returns an entry recording that the destination file at the given path was
+// produced from the given source node via the given operation. destInfo may be nil if the
+// destination file's properties aren't known.
+func NewSyncStateEntry(sourceRootPath string, source *MusicTreeNode, destPath string, destInfo *audioinfo.Info, operation, encoderSettings string) (*SyncStateEntry, error) {
+	destStat, err := os.Stat(destPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat '%s': %w", destPath, err)
+	}
+	e := &SyncStateEntry{
+		SourcePath:      relativePath(sourceRootPath, source.FilesystemPath),
+		SourceSize:      source.FileSize,
+		SourceModTime:   source.ModTime,
+		Operation:       operation,
+		EncoderSettings: encoderSettings,
+		DestSize:        destStat.Size(),
+		DestModTime:     destStat.ModTime(),
+		DestInfo:        destInfo,
+		MsyncVersion:    version,
+		SyncedAt:        time.Now(),
+	}
+	if *hashSourcesFlag {
+		e.SourceHash, err = dzutil.FileSHA256(source.FilesystemPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash '%s': %w", source.FilesystemPath, err)
+		}
+	}
+	return e, nil
+}
+
+// AdoptSyncStateEntry returns an entry for a destination file which predates msync's state tracking.
+// It assumes the destination file is up to date with the given source node, and infers how it was produced.
+func AdoptSyncStateEntry(sourceRootPath string, source *MusicTreeNode, dest *MusicTreeNode) (*SyncStateEntry, error) {
+	operation := syncOpCopy
+	if lstat, err := os.Lstat(dest.FilesystemPath); err == nil && lstat.Mode()&os.ModeSymlink != 0 {
+		operation = syncOpSymlink
+	} else if !strings.EqualFold(filepath.Ext(dest.FilesystemPath), filepath.Ext(source.FilesystemPath)) {
+		operation = syncOpTranscode
+	}
+	return NewSyncStateEntry(sourceRootPath, source, dest.FilesystemPath, dest.AudioInfo(), operation, "")
+}
+
+// MatchesSource returns true iff this entry describes the current state of the given source node.
+// If the source's size and path are unchanged but its modification time differs, and this entry
+// includes a content hash, the source file is hashed and compared.
+func (e *SyncStateEntry) MatchesSource(sourceRootPath string, source *MusicTreeNode) bool {
+	if e.SourcePath != relativePath(sourceRootPath, source.FilesystemPath) || e.SourceSize != source.FileSize {
+		return false
+	}
+	if e.SourceModTime.Equal(source.ModTime) {
+		return true
+	}
+	if e.SourceHash == "" {
+		return false
+	}
+	hash, err := dzutil.FileSHA256(source.FilesystemPath)
+	return err == nil && hash == e.SourceHash
+}
+
+// syncStateProber wraps another AudioProber. For destination files whose size and modification time
+// match those recorded in the sync state, it returns the recorded properties instead of probing the file.
+type syncStateProber struct {
+	inner        AudioProber
+	state        *SyncState
+	destRootPath string
+}
+
+func (p syncStateProber) Name() string {
+	return p.inner.Name()
+}
+
+func (p syncStateProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	// entries recorded by older versions of msync may lack some properties; those files are re-probed.
+	if e := p.state.Get(relativePath(p.destRootPath, path)); e != nil && e.DestInfo != nil && e.DestInfo.Codec != "" {
+		if stat, err := os.Stat(path); err == nil && stat.Size() == e.DestSize && stat.ModTime().Equal(e.DestModTime) {
+			info := *e.DestInfo
+			return &info, nil
+		}
+	}
+	return p.inner.Probe(ctx, path)
+}
+
+// relativePath returns the given path relative to the given root path.
+func relativePath(rootPath, path string) string {
+	rel, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -1,33 +1,103 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"msync/audioinfo"
 	"msync/dzutil"
 )
 
-var bitrateRegex = regexp.MustCompile("bit rate: (\\d+) bits per second")
+const defaultProberSpec = "native,afinfo"
 
-// fileBitrate returns the bitrate of the file at the given path, as determined by macOS's afinfo command.
-// An error is returned if afinfo cannot be found, returns a nonzero exit code, or
-// produces no or un-parsable output.
-func fileBitrate(path string) (int, error) {
-	out, err := dzutil.Exec("afinfo", []string{path})
+var (
+	bitrateRegex    = regexp.MustCompile("bit rate: (\\d+) bits per second")
+	dataFormatRegex = regexp.MustCompile("Data format:\\s+(\\d+) ch,\\s+(\\d+) Hz, '(.{4})'")
+	bitDepthRegex   = regexp.MustCompile("(\\d+)-bit")
+	durationRegex   = regexp.MustCompile("estimated duration: ([\\d.]+) sec")
+	// afinfoUnsupportedRegex matches afinfo's report of Core Audio's unsupported file type or data format errors:
+	afinfoUnsupportedRegex = regexp.MustCompile("AudioFileOpen failed \\('(typ|fmt)\\?'\\)")
+)
+
+// afinfoCodecs maps the Core Audio format IDs reported by afinfo to audioinfo codec names.
+var afinfoCodecs = map[string]string{
+	"aac ": "aac",
+	"aach": "aac",
+	"aacp": "aac",
+	"ac-3": "ac3",
+	"alac": "alac",
+	"flac": "flac",
+	"lpcm": "pcm",
+	"opus": "opus",
+	".mp1": "mp1",
+	".mp2": "mp2",
+	".mp3": "mp3",
+}
+
+// afinfoProber determines audio properties using macOS's afinfo command.
+type afinfoProber struct {
+	timeout time.Duration // see dzutil.Exec
+}
+
+func newAfinfoProber(timeout time.Duration) (AudioProber, error) {
+	return afinfoProber{timeout: timeout}, nil
+}
+
+func (afinfoProber) Name() string {
+	return "afinfo"
+}
+
+// Probe returns the properties of the file at the given path, as determined by macOS's afinfo command.
+// An error is returned if afinfo cannot be found, returns a nonzero exit code, times out, or
+// produces no or un-parsable output. If Core Audio doesn't support the file's type or data format,
+// the error wraps audioinfo.ErrUnsupportedFormat.
+func (p afinfoProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	out, stderr, err := dzutil.Exec(ctx, p.timeout, "afinfo", []string{path})
+	if afinfoUnsupportedRegex.MatchString(out + "\n" + stderr) {
+		return nil, fmt.Errorf("%w: afinfo could not open '%s'", audioinfo.ErrUnsupportedFormat, path)
+	}
 	if err != nil {
-		return 0, fmt.Errorf("could not run afinfo to get bitrate: %w", err)
+		return nil, fmt.Errorf("could not run afinfo to get bitrate: %w", err)
 	}
 	if out == "" {
-		return 0, fmt.Errorf("afinfo returned no output for '%s'", path)
+		return nil, fmt.Errorf("afinfo returned no output for '%s'", path)
 	}
 	matches := bitrateRegex.FindStringSubmatch(out)
 	if len(matches) < 2 {
-		return 0, fmt.Errorf("failed to parse output from afinfo for '%s'", path)
+		return nil, fmt.Errorf("failed to parse output from afinfo for '%s'", path)
 	}
 	bitrate, err := strconv.Atoi(matches[1])
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse bitrate '%s' from afinfo for '%s'", matches[1], path)
+		return nil, fmt.Errorf("failed to parse bitrate '%s' from afinfo for '%s'", matches[1], path)
+	}
+	info := &audioinfo.Info{Bitrate: bitrate}
+
+	if matches := dataFormatRegex.FindStringSubmatch(out); len(matches) == 4 {
+		info.Channels, _ = strconv.Atoi(matches[1])
+		info.SampleRate, _ = strconv.Atoi(matches[2])
+		info.Codec = afinfoCodecs[matches[3]]
+		if info.Codec == "" {
+			info.Codec = strings.TrimSpace(matches[3])
+		}
+		info.Lossless = audioinfo.IsLosslessCodec(info.Codec)
+		if info.Lossless {
+			formatLine := out[strings.Index(out, matches[0]):]
+			if end := strings.IndexByte(formatLine, '\n'); end >= 0 {
+				formatLine = formatLine[:end]
+			}
+			if depthMatches := bitDepthRegex.FindStringSubmatch(formatLine); len(depthMatches) == 2 {
+				info.BitDepth, _ = strconv.Atoi(depthMatches[1])
+			}
+		}
+	}
+	if matches := durationRegex.FindStringSubmatch(out); len(matches) == 2 {
+		if seconds, err := strconv.ParseFloat(matches[1], 64); err == nil {
+			info.Duration = time.Duration(seconds * float64(time.Second))
+		}
 	}
-	return bitrate, nil
+	return info, nil
 }
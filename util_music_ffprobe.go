@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"msync/audioinfo"
+	"msync/dzutil"
+)
+
+// ffprobeOutput models the subset of `ffprobe -of json -show_streams -show_format` output used by msync.
+type ffprobeOutput struct {
+	Streams []ffprobeStream `json:"streams"`
+	Format  struct {
+		BitRate  string `json:"bit_rate"`
+		Duration string `json:"duration"`
+		Size     string `json:"size"`
+	} `json:"format"`
+}
+
+type ffprobeStream struct {
+	CodecType        string            `json:"codec_type"`
+	CodecName        string            `json:"codec_name"`
+	BitRate          string            `json:"bit_rate"`
+	Duration         string            `json:"duration"`
+	SampleRate       string            `json:"sample_rate"`
+	Channels         int               `json:"channels"`
+	BitsPerSample    int               `json:"bits_per_sample"`
+	BitsPerRawSample string            `json:"bits_per_raw_sample"`
+	Tags             map[string]string `json:"tags"`
+	Disposition      struct {
+		AttachedPic int `json:"attached_pic"`
+	} `json:"disposition"`
+}
+
+// ffprobeProber determines audio properties using ffprobe, which ships with ffmpeg.
+type ffprobeProber struct {
+	timeout time.Duration // see dzutil.Exec
+}
+
+func (ffprobeProber) Name() string {
+	return "ffprobe"
+}
+
+// Probe returns the properties of the file at the given path, as determined by ffprobe.
+// An error is returned if ffprobe cannot be found, returns a nonzero exit code, times out, or
+// produces no or un-parsable output. If ffprobe can't make sense of the file, or finds no audio
+// stream in it, the error wraps audioinfo.ErrUnsupportedFormat.
+//
+// The audio stream's bitrate is preferred. Some containers (eg. FLAC, Ogg, Matroska) don't report
+// a stream-level bitrate; in that case we fall back to the Matroska BPS tag, then to the container's
+// overall bitrate. The container bitrate includes any embedded cover art, so it may slightly
+// overestimate the audio bitrate.
+func (p ffprobeProber) Probe(ctx context.Context, path string) (*audioinfo.Info, error) {
+	out, _, err := dzutil.Exec(ctx, p.timeout, "ffprobe", []string{"-v", "error", "-of", "json", "-show_streams", "-show_format", path})
+	var execErr *dzutil.ExecError
+	if errors.As(err, &execErr) && execErr.ExitCode > 0 && strings.Contains(execErr.StderrTail, "Invalid data found when processing input") {
+		return nil, fmt.Errorf("%w: ffprobe could not read '%s'", audioinfo.ErrUnsupportedFormat, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not run ffprobe to get bitrate: %w", err)
+	}
+	if out == "" {
+		return nil, fmt.Errorf("ffprobe returned no output for '%s'", path)
+	}
+	var parsed ffprobeOutput
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse output from ffprobe for '%s'", path)
+	}
+
+	var audioStream *ffprobeStream
+	for i, s := range parsed.Streams {
+		// cover art shows up as a video stream with the attached_pic disposition; skip it and any other non-audio streams:
+		if s.CodecType == "audio" && s.Disposition.AttachedPic == 0 {
+			audioStream = &parsed.Streams[i]
+			break
+		}
+	}
+	if audioStream == nil {
+		return nil, fmt.Errorf("%w: ffprobe found no audio stream in '%s'", audioinfo.ErrUnsupportedFormat, path)
+	}
+
+	info := &audioinfo.Info{
+		Codec:    audioinfo.NormalizeCodecName(audioStream.CodecName),
+		Channels: audioStream.Channels,
+	}
+	info.Lossless = audioinfo.IsLosslessCodec(info.Codec)
+	info.SampleRate, _ = strconv.Atoi(audioStream.SampleRate)
+	if info.Lossless {
+		// bits_per_raw_sample is set for eg. FLAC and ALAC; bits_per_sample for PCM:
+		info.BitDepth, _ = strconv.Atoi(audioStream.BitsPerRawSample)
+		if info.BitDepth == 0 {
+			info.BitDepth = audioStream.BitsPerSample
+		}
+	}
+	duration := audioStream.Duration
+	if duration == "" || duration == "N/A" {
+		duration = parsed.Format.Duration
+	}
+	seconds, durErr := strconv.ParseFloat(duration, 64)
+	if durErr == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	candidates := []string{audioStream.BitRate, audioStream.Tags["BPS"], parsed.Format.BitRate}
+	for _, c := range candidates {
+		if c == "" || c == "N/A" {
+			continue
+		}
+		bitrate, err := strconv.Atoi(c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bitrate '%s' from ffprobe for '%s'", c, path)
+		}
+		if bitrate > 0 {
+			info.Bitrate = bitrate
+			return info, nil
+		}
+	}
+
+	// as a last resort, derive the bitrate from the file size and duration:
+	size, sizeErr := strconv.ParseInt(parsed.Format.Size, 10, 64)
+	if durErr != nil || sizeErr != nil || seconds <= 0 {
+		return nil, fmt.Errorf("failed to parse output from ffprobe for '%s'", path)
+	}
+	info.Bitrate = int(float64(size*8) / seconds)
+	return info, nil
+}
@@ -0,0 +1,15 @@
+//go:build !darwin
+// +build !darwin
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const defaultProberSpec = "native,ffprobe"
+
+func newAfinfoProber(timeout time.Duration) (AudioProber, error) {
+	return nil, errors.New("the afinfo prober is only available on macOS")
+}